@@ -0,0 +1,149 @@
+// Package events defines the messages the itaic services send each other over RabbitMQ.
+// Every message is an Event envelope with a typed payload, so consumers can tell a like
+// from an edit and skip anything they don't understand.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Version ... Schema version of the envelope and payloads produced by this package
+const Version = 1
+
+// ContentType ... Content type of a published event
+const ContentType = "application/json"
+
+// Exchange ... Durable topic exchange events are published to, with the event type as the
+// routing key so consumers can bind to patterns like "post.*"
+const Exchange = "itaic.events"
+
+// Event types
+const (
+	PostCreated    = "post.created"
+	PostReady      = "post.ready"
+	PostUpdated    = "post.updated"
+	PostLiked      = "post.liked"
+	PostUnliked    = "post.unliked"
+	PostDeleted    = "post.deleted"
+	CommentAdded   = "comment.added"
+	CommentUpdated = "comment.updated"
+	CommentLiked   = "comment.liked"
+	CommentUnliked = "comment.unliked"
+	CommentDeleted = "comment.deleted"
+	UserCreated    = "user.created"
+	UserUpdated    = "user.updated"
+	UserFollowed   = "user.followed"
+	UserUnfollowed = "user.unfollowed"
+	UserDeleted    = "user.deleted"
+	MediaRequested = "media.requested"
+	// DeletionRequested ... A job to delete a user's account and everything they left behind
+	DeletionRequested = "user.deletion_requested"
+	// ExportRequested ... A job to build an archive of everything a user has put on the API
+	ExportRequested = "user.export_requested"
+)
+
+// ErrUnsupportedVersion ... Returned by Parse for events newer than this package understands
+var ErrUnsupportedVersion = errors.New("unsupported event version")
+
+// Event ... The envelope every message is sent in
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Post ... Payload of the post.* events
+type Post struct {
+	ID  string `json:"id"`
+	UID string `json:"uid"`
+	// Score ... The post's creation time in milliseconds, where timelines sort it
+	Score int64 `json:"score,omitempty"`
+}
+
+// Comment ... Payload of the comment.* events
+type Comment struct {
+	PostID    string `json:"post_id"`
+	CommentID string `json:"comment_id"`
+	// ParentID ... The comment it replies to, so the cache knows which thread a new comment is
+	// in. Empty for a top level comment, and on events whose publisher didn't look the comment up.
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// Media ... Payload of the media.requested event, a job to make the images uploaded with a post
+// into the sizes they're shown at
+type Media struct {
+	PostID string      `json:"post_id"`
+	UID    string      `json:"uid"`
+	Items  []MediaItem `json:"items"`
+}
+
+// MediaItem ... One upload in a media job
+type MediaItem struct {
+	// ID ... The id of the post's media item the upload is for
+	ID string `json:"id"`
+	// Key ... Where the original upload is kept in blob storage
+	Key string `json:"key"`
+}
+
+// User ... Payload of the user.created, user.updated, user.deleted, user.deletion_requested and
+// user.export_requested events
+type User struct {
+	UID string `json:"uid"`
+}
+
+// Follow ... Payload of the user.followed and user.unfollowed events
+type Follow struct {
+	Follower string `json:"follower"`
+	Followee string `json:"followee"`
+}
+
+// New ... Wraps payload in an envelope stamped with a fresh id and the current time
+func New(eventType, actor string, payload interface{}) (Event, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:         newID(),
+		Type:       eventType,
+		Version:    Version,
+		OccurredAt: time.Now().UTC(),
+		Actor:      actor,
+		Payload:    raw,
+	}, nil
+}
+
+// Parse ... Reads an event from a message body
+func Parse(body []byte) (Event, error) {
+	e := Event{}
+	err := json.Unmarshal(body, &e)
+	if err != nil {
+		return e, err
+	}
+	if e.Type == "" {
+		return e, errors.New("event has no type")
+	}
+	if e.Version > Version {
+		return e, ErrUnsupportedVersion
+	}
+	return e, nil
+}
+
+// Decode ... Reads the payload into v
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 
@@ -15,17 +15,30 @@ import (
 func main() {
 	fmt.Println("[ * ] Gateway starting....")
 
-	router := goji.NewMux()
+	dbURL := getEnv("ITAIC_DB_API", "http://db-api:8000")
+	cacheURL := getEnv("ITAIC_CACHE_API", "http://cache-api:5000")
+	searchURL := getEnv("ITAIC_SEARCH_API", "http://search:8003")
+	addr := getEnv("GATEWAY_ADDR", ":6000")
+
+	gw, err := NewGateway(dbURL, cacheURL, searchURL)
+	if err != nil {
+		log.Fatal("[ ! ] Error configuring upstreams: ", err)
+	}
 
-	router.HandleFunc(pat.Get("/api/posts"), func(res http.ResponseWriter, req *http.Request) {
-		result, err := http.Get("http://176.24.0.13/posts")
-		if err != nil {
-			fmt.Println("[ ! ] Error calling endpoint")
-		}
-		defer result.Body.Close()
+	router := goji.NewMux()
+	router.Handle(pat.New("/api/*"), http.StripPrefix("/api", gw))
 
-		json.NewEncoder(res).Encode(&result.Body)
-	})
+	fmt.Println("[ > ] db api: ", dbURL)
+	fmt.Println("[ > ] cache api: ", cacheURL)
+	fmt.Println("[ > ] search service: ", searchURL)
+	fmt.Println("[ + ] Gateway started")
+	log.Fatal(http.ListenAndServe(addr, handlers.LoggingHandler(os.Stdout, router)))
+}
 
-	http.ListenAndServe(":6000", handlers.LoggingHandler(os.Stdout, router))
+// getEnv ... Returns the value of an environment variable or a fallback if it is unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
 }
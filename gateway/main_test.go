@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+func upstream(name string, status int, headers ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("X-Upstream", name)
+		for i := 0; i+1 < len(headers); i += 2 {
+			res.Header().Set(headers[i], headers[i+1])
+		}
+		res.WriteHeader(status)
+		io.WriteString(res, req.Method+" "+req.URL.RequestURI())
+	}))
+}
+
+func Router(t *testing.T, dbURL, cacheURL, searchURL string) *goji.Mux {
+	gw, err := NewGateway(dbURL, cacheURL, searchURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := goji.NewMux()
+	router.Handle(pat.New("/api/*"), http.StripPrefix("/api", gw))
+	return router
+}
+
+func TestGatewayRouting(t *testing.T) {
+	db := upstream("db", http.StatusCreated)
+	defer db.Close()
+	hit := upstream("cache", http.StatusOK)
+	defer hit.Close()
+	miss := upstream("cache", http.StatusNotFound)
+	defer miss.Close()
+	gone := upstream("cache", http.StatusNotFound, "X-Cache", "hit")
+	defer gone.Close()
+	search := upstream("search", http.StatusOK)
+	defer search.Close()
+
+	cases := []struct {
+		name, cache, method, path, upstream, body string
+		status                                    int
+	}{
+		{"read from cache", hit.URL, "GET", "/api/posts?limit=2", "cache", "GET /posts?limit=2", http.StatusOK},
+		{"fall back on miss", miss.URL, "GET", "/api/posts/abc", "db", "GET /posts/abc", http.StatusCreated},
+		{"cached not found", gone.URL, "GET", "/api/posts/gone", "cache", "GET /posts/gone", http.StatusNotFound},
+		{"fall back on error", "http://127.0.0.1:1", "GET", "/api/user/abc", "db", "GET /user/abc", http.StatusCreated},
+		{"writes go to db", hit.URL, "POST", "/api/posts", "db", "POST /posts", http.StatusCreated},
+		{"comments from cache", hit.URL, "GET", "/api/posts/abc/comments?limit=5", "cache", "GET /posts/abc/comments?limit=5", http.StatusOK},
+		{"timelines aren't proxied to cache", hit.URL, "GET", "/api/timeline/abc", "db", "GET /timeline/abc", http.StatusCreated},
+		{"dead letters aren't proxied to cache", hit.URL, "GET", "/api/admin/dlq", "db", "GET /admin/dlq", http.StatusCreated},
+		{"other reads go to db", hit.URL, "GET", "/api/user/abc/followers", "db", "GET /user/abc/followers", http.StatusCreated},
+		{"searches go to search", hit.URL, "GET", "/api/search?q=beach&type=tags", "search", "GET /search?q=beach&type=tags", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(""))
+		res := httptest.NewRecorder()
+		Router(t, db.URL, c.cache, search.URL).ServeHTTP(res, req)
+
+		if res.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, res.Code)
+		}
+		if got := res.Header().Get("X-Upstream"); got != c.upstream {
+			t.Errorf("%s: expected upstream %q, got %q", c.name, c.upstream, got)
+		}
+		if got := res.Body.String(); got != c.body {
+			t.Errorf("%s: expected body %q, got %q", c.name, c.body, got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"goji.io/pat"
+)
+
+type contextKey string
+
+const originalRequestKey contextKey = "original-request"
+
+var errCacheMiss = errors.New("cache miss")
+
+// cacheRoutes ... The public reads the cache api serves. Its other routes, like timelines and the
+// dead letter queue, are only for the other services and are never proxied to it.
+var cacheRoutes = []*pat.Pattern{
+	pat.Get("/posts"),
+	pat.Get("/posts/:id"),
+	pat.Get("/posts/:id/comments"),
+	pat.Get("/user/:uid"),
+}
+
+// Gateway ... Proxies reads to the cache api, searches to the search service and writes to the
+// db api
+type Gateway struct {
+	db     *httputil.ReverseProxy
+	cache  *httputil.ReverseProxy
+	search *httputil.ReverseProxy
+}
+
+// NewGateway ... Builds a gateway for the given db api, cache api and search service base urls
+func NewGateway(dbURL, cacheURL, searchURL string) (*Gateway, error) {
+	dbTarget, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing db api url: %v", err)
+	}
+
+	cacheTarget, err := url.Parse(cacheURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cache api url: %v", err)
+	}
+
+	searchTarget, err := url.Parse(searchURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing search service url: %v", err)
+	}
+
+	gw := &Gateway{
+		db:     httputil.NewSingleHostReverseProxy(dbTarget),
+		cache:  httputil.NewSingleHostReverseProxy(cacheTarget),
+		search: httputil.NewSingleHostReverseProxy(searchTarget),
+	}
+
+	// anything the cache can't answer is treated as a miss so the request can
+	// be retried against the db api before a single byte reaches the client.
+	// A 404 with X-Cache set is the cache saying the db api doesn't have it
+	// either, rather than a route the cache doesn't serve.
+	gw.cache.ModifyResponse = func(res *http.Response) error {
+		notFound := res.StatusCode == http.StatusNotFound && res.Header.Get("X-Cache") == ""
+		if notFound || res.StatusCode >= http.StatusInternalServerError {
+			res.Body.Close()
+			return errCacheMiss
+		}
+		return nil
+	}
+	gw.cache.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		if err != errCacheMiss {
+			fmt.Println("[ ! ] Error calling cache api: ", err)
+		}
+
+		// retry with the request as the client sent it, not the one already
+		// rewritten for the cache
+		original, ok := req.Context().Value(originalRequestKey).(*http.Request)
+		if !ok {
+			original = req
+		}
+		gw.db.ServeHTTP(res, original)
+	}
+	gw.db.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		fmt.Println("[ ! ] Error calling db api: ", err)
+		res.WriteHeader(http.StatusBadGateway)
+	}
+	gw.search.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		fmt.Println("[ ! ] Error calling search service: ", err)
+		res.WriteHeader(http.StatusBadGateway)
+	}
+
+	return gw, nil
+}
+
+// ServeHTTP ... Sends searches to the search service, reads the cache serves to the cache first and
+// everything else to the db api
+func (gw *Gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/search" {
+		gw.search.ServeHTTP(res, req)
+		return
+	}
+
+	if !cached(req) {
+		gw.db.ServeHTTP(res, req)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), originalRequestKey, req)
+	gw.cache.ServeHTTP(res, req.WithContext(ctx))
+}
+
+// cached ... Whether a request is one of the reads the cache serves
+func cached(req *http.Request) bool {
+	for _, route := range cacheRoutes {
+		if route.Match(req) != nil {
+			return true
+		}
+	}
+	return false
+}
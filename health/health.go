@@ -0,0 +1,44 @@
+// Package health serves the state of a service's connections to the things it depends on.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Status ... The state of one dependency
+type Status struct {
+	OK bool `json:"ok"`
+	// Since ... When the dependency last went up or down, zero if it's never been reached
+	Since time.Time `json:"since"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Check ... Reports the state of a dependency
+type Check func() Status
+
+// Handler ... Serves the state of every check, responding 503 if any of them is down
+func Handler(checks map[string]Check) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		result := struct {
+			Status string            `json:"status"`
+			Checks map[string]Status `json:"checks"`
+		}{"ok", map[string]Status{}}
+
+		for name, check := range checks {
+			status := check()
+			if !status.OK {
+				result.Status = "unavailable"
+			}
+			result.Checks[name] = status
+		}
+
+		if result.Status != "ok" {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(res).Encode(&result)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
+	"goji.io/pat"
+)
+
+// commentPage ... One page of a post's comments or of the replies to one
+type commentPage struct {
+	Comments   []models.Comment `json:"comments"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// threadKey ... Where the comments on a post with the given parent are cached, the top level
+// ones when parentID is empty. A thread is cached whole, oldest first, as the db api lists it.
+func threadKey(postID, parentID string) string {
+	return "comments:" + postID + ":" + parentID
+}
+
+// threadsKey ... Set of the parent ids of a post's threads that are cached, so events about its
+// comments know which ones to refresh
+func threadsKey(postID string) string {
+	return "threads:" + postID
+}
+
+// HandleGetComments ... Gets a page of a post's comments oldest first, or of the replies to the
+// comment in ?parent_id=, reading the thread through to the db api if it isn't cached. Comments
+// show their author's current username, like they do from the db api.
+func HandleGetComments(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		postID := pat.Param(req, "id")
+
+		limit := 20
+		if raw := req.URL.Query().Get("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 || parsed > 100 {
+				writeError(res, http.StatusBadRequest, "validation", "limit must be a number from 1 to 100")
+				return
+			}
+			limit = parsed
+		}
+
+		// comments are paged by the same created time and id as posts
+		var last *PostCursor
+		if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+			after, err := decodePostCursor(cursor)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, "validation", "invalid cursor")
+				return
+			}
+			last = &after
+		}
+
+		thread, hit, err := getThread(postID, req.URL.Query().Get("parent_id"), client)
+		if err != nil {
+			serveCached(res, "post", "", hit, err)
+			return
+		}
+
+		comments := []models.Comment{}
+		err = json.Unmarshal([]byte(thread), &comments)
+		if err != nil {
+			fmt.Println("[ ! ] Error unmarshaling comments: ", err)
+			writeError(res, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+
+		start := 0
+		for last != nil && start < len(comments) && !after(comments[start], *last) {
+			start++
+		}
+		comments = comments[start:]
+
+		next := ""
+		if len(comments) > limit {
+			comments = comments[:limit]
+			end := comments[limit-1]
+			next = encodePostCursor(PostCursor{Created: end.Created, ID: end.ID})
+		}
+
+		withUsernames(comments, client)
+		res.Header().Set("X-Cache", cacheStatus(hit))
+		json.NewEncoder(res).Encode(&commentPage{Comments: comments, NextCursor: next})
+	}
+}
+
+// after ... Whether a comment comes after the cursor, oldest first
+func after(c models.Comment, last PostCursor) bool {
+	if c.Created.Equal(last.Created) {
+		return c.ID > last.ID
+	}
+	return c.Created.After(last.Created)
+}
+
+// withUsernames ... Shows each author's current username on their comments, from the cached users.
+// Authors who are gone keep the username the comment was written with.
+func withUsernames(comments []models.Comment, client *redis.Client) {
+	uids := []string{}
+	seen := map[string]bool{}
+	for _, c := range comments {
+		if !seen[c.UID] {
+			seen[c.UID] = true
+			uids = append(uids, c.UID)
+		}
+	}
+
+	usernames := map[string]string{}
+	for _, user := range readUsers(uids, client) {
+		usernames[user.UID] = user.Username
+	}
+	for i, c := range comments {
+		if username, ok := usernames[c.UID]; ok {
+			comments[i].Username = username
+		}
+	}
+}
+
+// getThread ... Gets the JSON list of a thread's comments from the cache, fetching it from the db
+// api on a miss. The thread is listed under its post before it's fetched, so an event arriving
+// while the fetch is in flight refreshes it rather than leaving what was fetched to go stale.
+func getThread(postID, parentID string, client *redis.Client) (string, bool, error) {
+	key := threadKey(postID, parentID)
+	return readThrough(key, client, func() error {
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.SAdd(threadsKey(postID), parentID)
+			pipe.Expire(threadsKey(postID), entryTTL)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		comments, err := fetchThread(postID, parentID)
+		if err == errNotFound {
+			return client.SetNX(key, missing, missingTTL).Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		mc, err := json.Marshal(comments)
+		if err != nil {
+			return err
+		}
+		return client.SetNX(key, mc, entryTTL).Err()
+	})
+}
+
+// RefreshComments ... Brings the cached threads of a post up to date after one of its comments
+// changed, refetching only the thread the comment is in. Adding or deleting a comment also changes
+// its parent's reply count, so the post's other threads are dropped and read through again, along
+// with the replies to a deleted comment.
+func RefreshComments(comment events.Comment, eventType string, client *redis.Client) error {
+	postID := comment.PostID
+	parents, err := client.SMembers(threadsKey(postID)).Result()
+	if err != nil {
+		return err
+	}
+
+	added := eventType == events.CommentAdded
+	changed := added || eventType == events.CommentDeleted
+	thread, known := comment.ParentID, comment.ParentID != "" || added
+	if !known {
+		thread, known, err = findThread(postID, comment.CommentID, parents, client)
+		if err != nil {
+			return err
+		}
+	}
+
+	dropped := []string{}
+	for _, parentID := range parents {
+		if known && parentID == thread {
+			err = refreshThread(postID, parentID, client)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		// a fill in progress would cache what it fetched after the thread was dropped, so its
+		// thread is refreshed instead and the fill, which only writes a missing entry, leaves it
+		filling, err := client.Exists(lockKey(threadKey(postID, parentID))).Result()
+		if err != nil {
+			return err
+		}
+		if filling == 1 {
+			err = refreshThread(postID, parentID, client)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		dropped = append(dropped, parentID)
+	}
+
+	if len(parents) == 0 {
+		return nil
+	}
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, parentID := range dropped {
+			pipe.Del(threadKey(postID, parentID))
+			pipe.SRem(threadsKey(postID), parentID)
+		}
+		pipe.Expire(threadsKey(postID), entryTTL)
+		return nil
+	})
+	return err
+}
+
+// findThread ... Looks through a post's cached threads for the one a comment is in, for events
+// that don't say. A comment in none of them has no cached thread to refresh.
+func findThread(postID, commentID string, parents []string, client *redis.Client) (string, bool, error) {
+	for _, parentID := range parents {
+		thread, err := client.Get(threadKey(postID, parentID)).Result()
+		if err == redis.Nil || thread == missing {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		comments := []models.Comment{}
+		err = json.Unmarshal([]byte(thread), &comments)
+		if err != nil {
+			return "", false, err
+		}
+		for _, c := range comments {
+			if c.ID == commentID {
+				return parentID, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// refreshThread ... Refetches one cached thread from the db api
+func refreshThread(postID, parentID string, client *redis.Client) error {
+	key := threadKey(postID, parentID)
+	comments, err := fetchThread(postID, parentID)
+	if err == errNotFound {
+		return client.Set(key, missing, missingTTL).Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	mc, err := json.Marshal(comments)
+	if err != nil {
+		return err
+	}
+	return client.Set(key, mc, entryTTL).Err()
+}
+
+// DropComments ... Evicts every cached thread of a deleted post
+func DropComments(postID string, client *redis.Client) error {
+	parents, err := client.SMembers(threadsKey(postID)).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{threadsKey(postID)}
+	for _, parentID := range parents {
+		keys = append(keys, threadKey(postID, parentID))
+	}
+	return client.Del(keys...).Err()
+}
+
+// fetchThread ... Gets every comment in a thread from the db api, a page at a time, or errNotFound
+// if it doesn't have the post
+func fetchThread(postID, parentID string) ([]models.Comment, error) {
+	comments := []models.Comment{}
+	cursor := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", "100")
+		if parentID != "" {
+			query.Set("parent_id", parentID)
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		page := commentPage{}
+		err := fetch("/posts/"+url.PathEscape(postID)+"/comments?"+query.Encode(), &page)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, page.Comments...)
+
+		if page.NextCursor == "" {
+			return comments, nil
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/health"
+	"github.com/streadway/amqp"
+)
+
+// ErrDisconnected ... Returned when there's no open channel to RabbitMQ
+var ErrDisconnected = errors.New("not connected to RabbitMQ")
+
+// Backoff between attempts to connect
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Conn ... Keeps a channel to RabbitMQ open, redialing with backoff whenever the connection drops.
+// It works the same as the one in itaic/mq, each service builds against its own amqp package.
+type Conn struct {
+	url string
+
+	mu        sync.Mutex
+	ch        *amqp.Channel
+	onConnect []func(ch *amqp.Channel) error
+	status    health.Status
+}
+
+// NewConn ... Creates a connection manager for url, which starts dialing once Run is called
+func NewConn(url string) *Conn {
+	return &Conn{url: url, status: health.Status{Error: "not connected yet"}}
+}
+
+// OnConnect ... Registers a function to run on every new channel before it's handed out.
+// Register everything before calling Run.
+func (c *Conn) OnConnect(fn func(ch *amqp.Channel) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onConnect = append(c.onConnect, fn)
+}
+
+// Run ... Connects and stays connected, it never returns
+func (c *Conn) Run() {
+	backoff := minBackoff
+	for {
+		closed, err := c.connect()
+		if err != nil {
+			fmt.Println("[ ! ] Error connecting to RabbitMQ, retrying in "+backoff.String()+": ", err)
+			c.down(err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		fmt.Println("[ + ] Connected to RabbitMQ")
+		backoff = minBackoff
+		err = <-closed
+		fmt.Println("[ ! ] Lost connection to RabbitMQ: ", err)
+		c.down(err)
+	}
+}
+
+// connect ... Dials, opens a channel and runs the OnConnect functions, returning a channel that
+// reports when the connection or the channel closes
+func (c *Conn) connect() (<-chan error, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	hooks := c.onConnect
+	c.mu.Unlock()
+	for _, fn := range hooks {
+		err := fn(ch)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// closing the connection closes the channel, so a dropped channel takes the connection with it
+	closed := make(chan error, 1)
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		}
+		conn.Close()
+		if reason == nil {
+			closed <- errors.New("connection closed")
+			return
+		}
+		closed <- reason
+	}()
+
+	c.mu.Lock()
+	c.ch = ch
+	c.status = health.Status{OK: true, Since: time.Now().UTC()}
+	c.mu.Unlock()
+	return closed, nil
+}
+
+func (c *Conn) down(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ch = nil
+	if c.status.OK || c.status.Since.IsZero() {
+		c.status.Since = time.Now().UTC()
+	}
+	c.status.OK = false
+	c.status.Error = err.Error()
+}
+
+// Channel ... Gets the open channel, or ErrDisconnected while reconnecting
+func (c *Conn) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ch == nil {
+		return nil, ErrDisconnected
+	}
+	return c.ch, nil
+}
+
+// Health ... Reports whether the connection is up
+func (c *Conn) Health() health.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/handlers"
 
 	"github.com/go-redis/redis"
-	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
-	"github.com/streadway/amqp"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/health"
 
 	"goji.io"
 	"goji.io/pat"
 )
 
+// dbAPI ... Where the database API lives
+var dbAPI = getEnv("ITAIC_DB_API", "http://176.24.0.3:8000")
+
+// dbClient ... Calls the db api. A fill holds its lock for at most lockTTL, so a request that takes
+// longer is given up on rather than left for the lock to expire under it and another fill to start.
+var dbClient = &http.Client{Timeout: dbTimeout}
+
+// dbTimeout ... How long a call to the db api can take
+const dbTimeout = 4 * time.Second
+
 func main() {
 	fmt.Println("[ * ] Starting cache API....")
 	client := redis.NewClient(&redis.Options{
@@ -26,155 +35,211 @@ func main() {
 	})
 
 	defer client.Close()
-	fmt.Println("[ * ] Initializing cache")
-	res, err := http.Get("http://176.24.0.3:8000/posts")
-	if err != nil {
-		fmt.Println("[ ! ] Error making request to db api: ", err)
-	}
+	WaitForRedis(client)
 
-	posts := []models.Post{}
-	err = json.NewDecoder(res.Body).Decode(&posts)
+	fmt.Println("[ * ] Initializing cache")
+	err := LoadPosts(client)
 	if err != nil {
-		fmt.Println("[ ! ] Error decoding response body")
+		fmt.Println("[ ! ] Error loading posts from db api: ", err)
 	}
 
-	for _, post := range posts {
-		mp, err := json.Marshal(post)
-		if err != nil {
-			fmt.Println("[ ! ] Error marshaling post: ", err)
-		}
-
-		_ = client.HSet("posts", post.ID, mp)
-	}
+	conn := NewConn(getEnv("ITAIC_RABBITMQ_URL", "amqp://176.24.0.9:5672"))
+	queue := NewQueue(conn, client)
+	go conn.Run()
 
 	router := goji.NewMux()
 	router.HandleFunc(pat.Get("/posts"), HandleGetAllPosts(client))
 	router.HandleFunc(pat.Get("/posts/:id"), HandleGetPostByID(client))
+	router.HandleFunc(pat.Get("/posts/:id/comments"), HandleGetComments(client))
+	router.HandleFunc(pat.Get("/user/:uid"), HandleGetUser(client))
+	router.HandleFunc(pat.Get("/timeline/:uid"), HandleGetTimeline(client))
+	router.HandleFunc(pat.Put("/timeline/:uid"), HandleFillTimeline(client))
+	router.HandleFunc(pat.Get("/admin/dlq"), RequireAdmin(HandleListDeadLetters(queue)))
+	router.HandleFunc(pat.Post("/admin/dlq/replay"), RequireAdmin(HandleReplayDeadLetters(queue)))
+
+	router.HandleFunc(pat.Get("/health"), health.Handler(map[string]health.Check{
+		"rabbitmq": conn.Health,
+		"redis":    RedisHealth(client),
+	}))
 
-	go MQConsumer(client)
 	http.ListenAndServe(":5000", handlers.LoggingHandler(os.Stdout, router))
 }
 
-// MQConsumer ... checks the queue for a message and prints it
-func MQConsumer(client *redis.Client) {
-	conn, err := amqp.Dial("amqp://176.24.0.9:5672")
-	if err != nil {
-		log.Fatal("[ ! ] Error connecting to RabbitMQ: ", err)
-	}
-	defer conn.Close()
+// WaitForRedis ... Blocks until Redis answers, backing off between tries
+func WaitForRedis(client *redis.Client) {
+	backoff := minBackoff
+	for {
+		err := client.Ping().Err()
+		if err == nil {
+			fmt.Println("[ + ] Connected to Redis")
+			return
+		}
 
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatal("[ ! ] Error opening a channel: ", err)
+		fmt.Println("[ ! ] Error connecting to Redis, retrying in "+backoff.String()+": ", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
+}
 
-	q, err := ch.QueueDeclare(
-		"test", // name
-		false,  // durable
-		false,  // delete when unused
-		false,  // exclusive
-		false,  // no-wait
-		nil,    // arguments
-	)
-	if err != nil {
-		log.Fatal("[ ! ] Error declaring a queue: ", err)
+// RedisHealth ... Checks Redis by pinging it. The client redials on its own, so there's nothing to manage.
+func RedisHealth(client *redis.Client) health.Check {
+	return func() health.Status {
+		err := client.Ping().Err()
+		if err != nil {
+			return health.Status{Error: err.Error()}
+		}
+		return health.Status{OK: true}
 	}
+}
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatal("[ ! ] Error registering consumer: ", err)
+// getEnv ... Returns the value of an environment variable or a fallback if it is unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-
-	forever := make(chan bool)
-	go func() {
-		for d := range msgs {
-			fmt.Println("[ m ] Message Type: ", d.Type)
-			fmt.Println("[ m ] Message received: ", string(d.Body))
-
-			// check for updates
-			if d.Type == "UPDATE" {
-				fmt.Println("[ ! ] Need to update cache")
-				fmt.Println("[ ! ] ID of post: ", string(d.Body))
-				go UpdateCache(string(d.Body), client)
-			}
-		}
-	}()
-
-	fmt.Println("[ * ] Waiting to recieve messages")
-	<-forever
+	return fallback
 }
 
-// HandleGetAllPosts ... Test route
-func HandleGetAllPosts(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
-	return func(res http.ResponseWriter, req *http.Request) {
-		res.Header().Set("Content-Type", "application/json")
-
-		var posts []string
-		result := client.HGetAll("posts")
-		for _, post := range result.Val() {
-			posts = append(posts, post)
+// HandleEvent ... Brings the cache up to date with something that happened in the db api.
+// Errors wrapped with permanent won't get better on a retry.
+func HandleEvent(e events.Event, client *redis.Client) error {
+	switch e.Type {
+	case events.PostReady:
+		// posts only go on timelines once their images are ready
+		post := events.Post{}
+		err := decode(e, &post)
+		if err != nil {
+			return err
 		}
-
-		parsedResults := []models.Post{}
-		for _, post := range posts {
-			parsed := models.Post{}
-			json.Unmarshal([]byte(post), &parsed)
-			parsedResults = append(parsedResults, parsed)
+		err = UpdateCache(post.ID, client)
+		if err != nil {
+			return err
+		}
+		return FanOutPost(post, client)
+	case events.PostCreated:
+		// the post is added to its author's list of posts
+		post := events.Post{}
+		err := decode(e, &post)
+		if err != nil {
+			return err
+		}
+		err = UpdateCache(post.ID, client)
+		if err != nil {
+			return err
+		}
+		return RefreshUser(post.UID, client)
+	case events.PostUpdated, events.PostLiked, events.PostUnliked:
+		post := events.Post{}
+		err := decode(e, &post)
+		if err != nil {
+			return err
+		}
+		return UpdateCache(post.ID, client)
+	case events.PostDeleted:
+		post := events.Post{}
+		err := decode(e, &post)
+		if err != nil {
+			return err
+		}
+		err = RemovePost(post.ID, client)
+		if err != nil {
+			return err
+		}
+		err = DropComments(post.ID, client)
+		if err != nil {
+			return err
+		}
+		return RefreshUser(post.UID, client)
+	case events.CommentAdded, events.CommentUpdated, events.CommentLiked, events.CommentUnliked, events.CommentDeleted:
+		// the post's comment count changes along with the comment
+		comment := events.Comment{}
+		err := decode(e, &comment)
+		if err != nil {
+			return err
+		}
+		err = UpdateCache(comment.PostID, client)
+		if err != nil {
+			return err
+		}
+		return RefreshComments(comment, e.Type, client)
+	case events.UserCreated, events.UserUpdated:
+		user := events.User{}
+		err := decode(e, &user)
+		if err != nil {
+			return err
+		}
+		return RefreshUser(user.UID, client)
+	case events.UserFollowed, events.UserUnfollowed:
+		// both users' follow lists change
+		follow := events.Follow{}
+		err := decode(e, &follow)
+		if err != nil {
+			return err
 		}
+		err = DropTimeline(follow.Follower, client)
+		if err != nil {
+			return err
+		}
+		err = RefreshUser(follow.Follower, client)
+		if err != nil {
+			return err
+		}
+		return RefreshUser(follow.Followee, client)
+	case events.UserDeleted:
+		// their posts are each removed by post.deleted
+		user := events.User{}
+		err := decode(e, &user)
+		if err != nil {
+			return err
+		}
+		err = DropTimeline(user.UID, client)
+		if err != nil {
+			return err
+		}
+		return RemoveUser(user.UID, client)
+	}
 
-		json.NewEncoder(res).Encode(parsedResults)
+	// anything newer than this service is skipped
+	fmt.Println("[ - ] Ignoring event: ", e.Type)
+	return nil
+}
+
+func decode(e events.Event, payload interface{}) error {
+	err := e.Decode(payload)
+	if err != nil {
+		return permanent{fmt.Errorf("decoding %s payload: %v", e.Type, err)}
 	}
+	return nil
 }
 
-// HandleGetPostByID ... Handles getting a specific post
+// HandleGetPostByID ... Gets a post, reading it through to the db api if it isn't cached
 func HandleGetPostByID(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		res.Header().Set("Content-Type", "application/json")
 		id := pat.Param(req, "id")
-
-		result := client.HGet("posts", id)
-		fmt.Println(result)
-		if result.Err() == redis.Nil {
-			fmt.Println("[ ! ] Post not found: ", result)
-		} else {
-			parsed := models.Post{}
-			err := json.Unmarshal([]byte(result.Val()), &parsed)
-			if err != nil {
-				fmt.Println("[ ! ] Error unmarshaling post: ", err)
-			}
-			json.NewEncoder(res).Encode(parsed)
-		}
+		post, hit, err := getPost(id, client)
+		serveCached(res, "post", post, hit, err)
 	}
 }
 
-// UpdateCache ... if the post isn't found in the cache this function will check the db
-func UpdateCache(id string, client *redis.Client) {
+// UpdateCache ... Copies the post with the given id from the db into the cache
+func UpdateCache(id string, client *redis.Client) error {
 	fmt.Println("[ - ] Checking DB for post with id: " + id)
-	// for now we'll just simulate a miss
-	result, _ := http.Get("http://176.24.0.3:8000/posts/" + id)
-	if result.StatusCode == 500 {
-		fmt.Println("Received error")
-	}
+	post, err := fetchPost(id)
 
-	post := models.Post{}
-	err := json.NewDecoder(result.Body).Decode(&post)
+	// the post may have been deleted since the event was sent
+	if err == errNotFound {
+		return RemovePost(id, client)
+	}
 	if err != nil {
-		fmt.Println("[ ! ] Error decoding result body: ", err)
+		return err
 	}
 
-	mp, err := json.Marshal(post)
+	err = CachePost(post, client)
 	if err != nil {
-		fmt.Println("[ ! ] Error marshaling post: ", err)
+		return err
 	}
-
-	_ = client.HSet("posts", post.ID, mp)
 	fmt.Println("[ + ] Cache updated")
+	return nil
 }
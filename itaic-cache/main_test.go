@@ -0,0 +1,1082 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
+	"github.com/streadway/amqp"
+	"goji.io"
+	"goji.io/pat"
+)
+
+// fakeRedis ... Just enough of a Redis server for the commands the cache sends, keeping strings,
+// sets and sorted sets in memory
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+}
+
+// Redis ... Starts a fake Redis and returns a client for it, both closed when the test ends
+func Redis(t *testing.T) (*redis.Client, *fakeRedis) {
+	fake := &fakeRedis{
+		strings: map[string]string{},
+		expires: map[string]time.Time{},
+		sets:    map[string]map[string]bool{},
+		zsets:   map[string]map[string]float64{},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(c)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: l.Addr().String()})
+	t.Cleanup(func() {
+		client.Close()
+		l.Close()
+	})
+	return client, fake
+}
+
+// serve ... Answers the commands sent on one connection, queueing them between MULTI and EXEC
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	multi := false
+	queued := []string{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		reply := ""
+		switch cmd := strings.ToLower(args[0]); {
+		case cmd == "multi":
+			multi, queued, reply = true, []string{}, "+OK\r\n"
+		case cmd == "exec":
+			multi, reply = false, "*"+strconv.Itoa(len(queued))+"\r\n"+strings.Join(queued, "")
+		case multi:
+			queued, reply = append(queued, f.exec(args)), "+QUEUED\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		f.mu.Unlock()
+
+		_, err = io.WriteString(c, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, errors.New("bad command " + line)
+	}
+
+	args := []string{}
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func bulk(v string) string {
+	return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+}
+
+func integer(n int) string {
+	return ":" + strconv.Itoa(n) + "\r\n"
+}
+
+// exec ... Runs one command, the lock has to be held
+func (f *fakeRedis) exec(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "get":
+		v, ok := f.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "mget":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, k := range args[1:] {
+			if v, ok := f.get(k); ok {
+				reply += bulk(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "set":
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "ex":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl, i = time.Duration(n)*time.Second, i+1
+			case "px":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl, i = time.Duration(n)*time.Millisecond, i+1
+			case "nx":
+				nx = true
+			}
+		}
+		if nx && f.exists(args[1]) {
+			return "$-1\r\n"
+		}
+		f.del(args[1])
+		f.strings[args[1]] = args[2]
+		if ttl > 0 {
+			f.expires[args[1]] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "del":
+		n := 0
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+			f.del(k)
+		}
+		return integer(n)
+	case "exists":
+		n := 0
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+		}
+		return integer(n)
+	case "expire":
+		if !f.exists(args[1]) {
+			return integer(0)
+		}
+		n, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+		return integer(1)
+	case "sadd":
+		if f.sets[args[1]] == nil {
+			f.sets[args[1]] = map[string]bool{}
+		}
+		for _, m := range args[2:] {
+			f.sets[args[1]][m] = true
+		}
+		return integer(len(args) - 2)
+	case "srem":
+		for _, m := range args[2:] {
+			delete(f.sets[args[1]], m)
+		}
+		return integer(len(args) - 2)
+	case "smembers":
+		f.exists(args[1])
+		reply := "*" + strconv.Itoa(len(f.sets[args[1]])) + "\r\n"
+		for m := range f.sets[args[1]] {
+			reply += bulk(m)
+		}
+		return reply
+	case "zadd":
+		if f.zsets[args[1]] == nil {
+			f.zsets[args[1]] = map[string]float64{}
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			f.zsets[args[1]][args[i+1]] = score
+		}
+		return integer((len(args) - 2) / 2)
+	case "zrem":
+		for _, m := range args[2:] {
+			delete(f.zsets[args[1]], m)
+		}
+		return integer(len(args) - 2)
+	case "evalsha":
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	case "eval":
+		// the only script the cache runs is unlock
+		if v, ok := f.get(args[3]); ok && v == args[4] {
+			f.del(args[3])
+			return integer(1)
+		}
+		return integer(0)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// exists ... Whether there's anything at k, dropping it first if it's expired
+func (f *fakeRedis) exists(k string) bool {
+	if at, ok := f.expires[k]; ok && time.Now().After(at) {
+		f.del(k)
+	}
+	_, str := f.strings[k]
+	return str || len(f.sets[k]) > 0 || len(f.zsets[k]) > 0
+}
+
+func (f *fakeRedis) get(k string) (string, bool) {
+	if !f.exists(k) {
+		return "", false
+	}
+	v, ok := f.strings[k]
+	return v, ok
+}
+
+func (f *fakeRedis) del(k string) {
+	delete(f.strings, k)
+	delete(f.expires, k)
+	delete(f.sets, k)
+	delete(f.zsets, k)
+}
+
+// Set ... Writes a string straight into the fake, like another instance would
+func (f *fakeRedis) Set(k, v string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.del(k)
+	f.strings[k] = v
+}
+
+// Get ... Reads a string straight from the fake
+func (f *fakeRedis) Get(k string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(k)
+}
+
+// TTL ... How long until k expires, zero if it doesn't
+func (f *fakeRedis) TTL(k string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if at, ok := f.expires[k]; ok {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// DB ... Starts a fake db api serving handler and points the cache at it until the test ends
+func DB(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	original := dbAPI
+	dbAPI = server.URL
+	t.Cleanup(func() {
+		dbAPI = original
+		server.Close()
+	})
+}
+
+// published ... A message handle put on a queue
+type published struct {
+	queue string
+	msg   amqp.Publishing
+}
+
+// fakeChannel ... Records what's published to it, or fails every publish with err
+type fakeChannel struct {
+	mu        sync.Mutex
+	published []published
+	err       error
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.published = append(c.published, published{queue: key, msg: msg})
+	return nil
+}
+
+// acks ... Records how a delivery was acknowledged
+type acks struct {
+	acked, nacked, requeued int
+}
+
+func (a *acks) Ack(tag uint64, multiple bool) error {
+	a.acked++
+	return nil
+}
+
+func (a *acks) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked++
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
+
+func (a *acks) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// delivery ... A message carrying an event, having been retried the given number of times
+func delivery(t *testing.T, eventType string, payload interface{}, retries int) (amqp.Delivery, *acks, events.Event) {
+	e, err := events.New(eventType, "test", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &acks{}
+	d := amqp.Delivery{Acknowledger: a, MessageId: e.ID, Type: e.Type, Body: body, Headers: amqp.Table{}}
+	if retries > 0 {
+		d.Headers[retriesHeader] = int32(retries)
+	}
+	return d, a, e
+}
+
+func TestQueueAppliesEvents(t *testing.T) {
+	client, fake := Redis(t)
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, `{"ID":"p1","UID":"u1","Caption":"hi","Status":"ready","Created":"2020-01-01T00:00:00Z"}`)
+	})
+	q := &Queue{client: client}
+	ch := &fakeChannel{}
+
+	d, a, e := delivery(t, events.PostUpdated, events.Post{ID: "p1", UID: "u1"}, 0)
+	q.handle(ch, d)
+	if a.acked != 1 || a.nacked != 0 {
+		t.Errorf("expected the event to be acked, got %+v", *a)
+	}
+	if len(ch.published) != 0 {
+		t.Errorf("expected nothing to be republished, got %+v", ch.published)
+	}
+	if post, _ := fake.Get(postKey("p1")); !strings.Contains(post, `"Caption":"hi"`) {
+		t.Errorf("expected the post to be cached, got %q", post)
+	}
+	if ttl := fake.TTL(seenPrefix + e.ID); ttl <= 0 || ttl > seenFor {
+		t.Errorf("expected the event to be remembered for %s, got %s", seenFor, ttl)
+	}
+}
+
+func TestQueueSkipsDuplicates(t *testing.T) {
+	client, fake := Redis(t)
+	calls := 0
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		io.WriteString(res, `{"ID":"p1","Caption":"hi"}`)
+	})
+	q := &Queue{client: client}
+	ch := &fakeChannel{}
+
+	d, a, _ := delivery(t, events.PostUpdated, events.Post{ID: "p1"}, 0)
+	q.handle(ch, d)
+	fake.Set(postKey("p1"), "stale")
+
+	// the same message delivered again is acked without touching the cache
+	d.Acknowledger = a
+	q.handle(ch, d)
+	if a.acked != 2 {
+		t.Errorf("expected both deliveries to be acked, got %+v", *a)
+	}
+	if calls != 1 {
+		t.Errorf("expected the db api to be called once, got %d", calls)
+	}
+	if post, _ := fake.Get(postKey("p1")); post != "stale" {
+		t.Errorf("expected the duplicate to be skipped, got %q", post)
+	}
+}
+
+func TestQueueRetries(t *testing.T) {
+	client, fake := Redis(t)
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	})
+	q := &Queue{client: client}
+
+	for retries := 0; retries <= len(retryDelays); retries++ {
+		ch := &fakeChannel{}
+		d, a, e := delivery(t, events.PostUpdated, events.Post{ID: "p1"}, retries)
+		d.Headers["x-trace"] = "abc"
+		q.handle(ch, d)
+
+		target := retryQueue + strconv.Itoa(retries+1)
+		if retries == len(retryDelays) {
+			target = deadLetterQueue
+		}
+		if a.acked != 1 || a.nacked != 0 {
+			t.Errorf("retry %d: expected the message to be acked once it's parked, got %+v", retries, *a)
+		}
+		if len(ch.published) != 1 {
+			t.Fatalf("retry %d: expected one message to be republished, got %d", retries, len(ch.published))
+		}
+
+		p := ch.published[0]
+		if p.queue != target {
+			t.Errorf("retry %d: expected the message on %s, got %s", retries, target, p.queue)
+		}
+		if got := p.msg.Headers[retriesHeader]; got != int32(retries+1) {
+			t.Errorf("retry %d: expected %s to be %d, got %v", retries, retriesHeader, retries+1, got)
+		}
+		if reason, _ := p.msg.Headers[errorHeader].(string); !strings.Contains(reason, "500") {
+			t.Errorf("retry %d: expected %s to say why it failed, got %q", retries, errorHeader, reason)
+		}
+		if p.msg.Headers["x-trace"] != "abc" || p.msg.MessageId != e.ID || string(p.msg.Body) != string(d.Body) {
+			t.Errorf("retry %d: expected the message to be copied, got %+v", retries, p.msg)
+		}
+		if p.msg.DeliveryMode != amqp.Persistent {
+			t.Errorf("retry %d: expected the message to be persistent", retries)
+		}
+		if _, ok := fake.Get(seenPrefix + e.ID); ok {
+			t.Errorf("retry %d: expected a failed event not to be marked seen", retries)
+		}
+	}
+}
+
+func TestQueueDeadLettersPermanentErrors(t *testing.T) {
+	client, _ := Redis(t)
+	q := &Queue{client: client}
+
+	bad := amqp.Delivery{MessageId: "bad", Body: []byte("not json")}
+	newer, _, _ := delivery(t, events.PostUpdated, events.Post{ID: "p1"}, 0)
+	newer.Body = []byte(strings.Replace(string(newer.Body), `"version":1`, `"version":99`, 1))
+	undecodable, _, _ := delivery(t, events.PostUpdated, "not a post", 0)
+
+	for name, d := range map[string]amqp.Delivery{"unparseable": bad, "newer version": newer, "bad payload": undecodable} {
+		a := &acks{}
+		d.Acknowledger = a
+		ch := &fakeChannel{}
+		q.handle(ch, d)
+
+		if a.acked != 1 {
+			t.Errorf("%s: expected the message to be acked, got %+v", name, *a)
+		}
+		if len(ch.published) != 1 || ch.published[0].queue != deadLetterQueue {
+			t.Errorf("%s: expected the message on the dead letter queue straight away, got %+v", name, ch.published)
+			continue
+		}
+		if got := ch.published[0].msg.Headers[retriesHeader]; got != int32(1) {
+			t.Errorf("%s: expected %s to be 1, got %v", name, retriesHeader, got)
+		}
+	}
+}
+
+func TestQueueRequeuesWhenRepublishFails(t *testing.T) {
+	client, _ := Redis(t)
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusBadGateway)
+	})
+	q := &Queue{client: client}
+	ch := &fakeChannel{err: amqp.ErrClosed}
+
+	d, a, _ := delivery(t, events.PostUpdated, events.Post{ID: "p1"}, 0)
+	q.handle(ch, d)
+	if a.acked != 0 || a.requeued != 1 {
+		t.Errorf("expected the message to be requeued rather than lost, got %+v", *a)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	next := func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusTeapot)
+	}
+
+	cases := []struct {
+		name, token, header string
+		status              int
+	}{
+		{"switched off", "", "Bearer ", http.StatusForbidden},
+		{"no token", "secret", "", http.StatusForbidden},
+		{"wrong token", "secret", "Bearer nope", http.StatusForbidden},
+		{"right token", "secret", "Bearer secret", http.StatusTeapot},
+	}
+	for _, c := range cases {
+		t.Setenv("ITAIC_CACHE_ADMIN_TOKEN", c.token)
+		req := httptest.NewRequest("GET", "/admin/dlq", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		res := httptest.NewRecorder()
+		RequireAdmin(next)(res, req)
+		if res.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, res.Code)
+		}
+	}
+}
+
+// Router ... The cache's read routes on client
+func Router(client *redis.Client) *goji.Mux {
+	router := goji.NewMux()
+	router.HandleFunc(pat.Get("/posts/:id"), HandleGetPostByID(client))
+	router.HandleFunc(pat.Get("/posts/:id/comments"), HandleGetComments(client))
+	router.HandleFunc(pat.Get("/user/:uid"), HandleGetUser(client))
+	return router
+}
+
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+	return res
+}
+
+// counted ... A fake db api that counts the requests it gets and answers them with respond
+func counted(t *testing.T, respond http.HandlerFunc) *int32 {
+	calls := new(int32)
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		respond(res, req)
+	})
+	return calls
+}
+
+func TestReadThroughCollapsesMisses(t *testing.T) {
+	client, fake := Redis(t)
+	calls := counted(t, func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(res, `{"ID":"p1","Caption":"hi","Status":"ready","Created":"2020-01-01T00:00:00Z"}`)
+	})
+	router := Router(client)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 20)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = get(router, "/posts/p1")
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected concurrent misses to call the db api once, got %d", n)
+	}
+	for i, res := range responses {
+		if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"Caption":"hi"`) {
+			t.Errorf("request %d: expected the post, got %d %s", i, res.Code, res.Body.String())
+		}
+		if got := res.Header().Get("X-Cache"); got != "miss" {
+			t.Errorf("request %d: expected X-Cache miss, got %q", i, got)
+		}
+	}
+
+	res := get(router, "/posts/p1")
+	if res.Code != http.StatusOK || res.Header().Get("X-Cache") != "hit" {
+		t.Errorf("expected a cache hit, got %d with X-Cache %q", res.Code, res.Header().Get("X-Cache"))
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected a hit not to call the db api, got %d calls", n)
+	}
+	if ttl := fake.TTL(postKey("p1")); ttl <= missingTTL || ttl > entryTTL {
+		t.Errorf("expected the post to be cached for %s, got %s", entryTTL, ttl)
+	}
+	if _, ok := fake.Get("lock:" + postKey("p1")); ok {
+		t.Errorf("expected the lock to be released")
+	}
+}
+
+func TestReadThroughCachesNotFound(t *testing.T) {
+	client, fake := Redis(t)
+	calls := counted(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusNotFound)
+	})
+	router := Router(client)
+
+	for i, want := range []string{"miss", "hit", "hit"} {
+		res := get(router, "/posts/gone")
+		if res.Code != http.StatusNotFound {
+			t.Errorf("request %d: expected status 404, got %d", i, res.Code)
+		}
+		if got := res.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: expected X-Cache %q so the gateway passes the 404 on, got %q", i, want, got)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected the 404 to be cached, got %d calls", n)
+	}
+	if ttl := fake.TTL(postKey("gone")); ttl <= 0 || ttl > missingTTL {
+		t.Errorf("expected the 404 to be cached for %s, got %s", missingTTL, ttl)
+	}
+}
+
+func TestReadThroughDoesNotCacheErrors(t *testing.T) {
+	client, _ := Redis(t)
+	calls := counted(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	})
+	router := Router(client)
+
+	for i := 0; i < 2; i++ {
+		res := get(router, "/posts/p1")
+		if res.Code != http.StatusInternalServerError {
+			t.Errorf("request %d: expected status 500, got %d", i, res.Code)
+		}
+		if got := res.Header().Get("X-Cache"); got != "" {
+			t.Errorf("request %d: expected no X-Cache so the gateway falls back, got %q", i, got)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("expected every request to try the db api, got %d calls", n)
+	}
+}
+
+func TestReadThroughKeepsNewerEntries(t *testing.T) {
+	client, fake := Redis(t)
+	newer := `{"ID":"p1","Caption":"edited"}`
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		// an event writes the post while the db api is answering with an older copy
+		fake.Set(postKey("p1"), newer)
+		io.WriteString(res, `{"ID":"p1","Caption":"old","Status":"ready"}`)
+	})
+
+	res := get(Router(client), "/posts/p1")
+	if res.Body.String() != newer {
+		t.Errorf("expected the newer post, got %s", res.Body.String())
+	}
+	if cached, _ := fake.Get(postKey("p1")); cached != newer {
+		t.Errorf("expected the fill not to overwrite the newer post, got %s", cached)
+	}
+}
+
+func TestReadThroughWaitsForLock(t *testing.T) {
+	client, fake := Redis(t)
+	calls := counted(t, func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, `{"ID":"`+strings.TrimPrefix(req.URL.Path, "/posts/")+`","Caption":"fetched"}`)
+	})
+	router := Router(client)
+
+	// another instance is filling the post and finishes while we wait
+	fake.Set("lock:"+postKey("p1"), "them")
+	go func() {
+		time.Sleep(3 * lockPoll)
+		fake.Set(postKey("p1"), `{"ID":"p1","Caption":"theirs"}`)
+	}()
+
+	res := get(router, "/posts/p1")
+	if !strings.Contains(res.Body.String(), `"Caption":"theirs"`) {
+		t.Errorf("expected the post the lock holder cached, got %s", res.Body.String())
+	}
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Errorf("expected not to call the db api while the lock is held, got %d calls", n)
+	}
+
+	// the lock holder never finishes, so we give up on them and fetch it ourselves
+	fake.Set("lock:"+postKey("p2"), "them")
+	start := time.Now()
+	res = get(router, "/posts/p2")
+	if !strings.Contains(res.Body.String(), `"Caption":"fetched"`) {
+		t.Errorf("expected the post from the db api, got %s", res.Body.String())
+	}
+	if waited := time.Since(start); waited < lockWait {
+		t.Errorf("expected to wait %s for the lock holder, waited %s", lockWait, waited)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("expected one call to the db api, got %d", n)
+	}
+	if lock, _ := fake.Get("lock:" + postKey("p2")); lock != "them" {
+		t.Errorf("expected someone else's lock to be left alone, got %q", lock)
+	}
+}
+
+// fakeDB ... A db api with users, posts and comments the tests can change between requests
+type fakeDB struct {
+	mu       sync.Mutex
+	users    map[string]models.User
+	posts    map[string]models.Post
+	comments map[string][]models.Comment
+	// threads ... How many times each thread has been fetched, by its cache key
+	threads map[string]int
+}
+
+// Data ... Starts a fake db api and points the cache at it
+func Data(t *testing.T) *fakeDB {
+	db := &fakeDB{
+		users:    map[string]models.User{},
+		posts:    map[string]models.Post{},
+		comments: map[string][]models.Comment{},
+		threads:  map[string]int{},
+	}
+	DB(t, db.serve)
+	return db
+}
+
+func (db *fakeDB) serve(res http.ResponseWriter, req *http.Request) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var found interface{}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "user":
+		if user, ok := db.users[parts[1]]; ok {
+			found = user
+		}
+	case len(parts) == 2 && parts[0] == "posts":
+		if post, ok := db.posts[parts[1]]; ok {
+			found = post
+		}
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "comments":
+		if _, ok := db.posts[parts[1]]; ok {
+			parentID := req.URL.Query().Get("parent_id")
+			db.threads[threadKey(parts[1], parentID)]++
+			page := commentPage{Comments: []models.Comment{}}
+			for _, c := range db.comments[parts[1]] {
+				if c.ParentID == parentID {
+					page.Comments = append(page.Comments, c)
+				}
+			}
+			found = page
+		}
+	}
+
+	if found == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(res).Encode(found)
+}
+
+// Comment ... Adds a comment to a post, each one a minute after the last
+func (db *fakeDB) Comment(postID, id, parentID, uid, username string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	created := time.Date(2020, 1, 1, 0, len(db.comments[postID]), 0, 0, time.UTC)
+	db.comments[postID] = append(db.comments[postID], models.Comment{
+		ID: id, PostID: postID, ParentID: parentID, UID: uid, Username: username, Comment: "comment " + id, Created: created,
+	})
+}
+
+// Uncomment ... Deletes a comment and its replies
+func (db *fakeDB) Uncomment(postID, id string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	kept := []models.Comment{}
+	for _, c := range db.comments[postID] {
+		if c.ID != id && c.ParentID != id {
+			kept = append(kept, c)
+		}
+	}
+	db.comments[postID] = kept
+}
+
+// Fetched ... How many times a thread has been fetched
+func (db *fakeDB) Fetched(postID, parentID string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.threads[threadKey(postID, parentID)]
+}
+
+// apply ... Handles an event as the queue would
+func apply(t *testing.T, client *redis.Client, eventType string, payload interface{}) {
+	e, err := events.New(eventType, "test", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = HandleEvent(e, client)
+	if err != nil {
+		t.Fatalf("handling %s: %v", eventType, err)
+	}
+}
+
+// comments ... Reads a page of comments, failing the test if it can't
+func comments(t *testing.T, router http.Handler, path string) ([]models.Comment, string, string) {
+	res := get(router, path)
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected status 200, got %d %s", path, res.Code, res.Body.String())
+	}
+	page := commentPage{}
+	err := json.Unmarshal(res.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page.Comments, page.NextCursor, res.Header().Get("X-Cache")
+}
+
+func ids(comments []models.Comment) string {
+	found := []string{}
+	for _, c := range comments {
+		found = append(found, c.ID)
+	}
+	return strings.Join(found, ",")
+}
+
+func TestUserEvents(t *testing.T) {
+	client, fake := Redis(t)
+	db := Data(t)
+	router := Router(client)
+	db.users["u1"] = models.User{UID: "u1", Username: "before"}
+
+	res := get(router, "/user/u1")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"Username":"before"`) {
+		t.Fatalf("expected the user, got %d %s", res.Code, res.Body.String())
+	}
+
+	db.users["u1"] = models.User{UID: "u1", Username: "after"}
+	apply(t, client, events.UserUpdated, events.User{UID: "u1"})
+	res = get(router, "/user/u1")
+	if !strings.Contains(res.Body.String(), `"Username":"after"`) || res.Header().Get("X-Cache") != "hit" {
+		t.Errorf("expected the updated user from the cache, got %s with X-Cache %q", res.Body.String(), res.Header().Get("X-Cache"))
+	}
+
+	// a user.updated for someone who's since gone marks them missing rather than failing
+	delete(db.users, "u1")
+	apply(t, client, events.UserUpdated, events.User{UID: "u1"})
+	res = get(router, "/user/u1")
+	if res.Code != http.StatusNotFound || res.Header().Get("X-Cache") != "hit" {
+		t.Errorf("expected a cached 404, got %d with X-Cache %q", res.Code, res.Header().Get("X-Cache"))
+	}
+
+	db.users["u2"] = models.User{UID: "u2", Username: "two"}
+	get(router, "/user/u2")
+	fake.Set(timelineKey("u2"), "entries")
+	apply(t, client, events.UserDeleted, events.User{UID: "u2"})
+	res = get(router, "/user/u2")
+	if res.Code != http.StatusNotFound || res.Header().Get("X-Cache") != "hit" {
+		t.Errorf("expected a deleted user to be a cached 404, got %d with X-Cache %q", res.Code, res.Header().Get("X-Cache"))
+	}
+	if ttl := fake.TTL(userKey("u2")); ttl <= 0 || ttl > missingTTL {
+		t.Errorf("expected the deleted user to be cached for %s, got %s", missingTTL, ttl)
+	}
+	if _, ok := fake.Get(timelineKey("u2")); ok {
+		t.Errorf("expected the deleted user's timeline to be dropped")
+	}
+}
+
+func TestCommentsShowCurrentUsernames(t *testing.T) {
+	client, _ := Redis(t)
+	db := Data(t)
+	router := Router(client)
+	db.posts["p1"] = models.Post{ID: "p1", UID: "u1"}
+	db.users["u1"] = models.User{UID: "u1", Username: "renamed"}
+	db.Comment("p1", "c1", "", "u1", "original")
+	db.Comment("p1", "c2", "", "gone", "left")
+	db.Comment("p1", "c3", "", "u1", "original")
+
+	found, next, _ := comments(t, router, "/posts/p1/comments?limit=2")
+	if ids(found) != "c1,c2" || next == "" {
+		t.Fatalf("expected the first page to be c1,c2 with a cursor, got %q %q", ids(found), next)
+	}
+	if found[0].Username != "renamed" {
+		t.Errorf("expected the author's current username, got %q", found[0].Username)
+	}
+	if found[1].Username != "left" {
+		t.Errorf("expected a deleted author to keep the username they commented with, got %q", found[1].Username)
+	}
+
+	found, next, cache := comments(t, router, "/posts/p1/comments?limit=2&cursor="+url.QueryEscape(next))
+	if ids(found) != "c3" || next != "" || cache != "hit" {
+		t.Errorf("expected the last page to be c3 from the cache, got %q %q with X-Cache %q", ids(found), next, cache)
+	}
+
+	db.users["u1"] = models.User{UID: "u1", Username: "again"}
+	apply(t, client, events.UserUpdated, events.User{UID: "u1"})
+	found, _, _ = comments(t, router, "/posts/p1/comments")
+	if found[0].Username != "again" || found[2].Username != "again" {
+		t.Errorf("expected comments to follow the rename, got %+v", found)
+	}
+	if n := db.Fetched("p1", ""); n != 1 {
+		t.Errorf("expected a rename not to refetch the thread, got %d fetches", n)
+	}
+
+	res := get(router, "/posts/nope/comments")
+	if res.Code != http.StatusNotFound || res.Header().Get("X-Cache") != "miss" {
+		t.Errorf("expected a 404 for a missing post, got %d with X-Cache %q", res.Code, res.Header().Get("X-Cache"))
+	}
+}
+
+func TestCommentEvents(t *testing.T) {
+	client, fake := Redis(t)
+	db := Data(t)
+	router := Router(client)
+	db.posts["p1"] = models.Post{ID: "p1", UID: "u1", Status: models.PostReady}
+	db.Comment("p1", "c1", "", "u1", "one")
+	db.Comment("p1", "r1", "c1", "u1", "one")
+	db.Comment("p1", "c2", "", "u1", "one")
+	db.Comment("p1", "r2", "c2", "u1", "one")
+
+	cacheAll := func() {
+		for _, parentID := range []string{"", "c1", "c2"} {
+			comments(t, router, "/posts/p1/comments?parent_id="+parentID)
+		}
+	}
+	cacheAll()
+
+	db.Comment("p1", "r3", "c1", "u1", "one")
+	apply(t, client, events.CommentAdded, events.Comment{PostID: "p1", CommentID: "r3", ParentID: "c1"})
+
+	found, _, cache := comments(t, router, "/posts/p1/comments?parent_id=c1")
+	if ids(found) != "r1,r3" || cache != "hit" {
+		t.Errorf("expected the new reply from the cache, got %q with X-Cache %q", ids(found), cache)
+	}
+	for _, parentID := range []string{"", "c2"} {
+		if _, ok := fake.Get(threadKey("p1", parentID)); ok {
+			t.Errorf("expected thread %q to be dropped for the reply count to be read through", parentID)
+		}
+	}
+	if db.Fetched("p1", "c2") != 1 {
+		t.Errorf("expected only the reply's thread to be refetched")
+	}
+
+	cacheAll()
+	top, c1 := db.Fetched("p1", ""), db.Fetched("p1", "c1")
+	apply(t, client, events.CommentLiked, events.Comment{PostID: "p1", CommentID: "r2"})
+
+	if db.Fetched("p1", "c2") != 3 {
+		t.Errorf("expected the liked reply's thread to be found and refetched")
+	}
+	if db.Fetched("p1", "") != top || db.Fetched("p1", "c1") != c1 {
+		t.Errorf("expected a like to leave the other threads alone")
+	}
+	if _, _, cache = comments(t, router, "/posts/p1/comments"); cache != "hit" {
+		t.Errorf("expected the top level to stay cached, got X-Cache %q", cache)
+	}
+
+	db.Uncomment("p1", "c1")
+	apply(t, client, events.CommentDeleted, events.Comment{PostID: "p1", CommentID: "c1"})
+
+	found, _, cache = comments(t, router, "/posts/p1/comments")
+	if ids(found) != "c2" || cache != "hit" {
+		t.Errorf("expected the deleted comment to be gone from the cache, got %q with X-Cache %q", ids(found), cache)
+	}
+	for _, parentID := range []string{"c1", "c2"} {
+		if _, ok := fake.Get(threadKey("p1", parentID)); ok {
+			t.Errorf("expected thread %q to be dropped", parentID)
+		}
+	}
+	fetched := db.Fetched("p1", "c1")
+	if found, _, _ = comments(t, router, "/posts/p1/comments?parent_id=c1"); len(found) != 0 {
+		t.Errorf("expected no replies to a deleted comment, got %q", ids(found))
+	}
+	if db.Fetched("p1", "c1") != fetched+1 {
+		t.Errorf("expected the dropped thread to be read through again")
+	}
+}
+
+func TestCommentEventsRefreshThreadsBeingFilled(t *testing.T) {
+	client, fake := Redis(t)
+	db := Data(t)
+	router := Router(client)
+	db.posts["p1"] = models.Post{ID: "p1", UID: "u1", Status: models.PostReady}
+	db.Comment("p1", "c1", "", "u1", "one")
+	db.Comment("p1", "r1", "c1", "u1", "one")
+
+	comments(t, router, "/posts/p1/comments")
+	comments(t, router, "/posts/p1/comments?parent_id=c1")
+
+	// another instance is filling the replies, which it fetched before the reply was added
+	fake.Set(lockKey(threadKey("p1", "c1")), "other")
+	db.Comment("p1", "r2", "c1", "u1", "one")
+	db.Comment("p1", "c2", "", "u1", "one")
+	apply(t, client, events.CommentAdded, events.Comment{PostID: "p1", CommentID: "c2"})
+
+	if _, ok := fake.Get(threadKey("p1", "c1")); !ok {
+		t.Fatalf("expected a thread being filled to be refreshed rather than dropped")
+	}
+	found, _, cache := comments(t, router, "/posts/p1/comments?parent_id=c1")
+	if ids(found) != "r1,r2" || cache != "hit" {
+		t.Errorf("expected the refreshed replies from the cache, got %q with X-Cache %q", ids(found), cache)
+	}
+}
+
+func TestPostDeletedDropsComments(t *testing.T) {
+	client, fake := Redis(t)
+	db := Data(t)
+	router := Router(client)
+	db.posts["p1"] = models.Post{ID: "p1", UID: "u1", Status: models.PostReady}
+	db.users["u1"] = models.User{UID: "u1"}
+	db.Comment("p1", "c1", "", "u1", "one")
+	db.Comment("p1", "r1", "c1", "u1", "one")
+
+	comments(t, router, "/posts/p1/comments")
+	comments(t, router, "/posts/p1/comments?parent_id=c1")
+
+	delete(db.posts, "p1")
+	apply(t, client, events.PostDeleted, events.Post{ID: "p1", UID: "u1"})
+
+	for _, key := range []string{threadKey("p1", ""), threadKey("p1", "c1")} {
+		if _, ok := fake.Get(key); ok {
+			t.Errorf("expected %s to be dropped", key)
+		}
+	}
+	fake.mu.Lock()
+	threads := len(fake.sets[threadsKey("p1")])
+	fake.mu.Unlock()
+	if threads != 0 {
+		t.Errorf("expected the post's threads to be forgotten, got %d", threads)
+	}
+
+	res := get(router, "/posts/p1/comments")
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected the deleted post's comments to be a 404, got %d", res.Code)
+	}
+}
+
+func TestReadThroughGivesUpOnHungDB(t *testing.T) {
+	if dbTimeout >= lockTTL {
+		t.Errorf("expected calls to the db api to time out before a fill's lock expires, %s >= %s", dbTimeout, lockTTL)
+	}
+
+	client, fake := Redis(t)
+	release := make(chan struct{})
+	DB(t, func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+
+	timeout := dbClient.Timeout
+	dbClient.Timeout = 100 * time.Millisecond
+	defer func() { dbClient.Timeout = timeout }()
+
+	start := time.Now()
+	res := get(Router(client), "/posts/p1")
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", res.Code)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected a hung db api to be given up on, waited %s", took)
+	}
+	if _, ok := fake.Get("lock:" + postKey("p1")); ok {
+		t.Errorf("expected the lock to be released")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
+)
+
+// postsByCreated ... Sorted set of post ids scored by creation time in milliseconds, so listings
+// can be read a range at a time. It doesn't expire, the posts it points at are read through to the
+// db api once they have.
+const postsByCreated = "posts:created"
+
+// legacyPosts ... The hash every post used to be kept in, which couldn't expire them one at a time
+const legacyPosts = "posts"
+
+func postKey(id string) string {
+	return "post:" + id
+}
+
+// PostCursor ... Where a page of posts ended. The db api makes the same cursors, so a client can
+// keep paging when the gateway switches between the two services.
+type PostCursor struct {
+	Created time.Time `json:"created"`
+	ID      string    `json:"id"`
+}
+
+// postPage ... One page of a post listing
+type postPage struct {
+	Posts      []models.Post `json:"posts"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// CachePost ... Stores a post and adds it to the creation time index once its images are ready
+func CachePost(post models.Post, client *redis.Client) error {
+	mp, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(postKey(post.ID), mp, entryTTL)
+		if post.Ready() {
+			pipe.ZAdd(postsByCreated, redis.Z{Score: float64(createdScore(post.Created)), Member: post.ID})
+		} else {
+			pipe.ZRem(postsByCreated, post.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+// RemovePost ... Marks a deleted post missing in the cache. Timelines still holding its id skip it
+// when read.
+func RemovePost(id string, client *redis.Client) error {
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(postKey(id), missing, missingTTL)
+		pipe.ZRem(postsByCreated, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("[ + ] Post removed from cache")
+	return nil
+}
+
+// LoadPosts ... Fills the cache with every post in the db, a page at a time
+func LoadPosts(client *redis.Client) error {
+	err := client.Del(legacyPosts).Err()
+	if err != nil {
+		return err
+	}
+
+	cursor := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", "100")
+		query.Set("order", "asc")
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		res, err := dbClient.Get(dbAPI + "/posts?" + query.Encode())
+		if err != nil {
+			return err
+		}
+
+		result := postPage{}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, post := range result.Posts {
+			err := CachePost(post, client)
+			if err != nil {
+				fmt.Println("[ ! ] Error caching post: ", err)
+			}
+		}
+
+		if result.NextCursor == "" {
+			return nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+// HandleGetAllPosts ... Gets a page of posts ordered by creation time, newest first unless ?order=asc
+func HandleGetAllPosts(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		limit := 20
+		if raw := req.URL.Query().Get("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 || parsed > 100 {
+				writeError(res, http.StatusBadRequest, "validation", "limit must be a number from 1 to 100")
+				return
+			}
+			limit = parsed
+		}
+
+		ascending := false
+		switch req.URL.Query().Get("order") {
+		case "", "desc":
+		case "asc":
+			ascending = true
+		default:
+			writeError(res, http.StatusBadRequest, "validation", "order must be asc or desc")
+			return
+		}
+
+		var last TimelineEntry
+		cursor := req.URL.Query().Get("cursor")
+		if cursor != "" {
+			after, err := decodePostCursor(cursor)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, "validation", "invalid cursor")
+				return
+			}
+			last = TimelineEntry{ID: after.ID, Score: createdScore(after.Created)}
+		}
+
+		// fetch a little extra to step over posts that share the cursor's score
+		span := redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: int64(limit + 50)}
+		var result []redis.Z
+		var err error
+		if ascending {
+			if cursor != "" {
+				span.Min = strconv.FormatInt(last.Score, 10)
+			}
+			result, err = client.ZRangeByScoreWithScores(postsByCreated, span).Result()
+		} else {
+			if cursor != "" {
+				span.Max = strconv.FormatInt(last.Score, 10)
+			}
+			result, err = client.ZRevRangeByScoreWithScores(postsByCreated, span).Result()
+		}
+		if err != nil {
+			fmt.Println("[ ! ] Error reading posts: ", err)
+			writeError(res, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+
+		ids := []string{}
+		for _, z := range result {
+			entry := TimelineEntry{ID: z.Member.(string), Score: int64(z.Score)}
+			if cursor != "" && older(entry, last) == ascending {
+				continue
+			}
+			if cursor != "" && entry == last {
+				continue
+			}
+			ids = append(ids, entry.ID)
+		}
+
+		posts := readPosts(ids, client)
+		next := ""
+		if len(posts) > limit {
+			posts = posts[:limit]
+			end := posts[limit-1]
+			next = encodePostCursor(PostCursor{Created: end.Created, ID: end.ID})
+		}
+
+		json.NewEncoder(res).Encode(&postPage{Posts: posts, NextCursor: next})
+	}
+}
+
+// readPosts ... Gets the posts with the given ids, in order, reading the ones that have expired
+// through to the db api and skipping any that are gone
+func readPosts(ids []string, client *redis.Client) []models.Post {
+	posts := []models.Post{}
+	if len(ids) == 0 {
+		return posts
+	}
+
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, postKey(id))
+	}
+
+	cached := client.MGet(keys...).Val()
+	for i, value := range cached {
+		raw, ok := value.(string)
+		if !ok {
+			var err error
+			raw, _, err = getPost(ids[i], client)
+			if err != nil && err != errNotFound {
+				fmt.Println("[ ! ] Error reading post "+ids[i]+": ", err)
+			}
+		}
+		if raw == missing {
+			continue
+		}
+
+		post := models.Post{}
+		err := json.Unmarshal([]byte(raw), &post)
+		if err != nil {
+			fmt.Println("[ ! ] Error unmarshaling post: ", err)
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+func writeError(res http.ResponseWriter, status int, code, message string) {
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(map[string]string{"code": code, "message": message})
+}
+
+// createdScore ... Turns a post's created time into milliseconds for the sorted sets
+func createdScore(created time.Time) int64 {
+	return created.UnixNano() / int64(time.Millisecond)
+}
+
+func encodePostCursor(last PostCursor) string {
+	raw, _ := json.Marshal(last)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePostCursor(cursor string) (PostCursor, error) {
+	last := PostCursor{}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return last, err
+	}
+
+	err = json.Unmarshal(raw, &last)
+	return last, err
+}
+
+// getPost ... Gets a post's JSON from the cache, fetching it from the db api on a miss
+func getPost(id string, client *redis.Client) (string, bool, error) {
+	return readThrough(postKey(id), client, func() error {
+		post, err := fetchPost(id)
+		if err == errNotFound {
+			return client.SetNX(postKey(id), missing, missingTTL).Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		mp, err := json.Marshal(post)
+		if err != nil {
+			return err
+		}
+		added, err := client.SetNX(postKey(id), mp, entryTTL).Result()
+		if err != nil || !added || !post.Ready() {
+			return err
+		}
+		return client.ZAdd(postsByCreated, redis.Z{Score: float64(createdScore(post.Created)), Member: post.ID}).Err()
+	})
+}
+
+// fetchPost ... Gets a post from the db api, or errNotFound if it doesn't have it
+func fetchPost(id string) (models.Post, error) {
+	post := models.Post{}
+	err := fetch("/posts/"+url.PathEscape(id), &post)
+	return post, err
+}
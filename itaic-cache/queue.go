@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/streadway/amqp"
+)
+
+// Queues the cache consumes from. Events land on eventsQueue, a failed one is parked on the
+// retry queue for its attempt until the queue's TTL sends it back, and one that fails every
+// attempt, or can't be read at all, ends up on deadLetterQueue.
+const (
+	eventsQueue     = "itaic-cache.events"
+	retryQueue      = "itaic-cache.retry."
+	deadLetterQueue = "itaic-cache.dlq"
+)
+
+// retryDelays ... How long to wait before each retry, the length is how many retries a message gets
+var retryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// Headers added to messages that are retried or dead lettered
+const (
+	retriesHeader = "x-retries"
+	errorHeader   = "x-error"
+)
+
+// consumers ... How many messages are handled at once
+const consumers = 4
+
+// Events can be delivered more than once, so the ids of ones already applied are remembered
+// for a while and repeats are dropped
+const (
+	seenPrefix = "events:seen:"
+	seenFor    = 24 * time.Hour
+)
+
+// permanent ... An error that retrying won't fix, the message goes straight to the dead letter queue
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string {
+	return p.err.Error()
+}
+
+// publisher ... Somewhere handle can put a message it couldn't apply, the channel it came in on
+type publisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Queue ... The cache's queues on RabbitMQ
+type Queue struct {
+	conn   *Conn
+	client *redis.Client
+	// mu guards publishing, which the consumers and the admin routes share a channel for
+	mu sync.Mutex
+}
+
+// NewQueue ... Creates the cache's consumer, which declares its queues and starts handling
+// events every time conn connects
+func NewQueue(conn *Conn, client *redis.Client) *Queue {
+	q := &Queue{conn: conn, client: client}
+	conn.OnConnect(q.consume)
+	return q
+}
+
+// consume ... Declares the events exchange and the cache's queues, then handles events until the
+// channel closes. A message is only acked once the cache has been written, or once it's been
+// handed to a retry or dead letter queue.
+func (q *Queue) consume(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(events.Exchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(eventsQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ch.QueueBind(eventsQueue, "#", events.Exchange, false, nil)
+	if err != nil {
+		return err
+	}
+
+	// retry queues have no consumers, messages sit out their TTL then dead letter back to eventsQueue
+	for i, delay := range retryDelays {
+		_, err = ch.QueueDeclare(retryQueue+strconv.Itoa(i+1), true, false, false, false, amqp.Table{
+			"x-message-ttl":             int32(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": eventsQueue,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ch.Qos(consumers*2, 0, false)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := ch.Consume(
+		eventsQueue, // queue
+		"",          // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+	if err != nil {
+		return err
+	}
+
+	// msgs is closed when the channel goes, and the consumers with it
+	for i := 0; i < consumers; i++ {
+		go func() {
+			for d := range msgs {
+				q.handle(ch, d)
+			}
+		}()
+	}
+
+	fmt.Println("[ * ] Waiting to recieve messages")
+	return nil
+}
+
+// handle ... Applies one event to the cache, parking it on a retry queue if that fails, or on the
+// dead letter queue once it's out of retries or if it can never work
+func (q *Queue) handle(ch publisher, d amqp.Delivery) {
+	e, err := events.Parse(d.Body)
+	if err == nil {
+		if q.client.Exists(seenPrefix+e.ID).Val() > 0 {
+			fmt.Println("[ m ] Skipping duplicate event: ", e.Type, e.ID)
+			d.Ack(false)
+			return
+		}
+
+		fmt.Println("[ m ] Event received: ", e.Type, e.ID)
+		err = HandleEvent(e, q.client)
+		if err == nil {
+			q.client.Set(seenPrefix+e.ID, 1, seenFor)
+			d.Ack(false)
+			return
+		}
+	} else {
+		err = permanent{err}
+	}
+
+	retries := retriesOf(d)
+	target := deadLetterQueue
+	if _, ok := err.(permanent); !ok && retries < len(retryDelays) {
+		target = retryQueue + strconv.Itoa(retries+1)
+	}
+	fmt.Println("[ ! ] Error handling message "+d.MessageId+", sending to "+target+": ", err)
+
+	err = q.republish(ch, d, target, retries+1, err.Error())
+	if err != nil {
+		// couldn't park it anywhere, so let RabbitMQ hand it out again
+		fmt.Println("[ ! ] Error republishing message: ", err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// republish ... Copies a delivery onto the named queue, recording how many times it's been tried
+func (q *Queue) republish(ch publisher, d amqp.Delivery, queue string, retries int, reason string) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retriesHeader] = int32(retries)
+	if reason != "" {
+		headers[errorHeader] = reason
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return ch.Publish("", queue, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Type:         d.Type,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	})
+}
+
+func retriesOf(d amqp.Delivery) int {
+	switch v := d.Headers[retriesHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// DeadLetter ... A message on the dead letter queue as the admin routes show it
+type DeadLetter struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Retries int             `json:"retries"`
+	Error   string          `json:"error"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// drain ... Takes up to limit messages off the dead letter queue, letting visit ack the ones it
+// deals with. The rest are put back once every message has been looked at, so each one is seen once.
+func (q *Queue) drain(limit int, visit func(ch *amqp.Channel, d amqp.Delivery) (bool, error)) error {
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	held := []amqp.Delivery{}
+	defer func() {
+		for _, d := range held {
+			d.Nack(false, true)
+		}
+	}()
+
+	for i := 0; i < limit; i++ {
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		done, err := visit(ch, d)
+		if err != nil {
+			held = append(held, d)
+			return err
+		}
+		if done {
+			d.Ack(false)
+			continue
+		}
+		held = append(held, d)
+	}
+	return nil
+}
+
+// HandleListDeadLetters ... Shows the messages on the dead letter queue without removing them
+func HandleListDeadLetters(q *Queue) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 20
+		}
+
+		letters := []DeadLetter{}
+		err = q.drain(limit, func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+			reason, _ := d.Headers[errorHeader].(string)
+			body := json.RawMessage(d.Body)
+			if !json.Valid(d.Body) {
+				body, _ = json.Marshal(string(d.Body))
+			}
+			letters = append(letters, DeadLetter{
+				ID:      d.MessageId,
+				Type:    d.Type,
+				Retries: retriesOf(d),
+				Error:   reason,
+				Body:    body,
+			})
+			return false, nil
+		})
+		if err == ErrDisconnected {
+			writeError(res, http.StatusServiceUnavailable, "upstream", err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println("[ ! ] Error reading dead letter queue: ", err)
+			writeError(res, http.StatusBadGateway, "upstream", "error reading dead letter queue")
+			return
+		}
+
+		json.NewEncoder(res).Encode(struct {
+			Messages []DeadLetter `json:"messages"`
+		}{letters})
+	}
+}
+
+// HandleReplayDeadLetters ... Moves dead lettered messages back onto the events queue for another
+// round of retries. ?id= replays a single message, otherwise up to ?limit= are replayed.
+func HandleReplayDeadLetters(q *Queue) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		id := req.URL.Query().Get("id")
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > 1000 {
+			limit = 100
+		}
+
+		replayed := []string{}
+		err = q.drain(limit, func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+			if id != "" && d.MessageId != id {
+				return false, nil
+			}
+
+			// called with q.mu held, so publish directly
+			err := ch.Publish("", eventsQueue, false, false, amqp.Publishing{
+				ContentType:  d.ContentType,
+				DeliveryMode: amqp.Persistent,
+				Type:         d.Type,
+				MessageId:    d.MessageId,
+				Timestamp:    d.Timestamp,
+				Body:         d.Body,
+			})
+			if err != nil {
+				return false, err
+			}
+			replayed = append(replayed, d.MessageId)
+			return true, nil
+		})
+		if err == ErrDisconnected {
+			writeError(res, http.StatusServiceUnavailable, "upstream", err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println("[ ! ] Error replaying dead letter queue: ", err)
+			writeError(res, http.StatusBadGateway, "upstream", "error replaying dead letter queue")
+			return
+		}
+		if id != "" && len(replayed) == 0 {
+			writeError(res, http.StatusNotFound, "not_found", "message not found on the dead letter queue")
+			return
+		}
+
+		json.NewEncoder(res).Encode(struct {
+			Replayed []string `json:"replayed"`
+		}{replayed})
+	}
+}
+
+// RequireAdmin ... Only lets through requests carrying the token in ITAIC_CACHE_ADMIN_TOKEN.
+// With no token configured the admin routes are switched off.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		token := os.Getenv("ITAIC_CACHE_ADMIN_TOKEN")
+		if token == "" || req.Header.Get("Authorization") != "Bearer "+token {
+			res.Header().Set("Content-Type", "application/json")
+			writeError(res, http.StatusForbidden, "forbidden", "admin token required")
+			return
+		}
+		next(res, req)
+	}
+}
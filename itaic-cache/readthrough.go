@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// How long things are cached for. Entries are kept fresh by events, the TTL only bounds how long
+// one can be wrong if an event is lost. Ids the db api doesn't have are remembered for a short
+// while so asking for them again doesn't reach it every time.
+const (
+	entryTTL   = time.Hour
+	missingTTL = 30 * time.Second
+)
+
+// While one instance fetches an entry it holds a lock that others wait on for up to lockWait,
+// rather than all asking the db api at once. The lock expires after lockTTL in case the instance
+// holding it dies.
+const (
+	lockTTL  = 5 * time.Second
+	lockWait = 2 * time.Second
+	lockPoll = 50 * time.Millisecond
+)
+
+// missing ... What's cached in place of an entry the db api doesn't have
+const missing = ""
+
+// errNotFound ... The db api doesn't have the entry asked for
+var errNotFound = errors.New("not found")
+
+// unlock ... Deletes a lock only if it's still the one we took, so a lock that expired and was
+// taken by someone else isn't released from under them
+var unlock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// flight ... A fill in progress that other callers for the same key wait on
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// group ... Collapses concurrent fills of the same key in this process into one
+type group struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// fills ... The fills in progress in this process
+var fills = &group{flights: map[string]*flight{}}
+
+// Do ... Runs fn for key, or if it's already running waits for that to finish and returns its error
+func (g *group) Do(key string, fn func() error) error {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.err = fn()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+// readThrough ... Gets what's cached at key, calling fill to fetch it from the db api and cache it
+// on a miss. Reports whether it was a hit, and returns errNotFound if the db api doesn't have it.
+// fill should only write an entry that isn't there yet, so it can't overwrite a newer one an event
+// wrote while it was fetching.
+func readThrough(key string, client *redis.Client, fill func() error) (string, bool, error) {
+	value, err := client.Get(key).Result()
+	if err == nil {
+		return found(value, true)
+	}
+	if err != redis.Nil {
+		return "", false, err
+	}
+
+	err = fills.Do(key, func() error {
+		return lockedFill(key, client, fill)
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	value, err = client.Get(key).Result()
+	if err == redis.Nil {
+		return "", false, fmt.Errorf("%s was filled but isn't cached", key)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return found(value, false)
+}
+
+// lockedFill ... Runs fill while holding the Redis lock for key, or waits for whoever holds it to
+// fill key instead. If they take too long it fills key anyway rather than fail.
+func lockedFill(key string, client *redis.Client, fill func() error) error {
+	lock := lockKey(key)
+	token := newToken()
+	locked, err := client.SetNX(lock, token, lockTTL).Result()
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		defer unlock.Run(client, []string{lock}, token)
+
+		// someone may have filled it between the miss and taking the lock
+		if client.Exists(key).Val() == 1 {
+			return nil
+		}
+		return fill()
+	}
+
+	for deadline := time.Now().Add(lockWait); time.Now().Before(deadline); {
+		time.Sleep(lockPoll)
+		if client.Exists(key).Val() == 1 {
+			return nil
+		}
+	}
+	fmt.Println("[ ! ] Gave up waiting for " + lock + ", fetching it anyway")
+	return fill()
+}
+
+// lockKey ... The lock held while key is being filled
+func lockKey(key string) string {
+	return "lock:" + key
+}
+
+// fetch ... Gets path from the db api into v, or errNotFound if the db api doesn't have it
+func fetch(path string, v interface{}) error {
+	res, err := dbClient.Get(dbAPI + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("db api returned %s for %s", res.Status, path)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// found ... Turns a cached value into the result of readThrough
+func found(value string, hit bool) (string, bool, error) {
+	if value == missing {
+		return "", hit, errNotFound
+	}
+	return value, hit, nil
+}
+
+// serveCached ... Sends what a read through the cache found, or a 404 the gateway can pass on if
+// the db api doesn't have it either
+func serveCached(res http.ResponseWriter, what, value string, hit bool, err error) {
+	res.Header().Set("Content-Type", "application/json")
+	if err == errNotFound {
+		res.Header().Set("X-Cache", cacheStatus(hit))
+		writeError(res, http.StatusNotFound, "not_found", what+" not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("[ ! ] Error reading "+what+": ", err)
+		writeError(res, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	res.Header().Set("X-Cache", cacheStatus(hit))
+	io.WriteString(res, value)
+}
+
+// cacheStatus ... The X-Cache header for a read, which tells the gateway a 404 is an answer and
+// not a route the cache doesn't have
+func cacheStatus(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
+	"goji.io/pat"
+)
+
+// maxTimelineEntries ... How many posts a timeline keeps, older ones fall off the end
+const maxTimelineEntries = 500
+
+// TimelineEntry ... A post on a timeline, scored by its creation time in milliseconds
+type TimelineEntry struct {
+	ID    string `json:"id"`
+	Score int64  `json:"score"`
+}
+
+func timelineKey(uid string) string {
+	return "timeline:" + uid
+}
+
+// HandleGetTimeline ... Gets a page of a user's home timeline, newest first. Responds 404 when the
+// timeline isn't cached so the db api knows to build it.
+func HandleGetTimeline(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		key := timelineKey(pat.Param(req, "uid"))
+
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 20
+		}
+
+		max := "+inf"
+		var last TimelineEntry
+		cursor := req.URL.Query().Get("cursor")
+		if cursor != "" {
+			last, err = decodeCursor(cursor)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, "validation", "invalid cursor")
+				return
+			}
+			max = strconv.FormatInt(last.Score, 10)
+		}
+
+		// a timeline key only exists once it's been filled, an empty one holds a placeholder
+		if client.Exists(key).Val() == 0 {
+			writeError(res, http.StatusNotFound, "not_found", "timeline not cached")
+			return
+		}
+
+		// fetch a little extra to step over entries that share the cursor's score
+		result, err := client.ZRevRangeByScoreWithScores(key, redis.ZRangeBy{
+			Max:   max,
+			Min:   "-inf",
+			Count: int64(limit + 50),
+		}).Result()
+		if err != nil {
+			fmt.Println("[ ! ] Error reading timeline: ", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		entries := []TimelineEntry{}
+		for _, z := range result {
+			entry := TimelineEntry{ID: z.Member.(string), Score: int64(z.Score)}
+			if entry.ID == "" {
+				continue
+			}
+			if cursor != "" && !older(entry, last) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		next := ""
+		if len(entries) > limit {
+			entries = entries[:limit]
+			next = encodeCursor(entries[limit-1])
+		}
+
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+
+		posts := readPosts(ids, client)
+		json.NewEncoder(res).Encode(&postPage{Posts: posts, NextCursor: next})
+	}
+}
+
+// HandleFillTimeline ... Replaces a user's timeline with the entries the db api built for it
+func HandleFillTimeline(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := timelineKey(pat.Param(req, "uid"))
+
+		body := struct {
+			Entries []TimelineEntry `json:"entries"`
+		}{}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// an empty member marks a timeline that is cached but has nothing on it yet
+		members := []redis.Z{{Score: 0, Member: ""}}
+		for _, entry := range body.Entries {
+			members = append(members, redis.Z{Score: float64(entry.Score), Member: entry.ID})
+		}
+
+		_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(key)
+			pipe.ZAdd(key, members...)
+			pipe.ZRemRangeByRank(key, 0, -maxTimelineEntries-2)
+			return nil
+		})
+		if err != nil {
+			fmt.Println("[ ! ] Error filling timeline: ", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// FanOutPost ... Adds a new post to the cached timelines of everyone following its author.
+// Timelines that aren't cached are left alone, they're built in full the next time they're read.
+func FanOutPost(created events.Post, client *redis.Client) error {
+	res, err := dbClient.Get(dbAPI + "/user/" + created.UID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// the author is gone, so there's nobody to fan out to
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("db api returned %s for author %s", res.Status, created.UID)
+	}
+
+	author := models.User{}
+	err = json.NewDecoder(res.Body).Decode(&author)
+	if err != nil {
+		return err
+	}
+
+	for _, follower := range author.Followers {
+		key := timelineKey(follower)
+		if client.Exists(key).Val() == 0 {
+			continue
+		}
+
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(key, redis.Z{Score: float64(created.Score), Member: created.ID})
+			pipe.ZRemRangeByRank(key, 0, -maxTimelineEntries-2)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println("[ + ] Post added to timelines")
+	return nil
+}
+
+// DropTimeline ... Forgets a cached timeline so it's rebuilt from the db on the next read
+func DropTimeline(uid string, client *redis.Client) error {
+	return client.Del(timelineKey(uid)).Err()
+}
+
+// older ... Reports whether a comes after b on a timeline
+func older(a, b TimelineEntry) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.ID < b.ID
+}
+
+func encodeCursor(last TimelineEntry) string {
+	raw := strconv.FormatInt(last.Score, 10) + ":" + last.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (TimelineEntry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return TimelineEntry{}, err
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return TimelineEntry{}, fmt.Errorf("malformed cursor")
+	}
+
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return TimelineEntry{}, err
+	}
+	return TimelineEntry{ID: parts[1], Score: score}, nil
+}
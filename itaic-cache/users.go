@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-redis/redis"
+	"github.com/jmlattanzi/itaic-backend/itaic-cache/models"
+	"goji.io/pat"
+)
+
+func userKey(uid string) string {
+	return "user:" + uid
+}
+
+// HandleGetUser ... Gets a user, reading them through to the db api if they aren't cached
+func HandleGetUser(client *redis.Client) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		uid := pat.Param(req, "uid")
+		user, hit, err := getUser(uid, client)
+		serveCached(res, "user", user, hit, err)
+	}
+}
+
+// getUser ... Gets a user's JSON from the cache, fetching it from the db api on a miss
+func getUser(uid string, client *redis.Client) (string, bool, error) {
+	return readThrough(userKey(uid), client, func() error {
+		user, err := fetchUser(uid)
+		if err == errNotFound {
+			return client.SetNX(userKey(uid), missing, missingTTL).Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		mu, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return client.SetNX(userKey(uid), mu, entryTTL).Err()
+	})
+}
+
+// readUsers ... Gets the users with the given uids, reading the ones that aren't cached through to
+// the db api and skipping any that are gone
+func readUsers(uids []string, client *redis.Client) []models.User {
+	users := []models.User{}
+	if len(uids) == 0 {
+		return users
+	}
+
+	keys := []string{}
+	for _, uid := range uids {
+		keys = append(keys, userKey(uid))
+	}
+
+	cached := client.MGet(keys...).Val()
+	for i, value := range cached {
+		raw, ok := value.(string)
+		if !ok {
+			var err error
+			raw, _, err = getUser(uids[i], client)
+			if err != nil && err != errNotFound {
+				fmt.Println("[ ! ] Error reading user "+uids[i]+": ", err)
+			}
+		}
+		if raw == missing {
+			continue
+		}
+
+		user := models.User{}
+		err := json.Unmarshal([]byte(raw), &user)
+		if err != nil {
+			fmt.Println("[ ! ] Error unmarshaling user: ", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// RefreshUser ... Copies the user with the given uid from the db into the cache, or marks them
+// missing if they're gone
+func RefreshUser(uid string, client *redis.Client) error {
+	user, err := fetchUser(uid)
+	if err == errNotFound {
+		return RemoveUser(uid, client)
+	}
+	if err != nil {
+		return err
+	}
+
+	mu, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return client.Set(userKey(uid), mu, entryTTL).Err()
+}
+
+// RemoveUser ... Marks a deleted user missing in the cache
+func RemoveUser(uid string, client *redis.Client) error {
+	return client.Set(userKey(uid), missing, missingTTL).Err()
+}
+
+// fetchUser ... Gets a user from the db api, or errNotFound if it doesn't have them
+func fetchUser(uid string) (models.User, error) {
+	user := models.User{}
+	err := fetch("/user/"+url.PathEscape(uid), &user)
+	return user, err
+}
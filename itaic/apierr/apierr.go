@@ -0,0 +1,145 @@
+package apierr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// Error codes returned in the body of an error response
+const (
+	CodeNotFound     = "not_found"
+	CodeValidation   = "validation"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeConflict     = "conflict"
+	CodeUpstream     = "upstream"
+	CodeInternal     = "internal"
+)
+
+// Error ... An error that knows which status code and message to send to the client
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// NotFound ... The requested document doesn't exist
+func NotFound(message string) *Error {
+	return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: message}
+}
+
+// Validation ... The request was malformed or missing something
+func Validation(message string) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: CodeValidation, Message: message}
+}
+
+// Unauthorized ... The caller didn't say who they are, or we couldn't verify it
+func Unauthorized(message string) *Error {
+	return &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: message}
+}
+
+// Forbidden ... The caller is known but isn't allowed to do this
+func Forbidden(message string) *Error {
+	return &Error{Status: http.StatusForbidden, Code: CodeForbidden, Message: message}
+}
+
+// Conflict ... The request clashes with something that already exists
+func Conflict(message string) *Error {
+	return &Error{Status: http.StatusConflict, Code: CodeConflict, Message: message}
+}
+
+// Upstream ... A service we depend on (Firestore, S3, RabbitMQ) failed
+func Upstream(message string, err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: CodeUpstream, Message: message, Err: err}
+}
+
+// Missing ... Turns a store not found error into a 404 naming what was missing, passing other errors through
+func Missing(err error, what string) error {
+	if err == store.ErrNotFound {
+		return NotFound(what + " not found")
+	}
+	return err
+}
+
+// From ... Turns any error into an *Error, mapping the errors the stores return to their status codes
+func From(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	if err == store.ErrNotFound {
+		return NotFound("document not found")
+	}
+	if err == store.ErrUsernameTaken {
+		return Conflict("username is taken")
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeUpstream, Message: "database unavailable", Err: err}
+	}
+
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "internal error", Err: err}
+}
+
+// Write ... Sends err to the client as a JSON error body
+func Write(res http.ResponseWriter, req *http.Request, err error) {
+	e := From(err)
+	id := RequestIDFrom(req.Context())
+	if e.Status >= http.StatusInternalServerError {
+		fmt.Printf("[ ! ] %s %s (request %s): %v\n", req.Method, req.URL.Path, id, e)
+	}
+
+	body := struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}{e.Code, e.Message, id}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(e.Status)
+	json.NewEncoder(res).Encode(&body)
+}
+
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+
+// RequestID ... Middleware that tags each request with an id, reusing X-Request-ID if the caller sent one
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		res.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(req.Context(), requestIDKey, id)
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom ... Gets the id RequestID stored on the context
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
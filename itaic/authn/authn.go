@@ -0,0 +1,123 @@
+package authn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"firebase.google.com/go/auth"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+)
+
+// memoryTokenPrefix ... Tokens the in-memory client accepts are this prefix followed by the uid
+const memoryTokenPrefix = "memory:"
+
+// Client ... The parts of Firebase auth the API depends on
+type Client interface {
+	CreateUser(ctx context.Context, email, displayName string) (string, error)
+	// DeleteUser ... Removes an auth user, doing nothing if it's already gone
+	DeleteUser(ctx context.Context, uid string) error
+	VerifyIDToken(ctx context.Context, idToken string) (string, error)
+}
+
+// Firebase ... Client backed by the Firebase auth client
+type Firebase struct {
+	client *auth.Client
+}
+
+// NewFirebase ... Wraps a Firebase auth client
+func NewFirebase(client *auth.Client) *Firebase {
+	return &Firebase{client: client}
+}
+
+// CreateUser ... Creates an auth user and returns its uid
+func (f *Firebase) CreateUser(ctx context.Context, email, displayName string) (string, error) {
+	params := (&auth.UserToCreate{}).Email(email).DisplayName(displayName)
+	user, err := f.client.CreateUser(ctx, params)
+	if err != nil {
+		if auth.IsEmailAlreadyExists(err) {
+			return "", apierr.Conflict("email already registered")
+		}
+		return "", err
+	}
+	return user.UID, nil
+}
+
+// DeleteUser ... Deletes the auth user with uid
+func (f *Firebase) DeleteUser(ctx context.Context, uid string) error {
+	err := f.client.DeleteUser(ctx, uid)
+	if auth.IsUserNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// VerifyIDToken ... Checks a Firebase ID token and returns the uid it was issued to
+func (f *Firebase) VerifyIDToken(ctx context.Context, idToken string) (string, error) {
+	token, err := f.client.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return "", err
+	}
+	return token.UID, nil
+}
+
+// Memory ... Client that keeps accounts in process, used for running the API offline and in tests
+type Memory struct {
+	mu     sync.Mutex
+	emails map[string]string
+}
+
+// NewMemory ... Creates an empty in-memory auth client
+func NewMemory() *Memory {
+	return &Memory{emails: map[string]string{}}
+}
+
+// CreateUser ... Registers the email and returns a random uid
+func (m *Memory) CreateUser(ctx context.Context, email, displayName string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.emails[email]; ok {
+		return "", apierr.Conflict("email already registered")
+	}
+
+	b := make([]byte, 14)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	uid := hex.EncodeToString(b)
+	m.emails[email] = uid
+	return uid, nil
+}
+
+// DeleteUser ... Frees the email registered to uid
+func (m *Memory) DeleteUser(ctx context.Context, uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for email, owner := range m.emails {
+		if owner == uid {
+			delete(m.emails, email)
+		}
+	}
+	return nil
+}
+
+// VerifyIDToken ... Accepts tokens made by Token. Anyone can make one, so this is only for running offline
+func (m *Memory) VerifyIDToken(ctx context.Context, idToken string) (string, error) {
+	if !strings.HasPrefix(idToken, memoryTokenPrefix) || len(idToken) == len(memoryTokenPrefix) {
+		return "", errors.New("not an in-memory token")
+	}
+	return strings.TrimPrefix(idToken, memoryTokenPrefix), nil
+}
+
+// Token ... Makes a token the in-memory client will accept for uid
+func Token(uid string) string {
+	return memoryTokenPrefix + uid
+}
@@ -0,0 +1,71 @@
+package authn
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+)
+
+type contextKey string
+
+const uidKey contextKey = "uid"
+
+// Authenticate ... Middleware that verifies the bearer token in the Authorization header and stores the caller's uid.
+// Requests without the header pass through anonymously, routes that need a caller are wrapped in Require.
+func Authenticate(client Client) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			header := req.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			token := strings.TrimPrefix(header, "Bearer ")
+			if token == header || token == "" {
+				apierr.Write(res, req, apierr.Unauthorized("authorization header must be a bearer token"))
+				return
+			}
+
+			uid, err := client.VerifyIDToken(req.Context(), token)
+			if err != nil {
+				fmt.Println("[ ! ] Error verifying ID token: ", err)
+				apierr.Write(res, req, apierr.Unauthorized("invalid or expired ID token"))
+				return
+			}
+
+			next.ServeHTTP(res, req.WithContext(WithUID(req.Context(), uid)))
+		})
+	}
+}
+
+// Require ... Wraps a handler so it is only called for authenticated requests
+func Require(next func(res http.ResponseWriter, req *http.Request)) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if _, ok := UIDFrom(req.Context()); !ok {
+			apierr.Write(res, req, apierr.Unauthorized("an ID token is required"))
+			return
+		}
+		next(res, req)
+	}
+}
+
+// WithUID ... Stores the caller's verified uid on the context
+func WithUID(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, uidKey, uid)
+}
+
+// UIDFrom ... Gets the caller's verified uid from the context
+func UIDFrom(ctx context.Context) (string, bool) {
+	uid, ok := ctx.Value(uidKey).(string)
+	return uid, ok && uid != ""
+}
+
+// UID ... Gets the caller's uid from a request that went through Require
+func UID(req *http.Request) string {
+	uid, _ := UIDFrom(req.Context())
+	return uid
+}
@@ -0,0 +1,152 @@
+// Package blob keeps the files uploaded to the API, like post images, in S3 or on local disk.
+// Files are stored under keys made from their contents within the post or user they belong to, so
+// nothing uploaded can be overwritten by something else, and deleting one post's images never
+// takes another's.
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// Store ... Somewhere uploaded files are kept
+type Store interface {
+	// Put ... Saves what's read from body under key with the given content type and returns the
+	// URL it can be fetched from. body is streamed, so it can be bigger than fits in memory.
+	Put(ctx context.Context, key, contentType string, body io.Reader) (string, error)
+	// Get ... Reads back the file saved under key
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Open ... Streams the file saved under key, for ones too big to read in one go. The caller
+	// closes it.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete ... Removes the file saved under key, doing nothing if there isn't one
+	Delete(ctx context.Context, key string) error
+}
+
+// ErrNotFound ... Returned by Get when nothing is saved under the key
+var ErrNotFound = errors.New("file not found")
+
+// Where keys are made. Images are public, originals are the files exactly as they were uploaded,
+// EXIF data and all, and are only read back to make the images from. Exports are archives of a
+// user's data and are only handed out through the API's download link.
+const (
+	imagesDir    = "images/"
+	originalsDir = "originals/"
+	exportsDir   = "exports/"
+)
+
+// extensions ... The image types that are stored and the extension their keys end in
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// PostOwner ... What a post's images are kept under
+func PostOwner(postID string) string {
+	return "posts/" + postID + "/"
+}
+
+// UserOwner ... What a user's profile pictures are kept under
+func UserOwner(uid string) string {
+	return "users/" + uid + "/"
+}
+
+// Key ... The key an image belonging to owner is stored under, its SHA-256 followed by the
+// extension for its type
+func Key(owner string, data []byte, contentType string) string {
+	return key(imagesDir+owner, data, contentType)
+}
+
+// OriginalKey ... The key an upload belonging to owner is kept under, exactly as it was sent
+func OriginalKey(owner string, data []byte, contentType string) string {
+	return key(originalsDir+owner, data, contentType)
+}
+
+// ExportKey ... The key an archive of uid's data is kept under, token makes each one different
+func ExportKey(uid, token string) string {
+	return exportsDir + uid + "/" + token + ".zip"
+}
+
+func key(dir string, data []byte, contentType string) string {
+	sum := sha256.Sum256(data)
+	return dir + hex.EncodeToString(sum[:]) + extensions[contentType]
+}
+
+// KeyOf ... The key of the image at a URL handed out by Put, or "" if it isn't one
+func KeyOf(url string) string {
+	i := strings.Index(url, "/"+imagesDir)
+	if i < 0 || typeOf(url) == "" {
+		return ""
+	}
+	return url[i+1:]
+}
+
+// typeOf ... The content type of a key made by Key, or "" if it doesn't end in a known extension
+func typeOf(key string) string {
+	for contentType, ext := range extensions {
+		if len(key) > len(ext) && key[len(key)-len(ext):] == ext {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// DeletePostImages ... Removes every size of a post's images and the uploads they were made from.
+// Only keys under the post's own owner are removed. Images from before keys had owners may be
+// shared with other posts and profile pictures, so they're left where they are.
+func DeletePostImages(ctx context.Context, s Store, post models.Post) error {
+	keys := []string{}
+	seen := map[string]bool{}
+	add := func(key string) {
+		if owned(key, PostOwner(post.ID)) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	add(KeyOf(post.ImageURL))
+	for _, v := range []models.ImageVariant{post.Variants.Thumbnail, post.Variants.Feed, post.Variants.Full} {
+		add(KeyOf(v.URL))
+	}
+	for _, item := range post.Media {
+		add(KeyOf(item.URL))
+		for _, v := range []models.ImageVariant{item.Variants.Thumbnail, item.Variants.Feed, item.Variants.Full} {
+			add(KeyOf(v.URL))
+		}
+		add(item.Original)
+	}
+
+	return deleteKeys(ctx, s, keys)
+}
+
+// DeleteProfilePicture ... Removes a user's profile picture, as long as it's kept under the user
+// and so can't be anyone else's
+func DeleteProfilePicture(ctx context.Context, s Store, user models.User) error {
+	key := KeyOf(user.ProfilePic)
+	if !owned(key, UserOwner(user.UID)) {
+		return nil
+	}
+	return deleteKeys(ctx, s, []string{key})
+}
+
+// owned ... Whether key is an image or upload kept under owner
+func owned(key, owner string) bool {
+	return strings.HasPrefix(key, imagesDir+owner) || strings.HasPrefix(key, originalsDir+owner)
+}
+
+func deleteKeys(ctx context.Context, s Store, keys []string) error {
+	for _, key := range keys {
+		err := s.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MediaPath ... Where the API serves files kept on local disk
+const MediaPath = "/media/"
+
+// Local ... Store that keeps files in a directory on disk and serves them over HTTP, so the API
+// can run without AWS
+type Local struct {
+	dir     string
+	baseURL string
+	files   http.Handler
+}
+
+// NewLocal ... Creates a store that writes to dir, creating it if needed, and hands out URLs
+// under baseURL, which should point at MediaPath on the API
+func NewLocal(dir, baseURL string) (*Local, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		files:   http.FileServer(http.Dir(dir)),
+	}, nil
+}
+
+// Put ... Writes body to its key under the directory and returns the URL it's served at
+func (l *Local) Put(ctx context.Context, key, contentType string, body io.Reader) (string, error) {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first so a file is never served half written
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return l.baseURL + "/" + key, nil
+}
+
+// Get ... Reads the file saved under key
+func (l *Local) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Open ... Opens the file saved under key
+func (l *Local) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete ... Removes the file saved under key, if there is one
+func (l *Local) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(l.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP ... Serves a stored image, with the path relative to MediaPath. Only images with a
+// known extension are served, so there are no directory listings, half written uploads or originals.
+// The path is cleaned before it's checked, so images/../originals/ can't reach past images/.
+func (l *Local) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	contentType := typeOf(key)
+	if contentType == "" || !strings.HasPrefix(key, imagesDir) {
+		http.NotFound(res, req)
+		return
+	}
+
+	// serve the path that was checked, not the one that was asked for
+	cleaned := *req.URL
+	cleaned.Path, cleaned.RawPath = "/"+key, ""
+	served := req.WithContext(req.Context())
+	served.URL = &cleaned
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Cache-Control", cacheControl)
+	l.files.ServeHTTP(res, served)
+}
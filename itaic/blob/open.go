@@ -0,0 +1,42 @@
+package blob
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/jmlattanzi/itaic-backend/itaic/config"
+)
+
+// Open ... Keeps files in dir if it's set, linked under ITAIC_MEDIA_URL, otherwise in the S3
+// bucket in config.json
+func Open(dir string) (Store, error) {
+	if dir != "" {
+		fmt.Println("[ * ] Keeping images in " + dir)
+		baseURL := os.Getenv("ITAIC_MEDIA_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:8000" + MediaPath
+		}
+		return NewLocal(dir, baseURL)
+	}
+
+	conf, err := config.LoadConfigurationFile("config.json")
+	if err != nil {
+		return nil, err
+	}
+
+	region := conf.S3Region
+	if region == "" {
+		region = "us-west-1"
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(conf.S3AccessKey, conf.S3SecretAccessKey, ""),
+		Region:      aws.String(region),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewS3(sess, conf.S3Bucket), nil
+}
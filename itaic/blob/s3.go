@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// cacheControl ... Content addressed files never change, so they can be cached forever
+const cacheControl = "public, max-age=31536000, immutable"
+
+// S3 ... Store that uploads files to an S3 bucket. Only the images should be readable by the
+// public. Everything else, like originals with their EXIF data and GPS location, is uploaded with
+// a private ACL, and a bucket policy that makes files public must only cover images/.
+type S3 struct {
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+	client     *s3.S3
+	bucket     string
+}
+
+// NewS3 ... Creates a store that uploads to bucket with the given session, which is shared by every upload
+func NewS3(sess *session.Session, bucket string) *S3 {
+	return &S3{
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+		client:     s3.New(sess),
+		bucket:     bucket,
+	}
+}
+
+// Put ... Uploads body to the bucket, in parts if it's big, and returns its S3 URL. Anything that
+// isn't an image is made private, whatever the bucket's default is.
+func (s *S3) Put(ctx context.Context, key, contentType string, body io.Reader) (string, error) {
+	input := &s3manager.UploadInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		Body:         body,
+		ContentType:  aws.String(contentType),
+		CacheControl: aws.String(cacheControl),
+	}
+	if !strings.HasPrefix(key, imagesDir) {
+		input.ACL = aws.String(s3.ObjectCannedACLPrivate)
+		input.CacheControl = aws.String("private, no-store")
+	}
+
+	result, err := s.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
+
+// Get ... Downloads the file saved under key from the bucket
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	buf := aws.NewWriteAtBuffer(nil)
+	_, err := s.downloader.DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if missing(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Open ... Streams the file saved under key from the bucket
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if missing(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// missing ... Whether an error from S3 means nothing is saved under the key
+func missing(err error) bool {
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// Delete ... Removes the file saved under key from the bucket, S3 doesn't mind if it's not there
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
@@ -3,283 +3,259 @@ package cc
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
 	"time"
 
-	"github.com/streadway/amqp"
-
-	shortid "github.com/jasonsoft/go-short-id"
-	"google.golang.org/api/iterator"
-
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/entities"
 	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
 	"goji.io/pat"
-
-	"cloud.google.com/go/firestore"
 )
 
-// HandleAddComment ... Adds a comment to the db
-func HandleAddComment(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+// commentPage ... One page of a post's comments or of the replies to one
+type commentPage struct {
+	Comments   []models.Comment `json:"comments"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// HandleGetComments ... Gets a page of a post's comments oldest first, or of the replies to the
+// comment in ?parent_id=
+func HandleGetComments(ctx context.Context, comments store.CommentStore, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
-		id := pat.Param(req, "id")
-		user := models.User{}
-		type NewComment struct {
-			Comment string `json:"comment"`
-		}
-
-		opt := shortid.Options{
-			Number:        14,
-			StartWithYear: false,
-			EndWithHost:   false,
-		}
-
-		newComment := models.Comment{
-			ID:       shortid.Generate(opt),
-			Created:  time.Now().String(),
-			Likes:    0,
-			Comment:  "",
-			UID:      "",
-			Username: "",
-		}
-		currentPost := models.Post{}
-		err := json.NewDecoder(req.Body).Decode(&newComment)
+		params, err := page.FromRequest(req)
 		if err != nil {
-			log.Fatal("[ ! ] Error decoding request body: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		query := client.Collection("users").Where("uid", "==", newComment.UID)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				log.Fatal("[ ! ] Error iterating documents: ", err)
-			}
-
-			fmt.Println("doc.Data: ", doc.Data())
-
-			err = doc.DataTo(&user)
+		// ask for one extra comment to find out if there's another page
+		q := store.CommentQuery{Limit: params.Limit + 1, ParentID: req.URL.Query().Get("parent_id")}
+		if params.Cursor != "" {
+			q.After = &store.CommentCursor{}
+			err = page.DecodeCursor(params.Cursor, q.After)
 			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
+				apierr.Write(res, req, err)
+				return
 			}
 		}
 
-		fmt.Println("username: ", user)
-		newComment.Username = user.Username
-
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
+		result, err := comments.ListComments(ctx, pat.Param(req, "id"), q)
 		if err != nil {
-			log.Fatal("[ ! ] Error getting document: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
 		}
-		err = doc.DataTo(&currentPost)
-		if err != nil {
-			log.Fatal("[ ! ] Error writing data to struct: ", err)
+
+		next := ""
+		if len(result) > params.Limit {
+			result = result[:params.Limit]
+			last := result[len(result)-1]
+			next = page.EncodeCursor(store.CommentCursor{Created: last.Created, ID: last.ID})
 		}
 
-		currentPost.Comments = append(currentPost.Comments, newComment)
-		_, err = client.Collection("posts").Doc(id).Set(ctx, currentPost)
+		err = withUsernames(ctx, users, result)
 		if err != nil {
-			log.Fatal("[ ! ] Error setting document: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		sendMessage(ch, q, id)
-
-		json.NewEncoder(res).Encode(currentPost)
+		json.NewEncoder(res).Encode(&commentPage{Comments: result, NextCursor: next})
 	}
 }
 
-// HandleDeleteComment ... Deletes a comment based on post id and comment id
-func HandleDeleteComment(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+// HandleAddComment ... Adds a comment to a post, or a reply to the comment in parent_id
+func HandleAddComment(ctx context.Context, comments store.CommentStore, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
 		id := pat.Param(req, "id")
-		commentID := pat.Param(req, "comment")
-		currentPost := models.Post{}
-		comments := []models.Comment{}
 
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
+		type NewComment struct {
+			Comment  string `json:"comment"`
+			ParentID string `json:"parent_id"`
+		}
+		body := NewComment{}
+		err := json.NewDecoder(req.Body).Decode(&body)
 		if err != nil {
-			log.Fatal("[ ! ] Error getting document")
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON comment"))
+			return
+		}
+		if body.Comment == "" {
+			apierr.Write(res, req, apierr.Validation("comment is required"))
+			return
 		}
 
-		err = doc.DataTo(&currentPost)
-		if err != nil {
-			log.Fatal("[ ! ] Error mapping data into struct: ", err)
+		newComment := models.Comment{
+			ID:       comments.NewCommentID(id),
+			ParentID: body.ParentID,
+			Comment:  body.Comment,
 		}
+		newComment.UID = authn.UID(req)
+		newComment.Created = time.Now().UTC()
+		newComment.UpdatedAt = newComment.Created
 
-		for _, comment := range currentPost.Comments {
-			if comment.ID == commentID {
-				fmt.Println("[ + ] Comment found")
-			} else {
-				comments = append(comments, comment)
-			}
+		user, err := users.GetUser(ctx, newComment.UID)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+		newComment.Username = user.Username
+		newComment.Entities, err = entities.Extract(ctx, users, newComment.Comment)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
 		}
 
-		currentPost.Comments = comments
-		_, err = client.Collection("posts").Doc(id).Set(ctx, currentPost)
+		e, err := commentEvent(events.CommentAdded, newComment.UID, id, newComment)
 		if err != nil {
-			log.Fatal("[ ! ] Error setting document: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		sendMessage(ch, q, id)
+		// counts the comment on the post, and on the comment it replies to, in the same write
+		newComment, err = comments.AddComment(ctx, id, newComment, e)
+		if err != nil {
+			what := "post"
+			if newComment.ParentID != "" {
+				what = "post or parent comment"
+			}
+			apierr.Write(res, req, apierr.Missing(err, what))
+			return
+		}
 
-		json.NewEncoder(res).Encode(currentPost)
+		json.NewEncoder(res).Encode(&newComment)
 	}
 }
 
-// HandleEditComment ... Edits a comment and submits to the db
-func HandleEditComment(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+// HandleDeleteComment ... Deletes a comment based on post id and comment id
+func HandleDeleteComment(ctx context.Context, comments store.CommentStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
 		id := pat.Param(req, "id")
 		commentID := pat.Param(req, "comment")
-		currentPost := models.Post{}
-		comments := []models.Comment{}
-
-		type NewComment struct {
-			Comment string `json:"comment"`
-		}
-		newComment := NewComment{}
 
-		err := json.NewDecoder(req.Body).Decode(&newComment)
+		comment, err := comments.GetComment(ctx, id, commentID)
 		if err != nil {
-			log.Fatal("[ ! ] Error decoding the response body: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "comment"))
+			return
 		}
-
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
-		if err != nil {
-			log.Fatal("[ ! ] Error getting document")
+		if comment.UID != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("only the author can delete a comment"))
+			return
 		}
 
-		err = doc.DataTo(&currentPost)
+		e, err := commentEvent(events.CommentDeleted, comment.UID, id, comment)
 		if err != nil {
-			log.Fatal("[ ! ] Error mapping data into struct: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		for _, comment := range currentPost.Comments {
-			if comment.ID == commentID {
-				fmt.Println("[ + ] Comment found")
-				comment.Comment = newComment.Comment
-			}
-
-			comments = append(comments, comment)
-		}
-
-		currentPost.Comments = comments
-		_, err = client.Collection("posts").Doc(id).Set(ctx, currentPost)
+		// also deletes the comment's replies
+		err = comments.DeleteComment(ctx, id, commentID, e)
 		if err != nil {
-			log.Fatal("[ ! ] Error setting document: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "comment"))
+			return
 		}
 
-		sendMessage(ch, q, id)
-
-		json.NewEncoder(res).Encode(currentPost)
+		json.NewEncoder(res).Encode("Comment deleted")
 	}
 }
 
-//HandleLikeComment ... Handles liking a comment
-func HandleLikeComment(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+// HandleEditComment ... Edits a comment and submits to the db
+func HandleEditComment(ctx context.Context, comments store.CommentStore, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
 		id := pat.Param(req, "id")
-		postID := pat.Param(req, "post_id")
-		uid := pat.Param(req, "uid")
-		user := models.User{}
-		post := models.Post{}
-
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				log.Fatal("[ ! ] Error iterating documents: ", err)
-			}
+		commentID := pat.Param(req, "comment")
 
-			err = doc.DataTo(&user)
-			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
-			}
+		type NewComment struct {
+			Comment string `json:"comment"`
 		}
+		newComment := NewComment{}
 
-		// get the post containing the comment
-		doc, err := client.Collection("posts").Doc(postID).Get(ctx)
+		err := json.NewDecoder(req.Body).Decode(&newComment)
 		if err != nil {
-			log.Fatal("[ ! ] Error getting post: ", err)
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON object with a comment"))
+			return
+		}
+		if newComment.Comment == "" {
+			apierr.Write(res, req, apierr.Validation("comment is required"))
+			return
 		}
 
-		err = doc.DataTo(&post)
+		comment, err := comments.GetComment(ctx, id, commentID)
 		if err != nil {
-			log.Fatal("[ ! ] Error mapping data into post: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "comment"))
+			return
 		}
-
-		likes := user.CommentLikes
-		for index, comment := range post.Comments {
-			if comment.ID == id {
-				addToLikes, i := remove(likes, id)
-				if addToLikes == false && i == 0 {
-					likes = append(likes, id)
-					post.Comments[index].Likes++
-				} else {
-					likes = append(likes[:i], likes[i+1:]...)
-					post.Comments[index].Likes--
-				}
-			}
+		if comment.UID != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("only the author can edit a comment"))
+			return
 		}
 
-		user.CommentLikes = likes
-		_, err = client.Collection("users").Doc(user.ID).Set(ctx, user)
+		found, err := entities.Extract(ctx, users, newComment.Comment)
 		if err != nil {
-			log.Fatal("[ ! ] Error adding comment to liked comments: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
-
-		_, err = client.Collection("posts").Doc(postID).Set(ctx, post)
+		comment.Comment = newComment.Comment
+		comment.Entities = found
+		comment.UpdatedAt = time.Now().UTC()
+		e, err := commentEvent(events.CommentUpdated, comment.UID, id, comment)
 		if err != nil {
-			log.Fatal("[ ! ] Error updating post: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		sendMessage(ch, q, postID)
+		err = comments.UpdateComment(ctx, id, comment, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "comment"))
+			return
+		}
 
-		json.NewEncoder(res).Encode(&post)
+		json.NewEncoder(res).Encode(&comment)
 	}
 }
 
-func remove(likes []string, id string) (bool, int) {
-	for i := 0; i < len(likes); i++ {
-		likeID := likes[i]
-		if likeID == id {
-			return true, i
+// withUsernames ... Shows each author's current username on their comments. Comments keep the
+// username they were written with, and a user's comments are spread over everyone's posts, so a
+// rename is picked up here rather than by rewriting them.
+func withUsernames(ctx context.Context, users store.UserStore, comments []models.Comment) error {
+	uids := []string{}
+	seen := map[string]bool{}
+	for _, c := range comments {
+		if !seen[c.UID] {
+			seen[c.UID] = true
+			uids = append(uids, c.UID)
 		}
 	}
-	return false, 0
-}
 
-func sendMessage(ch *amqp.Channel, q amqp.Queue, id string) {
-	body := id
-	err := ch.Publish(
-		"",
-		q.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Type:        "UPDATE",
-			Body:        []byte(body),
-		})
+	authors, err := users.GetUsers(ctx, uids)
 	if err != nil {
-		log.Fatal("[ ! ] Error publishing message")
+		return err
+	}
+	usernames := map[string]string{}
+	for _, author := range authors {
+		usernames[author.UID] = author.Username
 	}
-	fmt.Println("[ + ] Message sent")
+
+	// authors who are gone keep the username the comment was written with
+	for i, c := range comments {
+		if username, ok := usernames[c.UID]; ok {
+			comments[i].Username = username
+		}
+	}
+	return nil
+}
+
+// commentEvent ... Builds the event recorded alongside a change to a comment
+func commentEvent(eventType, actor, postID string, comment models.Comment) (events.Event, error) {
+	return events.New(eventType, actor, events.Comment{PostID: postID, CommentID: comment.ID, ParentID: comment.ParentID})
 }
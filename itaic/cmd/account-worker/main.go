@@ -0,0 +1,80 @@
+// Command account-worker deletes the accounts users ask to have deleted and builds the archives
+// of their data they ask for. It takes the deletion and export jobs the API queues on RabbitMQ.
+// A deletion removes the user's auth account, likes, comments, posts with their images, and
+// follows, then the user. Progress is saved in the deletions collection as it goes, so a job
+// that's interrupted carries on where it stopped when it's delivered again. An export zips up the
+// user's data and original images into the same storage as the images. The events it records are
+// published by the API's outbox relay.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	firebase "firebase.google.com/go"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/health"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/worker"
+	"google.golang.org/api/option"
+)
+
+// jobsQueue ... The queue account jobs are taken from, shared by every worker
+const jobsQueue = "itaic-accounts.jobs"
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	media := flag.String("media", "", "delete images and keep exports in this directory instead of S3, the same one the API was given")
+	addr := flag.String("addr", ":8002", "address to serve /health on")
+	flag.Parse()
+
+	fmt.Println("[ * ] Starting account worker....")
+	ctx := context.Background()
+
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	auth, err := app.Auth(ctx)
+	if err != nil {
+		log.Fatalf("[ ! ] Error getting Auth client: %v\n", err)
+	}
+
+	blobs, err := blob.Open(*media)
+	if err != nil {
+		log.Fatal("[ ! ] Error setting up image storage: ", err)
+	}
+
+	db := store.NewFirestore(client)
+	jobs := map[string]worker.Job{
+		events.DeletionRequested: worker.NewAccounts(db, authn.NewFirebase(auth), blobs),
+		events.ExportRequested:   worker.NewExports(db, blobs),
+	}
+	url := os.Getenv("ITAIC_RABBITMQ_URL")
+	if url == "" {
+		url = "amqp://176.24.0.9:5672"
+	}
+	conn := mq.NewConn(url)
+	mq.Consume(conn, jobsQueue, []string{events.DeletionRequested, events.ExportRequested}, func(e events.Event) error {
+		return jobs[e.Type].Handle(ctx, e)
+	})
+	go conn.Run()
+
+	fmt.Println("[ + ] Account worker started")
+	http.Handle("/health", health.Handler(map[string]health.Check{"rabbitmq": conn.Health}))
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
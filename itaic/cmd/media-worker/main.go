@@ -0,0 +1,67 @@
+// Command media-worker processes the images uploaded with new posts. It takes the media jobs the
+// API queues on RabbitMQ, makes each original into the sizes posts are shown at and marks the
+// post ready, or failed with the reason. The post.ready and post.updated events it records are
+// published by the API's outbox relay. Run as many as needed, each job goes to one of them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	firebase "firebase.google.com/go"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/health"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/worker"
+	"google.golang.org/api/option"
+)
+
+// jobsQueue ... The queue media jobs are taken from, shared by every worker
+const jobsQueue = "itaic-media.jobs"
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	media := flag.String("media", "", "read and write images in this directory instead of S3, the same one the API was given")
+	addr := flag.String("addr", ":8001", "address to serve /health on")
+	flag.Parse()
+
+	fmt.Println("[ * ] Starting media worker....")
+	ctx := context.Background()
+
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	blobs, err := blob.Open(*media)
+	if err != nil {
+		log.Fatal("[ ! ] Error setting up image storage: ", err)
+	}
+
+	w := worker.New(store.NewFirestore(client), blobs)
+	url := os.Getenv("ITAIC_RABBITMQ_URL")
+	if url == "" {
+		url = "amqp://176.24.0.9:5672"
+	}
+	conn := mq.NewConn(url)
+	mq.Consume(conn, jobsQueue, []string{events.MediaRequested}, func(e events.Event) error {
+		return w.Handle(ctx, e)
+	})
+	go conn.Run()
+
+	fmt.Println("[ + ] Media worker started")
+	http.Handle("/health", health.Handler(map[string]health.Check{"rabbitmq": conn.Health}))
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
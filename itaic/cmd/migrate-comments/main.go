@@ -0,0 +1,138 @@
+// Command migrate-comments moves the comments embedded in each post's comments array
+// into the post's comments subcollection, keeping their ids, then drops the array and
+// adds the comments to the post's comment_count. It is safe to run more than once, posts
+// without a comments array are left alone, and a post that was only partly moved is
+// finished on the next run.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// batchSize ... How many comments are written per batch, Firestore allows up to 500 writes
+const batchSize = 400
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	migrated, moved, skipped := 0, 0, 0
+	refs := client.Collection("posts").DocumentRefs(ctx)
+	for {
+		ref, err := refs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		n, err := migratePost(ctx, client, ref, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error migrating post "+ref.ID+": ", err)
+			skipped++
+			continue
+		}
+		if n >= 0 {
+			fmt.Printf("[ + ] Moved %d comments off post %s\n", n, ref.ID)
+			migrated++
+			moved += n
+		}
+	}
+
+	fmt.Printf("[ * ] Done, %d comments moved off %d posts, %d skipped\n", moved, migrated, skipped)
+}
+
+// migratePost ... Copies a post's embedded comments into its subcollection and then drops the
+// array, returning how many comments it had or -1 if it had no array
+func migratePost(ctx context.Context, client *firestore.Client, ref *firestore.DocumentRef, dryRun bool) (int, error) {
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	raw, has := doc.Data()["comments"]
+	if !has {
+		return -1, nil
+	}
+	embedded, _ := raw.([]interface{})
+	if dryRun {
+		return len(embedded), nil
+	}
+
+	// the copies are keyed by comment id, so writing them again on a rerun changes nothing
+	batch := client.Batch()
+	pending := 0
+	for _, item := range embedded {
+		comment, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		id, _ := comment["id"].(string)
+		commentRef := ref.Collection("comments").NewDoc()
+		if id != "" {
+			commentRef = ref.Collection("comments").Doc(id)
+		}
+		comment["id"] = commentRef.ID
+		comment["post_id"] = ref.ID
+		comment["parent_id"] = ""
+		comment["reply_count"] = 0
+
+		batch.Set(commentRef, comment)
+		pending++
+		if pending == batchSize {
+			_, err = batch.Commit(ctx)
+			if err != nil {
+				return 0, err
+			}
+			batch = client.Batch()
+			pending = 0
+		}
+	}
+	if pending > 0 {
+		_, err = batch.Commit(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// comments added through the subcollection since the API was updated are already counted
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if _, has := doc.Data()["comments"]; !has {
+			return nil
+		}
+
+		count, _ := doc.Data()["comment_count"].(int64)
+		return tx.Update(ref, []firestore.Update{
+			{Path: "comments", Value: firestore.Delete},
+			{Path: "comment_count", Value: count + int64(len(embedded))},
+		})
+	})
+	return len(embedded), err
+}
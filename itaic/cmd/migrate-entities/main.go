@@ -0,0 +1,153 @@
+// Command migrate-entities finds the hashtags and mentions in the captions and comments written
+// before they were picked out, and adds the posts to the post_tags index so they show up under
+// their hashtags. It is safe to run more than once, posts and comments whose entities are already
+// up to date are left alone. Run it after migrate-usernames, mentions are looked up by username.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/entities"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	// writes go through the store so the post_tags index is kept in the same write as the post
+	db := store.NewFirestore(client)
+
+	posts, comments, skipped := 0, 0, 0
+	docs := client.Collection("posts").Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			fmt.Println("[ ! ] Skipping unreadable post "+doc.Ref.ID+": ", err)
+			skipped++
+			continue
+		}
+
+		changed, err := migratePost(ctx, db, post, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error migrating post "+post.ID+": ", err)
+			skipped++
+			continue
+		}
+		if changed {
+			fmt.Println("[ + ] Added the entities of post " + post.ID)
+			posts++
+		}
+
+		n, err := migrateComments(ctx, db, doc.Ref, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error migrating the comments on post "+post.ID+": ", err)
+			skipped++
+		}
+		if n > 0 {
+			fmt.Printf("[ + ] Added the entities of %d comments on post %s\n", n, post.ID)
+		}
+		comments += n
+	}
+
+	fmt.Printf("[ * ] Done, %d posts and %d comments migrated, %d skipped\n", posts, comments, skipped)
+}
+
+// migratePost ... Sets the entities of the post's caption if they've changed, reporting whether
+// they had
+func migratePost(ctx context.Context, db *store.Firestore, post models.Post, dryRun bool) (bool, error) {
+	found, err := entities.Extract(ctx, db, post.Caption)
+	if err != nil {
+		return false, err
+	}
+	if same(found, post.Entities) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	post.Entities = found
+	return true, db.UpdatePost(ctx, post)
+}
+
+// migrateComments ... Sets the entities of each comment on the post that have changed, returning
+// how many had
+func migrateComments(ctx context.Context, db *store.Firestore, post *firestore.DocumentRef, dryRun bool) (int, error) {
+	docs := post.Collection("comments").Documents(ctx)
+	defer docs.Stop()
+
+	n := 0
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		comment := models.Comment{}
+		err = doc.DataTo(&comment)
+		if err != nil {
+			return n, err
+		}
+
+		found, err := entities.Extract(ctx, db, comment.Comment)
+		if err != nil {
+			return n, err
+		}
+		if same(found, comment.Entities) {
+			continue
+		}
+		if !dryRun {
+			comment.Entities = found
+			err = db.UpdateComment(ctx, post.ID, comment)
+			if err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+}
+
+// same ... Whether two lists of entities match, an empty list being the same as none
+func same(a, b []models.Entity) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
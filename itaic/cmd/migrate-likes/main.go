@@ -0,0 +1,180 @@
+// Command migrate-likes creates a like document for every like that was only recorded
+// in a user's likes and comment_likes lists, so it shows up when listing who liked a post
+// or comment. Counts on posts and comments already include these likes and are left alone.
+// It is safe to run more than once, likes that already have a document are skipped. Run
+// migrate-comments first so comment likes can be matched to their posts.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	// user lists only hold ids, so find out which post each comment is on and when things were made
+	posts := map[string]models.Post{}
+	comments := map[string]models.Comment{}
+	iter := client.Collection("posts").Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			fmt.Println("[ ! ] Error reading post "+doc.Ref.ID+": ", err)
+			continue
+		}
+		posts[post.ID] = post
+
+		err = readComments(ctx, doc.Ref, comments)
+		if err != nil {
+			fmt.Println("[ ! ] Error reading the comments on post "+doc.Ref.ID+": ", err)
+		}
+	}
+	iter.Stop()
+
+	created, skipped := 0, 0
+	iter = client.Collection("users").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing users: ", err)
+		}
+
+		user := models.User{}
+		err = doc.DataTo(&user)
+		if err != nil {
+			fmt.Println("[ ! ] Error reading user "+doc.Ref.ID+": ", err)
+			continue
+		}
+
+		targets := []store.LikeTarget{}
+		for _, id := range user.Likes {
+			targets = append(targets, store.LikeTarget{PostID: id})
+		}
+		for _, id := range user.CommentLikes {
+			comment, ok := comments[id]
+			if !ok {
+				fmt.Println("[ ! ] Skipping like of missing comment " + id + " by " + user.UID)
+				skipped++
+				continue
+			}
+			targets = append(targets, store.LikeTarget{PostID: comment.PostID, CommentID: id})
+		}
+
+		for _, target := range targets {
+			post, ok := posts[target.PostID]
+			if !ok {
+				fmt.Println("[ ! ] Skipping like of missing post " + target.PostID + " by " + user.UID)
+				skipped++
+				continue
+			}
+
+			ok, err := createLike(ctx, client, user.UID, target, likedAt(post, comments[target.CommentID], target), *dryRun)
+			if err != nil {
+				fmt.Println("[ ! ] Error creating like "+store.LikeID(user.UID, target)+": ", err)
+				skipped++
+				continue
+			}
+			if ok {
+				fmt.Println("[ + ] Created like " + store.LikeID(user.UID, target))
+				created++
+			}
+		}
+	}
+
+	fmt.Printf("[ * ] Done, %d likes created, %d skipped\n", created, skipped)
+}
+
+// createLike ... Creates the like document unless it's already there, reporting whether it was created
+func createLike(ctx context.Context, client *firestore.Client, uid string, target store.LikeTarget, created models.Like, dryRun bool) (bool, error) {
+	ref := client.Collection("likes").Doc(store.LikeID(uid, target))
+	_, err := ref.Get(ctx)
+	if err == nil {
+		return false, nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	created.UID = uid
+	_, err = ref.Create(ctx, created)
+	if status.Code(err) == codes.AlreadyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readComments ... Adds the comments kept under a post to comments, by id
+func readComments(ctx context.Context, post *firestore.DocumentRef, comments map[string]models.Comment) error {
+	iter := post.Collection("comments").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		comment := models.Comment{}
+		err = doc.DataTo(&comment)
+		if err != nil {
+			return err
+		}
+		comment.PostID = post.ID
+		comments[comment.ID] = comment
+	}
+}
+
+// likedAt ... The like for target with the best guess at when it happened, which is when the
+// post or comment was made since the real time was never stored
+func likedAt(post models.Post, comment models.Comment, target store.LikeTarget) models.Like {
+	like := models.Like{PostID: target.PostID, CommentID: target.CommentID, Created: post.Created}
+	if target.CommentID != "" {
+		like.Created = comment.Created
+	}
+	return like
+}
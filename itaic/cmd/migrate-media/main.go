@@ -0,0 +1,102 @@
+// Command migrate-media gives every post from before posts could have several images a media
+// list holding its one image, so clients can read every post's images the same way. It is safe
+// to run more than once, posts that already have a media list or have no image are left alone.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	migrated, skipped := 0, 0
+	refs := client.Collection("posts").DocumentRefs(ctx)
+	for {
+		ref, err := refs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		changed, err := migratePost(ctx, client, ref, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error migrating post "+ref.ID+": ", err)
+			skipped++
+			continue
+		}
+		if changed {
+			fmt.Println("[ + ] Added a media list to post " + ref.ID)
+			migrated++
+		}
+	}
+
+	fmt.Printf("[ * ] Done, %d posts migrated, %d skipped\n", migrated, skipped)
+}
+
+// migratePost ... Sets the post's media list to its cover image if it doesn't have one, reporting
+// whether it did
+func migratePost(ctx context.Context, client *firestore.Client, ref *firestore.DocumentRef, dryRun bool) (bool, error) {
+	changed := false
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		changed = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			return err
+		}
+		if len(post.Media) > 0 || post.ImageURL == "" {
+			return nil
+		}
+
+		changed = true
+		if dryRun {
+			return nil
+		}
+
+		// the same image always gets the same id, and it only has to be unique within the post
+		sum := sha256.Sum256([]byte(post.ImageURL))
+		return tx.Update(ref, []firestore.Update{{Path: "media", Value: []models.MediaItem{{
+			ID:          hex.EncodeToString(sum[:4]),
+			URL:         post.ImageURL,
+			Width:       post.Width,
+			Height:      post.Height,
+			Variants:    post.Variants,
+			Placeholder: post.Placeholder,
+		}}}})
+	})
+	return changed, err
+}
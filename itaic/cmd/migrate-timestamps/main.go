@@ -0,0 +1,153 @@
+// Command migrate-timestamps rewrites posts whose created times were stored as
+// time.Now().String() so they hold Firestore timestamps instead. Posts and comments
+// without an updated_at get one equal to their creation time. It is safe to run more
+// than once, documents that are already migrated are left alone.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// legacyLayout ... What time.Time.String() produces, minus the monotonic clock reading
+const legacyLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	migrated, skipped := 0, 0
+	refs := client.Collection("posts").DocumentRefs(ctx)
+	for {
+		ref, err := refs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		changed, err := migratePost(ctx, client, ref, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error migrating post "+ref.ID+": ", err)
+			skipped++
+			continue
+		}
+		if changed {
+			fmt.Println("[ + ] Migrated post " + ref.ID)
+			migrated++
+		}
+	}
+
+	fmt.Printf("[ * ] Done, %d posts migrated, %d skipped\n", migrated, skipped)
+}
+
+// migratePost ... Converts one post and its comments inside a transaction, reporting whether anything changed
+func migratePost(ctx context.Context, client *firestore.Client, ref *firestore.DocumentRef, dryRun bool) (bool, error) {
+	changed := false
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		changed = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		data := doc.Data()
+
+		updates := []firestore.Update{}
+		created, ok, err := convert(data["created"])
+		if err != nil {
+			return err
+		}
+		if ok {
+			updates = append(updates, firestore.Update{Path: "created", Value: created})
+		}
+		if _, has := data["updated_at"]; !has {
+			updates = append(updates, firestore.Update{Path: "updated_at", Value: created})
+		}
+
+		// comments live in an array on the post, so the whole array is written back
+		comments, _ := data["comments"].([]interface{})
+		commentsChanged := false
+		for _, raw := range comments {
+			comment, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			commentCreated, converted, err := convert(comment["created"])
+			if err != nil {
+				return err
+			}
+			if converted {
+				comment["created"] = commentCreated
+				commentsChanged = true
+			}
+			if _, has := comment["updated_at"]; !has {
+				comment["updated_at"] = commentCreated
+				commentsChanged = true
+			}
+		}
+		if commentsChanged {
+			updates = append(updates, firestore.Update{Path: "comments", Value: comments})
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		changed = true
+		if dryRun {
+			return nil
+		}
+		return tx.Update(ref, updates)
+	})
+	return changed, err
+}
+
+// convert ... Gets the timestamp for a created field, reporting whether it was in the old string format
+func convert(value interface{}) (time.Time, bool, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, false, nil
+	case string:
+		t, err := parseLegacy(v)
+		return t, true, err
+	case nil:
+		return time.Time{}, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("unexpected created value %v", value)
+}
+
+// parseLegacy ... Parses a time.Time.String() value, which may end in a monotonic clock reading like " m=+0.001"
+func parseLegacy(value string) (time.Time, error) {
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+
+	t, err := time.Parse(legacyLayout, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
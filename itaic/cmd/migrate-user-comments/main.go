@@ -0,0 +1,124 @@
+// Command migrate-user-comments adds the comments written before the user_comments index existed
+// to it, so deleting an account finds every comment the user wrote. It is safe to run more than
+// once, entries that are already there are written again unchanged. Run it after migrate-comments.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// batchSize ... How many entries are written at once, Firestore allows up to 500
+const batchSize = 500
+
+// userComment ... The same shape the store keeps user_comments entries in
+type userComment struct {
+	UID       string    `firestore:"uid"`
+	PostID    string    `firestore:"post_id"`
+	CommentID string    `firestore:"comment_id"`
+	Created   time.Time `firestore:"created"`
+}
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	indexed, skipped := 0, 0
+	refs := client.Collection("posts").DocumentRefs(ctx)
+	for {
+		ref, err := refs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing posts: ", err)
+		}
+
+		n, err := indexPost(ctx, client, ref, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error indexing the comments on post "+ref.ID+": ", err)
+			skipped++
+			continue
+		}
+		if n > 0 {
+			fmt.Printf("[ + ] Indexed %d comments on post %s\n", n, ref.ID)
+		}
+		indexed += n
+	}
+
+	fmt.Printf("[ * ] Done, %d comments indexed, %d posts skipped\n", indexed, skipped)
+}
+
+// indexPost ... Writes an index entry for every comment on the post, returning how many there were
+func indexPost(ctx context.Context, client *firestore.Client, post *firestore.DocumentRef, dryRun bool) (int, error) {
+	docs := post.Collection("comments").Documents(ctx)
+	defer docs.Stop()
+
+	n := 0
+	batch, pending := client.Batch(), 0
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		comment := models.Comment{}
+		err = doc.DataTo(&comment)
+		if err != nil {
+			return n, err
+		}
+
+		n++
+		if dryRun {
+			continue
+		}
+		batch.Set(client.Collection("user_comments").Doc(post.ID+"_"+doc.Ref.ID), userComment{
+			UID:       comment.UID,
+			PostID:    post.ID,
+			CommentID: doc.Ref.ID,
+			Created:   comment.Created,
+		})
+		pending++
+		if pending == batchSize {
+			_, err = batch.Commit(ctx)
+			if err != nil {
+				return n, err
+			}
+			batch, pending = client.Batch(), 0
+		}
+	}
+
+	if pending > 0 {
+		_, err := batch.Commit(ctx)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
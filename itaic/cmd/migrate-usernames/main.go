@@ -0,0 +1,111 @@
+// Command migrate-usernames reserves the username of every user from before usernames had to be
+// unique, so nobody can register or rename to a name that's already in use. It is safe to run
+// more than once. When two users already share a name the first one found keeps it and the
+// others are reported, they can still sign in but should be asked to pick a new one.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// reservation ... The same shape the store keeps username reservations in
+type reservation struct {
+	UID      string `firestore:"uid"`
+	Username string `firestore:"username"`
+}
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing anything")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	reserved, clashes, skipped := 0, 0, 0
+	docs := client.Collection("users").Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal("[ ! ] Error listing users: ", err)
+		}
+
+		user := models.User{}
+		err = doc.DataTo(&user)
+		if err != nil || user.Username == "" {
+			fmt.Println("[ ! ] Skipping user "+doc.Ref.ID+" with no readable username: ", err)
+			skipped++
+			continue
+		}
+
+		owner, err := reserve(ctx, client, user, *dryRun)
+		if err != nil {
+			fmt.Println("[ ! ] Error reserving the username of user "+user.UID+": ", err)
+			skipped++
+			continue
+		}
+		switch owner {
+		case "":
+			fmt.Println("[ + ] Reserved " + user.Username + " for user " + user.UID)
+			reserved++
+		case user.UID:
+		default:
+			fmt.Println("[ ! ] User " + user.UID + " shares the username " + user.Username + " with user " + owner)
+			clashes++
+		}
+	}
+
+	fmt.Printf("[ * ] Done, %d usernames reserved, %d clashes, %d skipped\n", reserved, clashes, skipped)
+}
+
+// reserve ... Reserves the user's username if it's free, returning who already had it, or an
+// empty string if it was free
+func reserve(ctx context.Context, client *firestore.Client, user models.User, dryRun bool) (string, error) {
+	owner := ""
+	ref := client.Collection("usernames").Doc(store.UsernameKey(user.Username))
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		owner = ""
+		doc, err := tx.Get(ref)
+		if err == nil {
+			existing := reservation{}
+			err = doc.DataTo(&existing)
+			owner = existing.UID
+			return err
+		}
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		if dryRun {
+			return nil
+		}
+		return tx.Create(ref, reservation{UID: user.UID, Username: user.Username})
+	})
+	return owner, err
+}
@@ -0,0 +1,94 @@
+// Command rebuild-search makes the search index again from every post and user in Firestore and
+// writes it to the file the search service keeps it in. Stop the search service first, or it
+// will write over the new index with its own. Events published while it runs wait on the search
+// service's queue, and are applied on top of the new index once the service starts again.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/search"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	index := flag.String("index", "search-index.json", "file to write the index to, the one the search service was given")
+	flag.Parse()
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	db := store.NewFirestore(client)
+	idx := search.New()
+	indexer := search.NewIndexer(idx, db, db)
+
+	skipped := 0
+	err = each(ctx, client.Collection("users"), func(doc *firestore.DocumentSnapshot) {
+		user := models.User{}
+		err := doc.DataTo(&user)
+		if err != nil {
+			fmt.Println("[ ! ] Skipping unreadable user "+doc.Ref.ID+": ", err)
+			skipped++
+			return
+		}
+		indexer.PutUser(user)
+	})
+	if err != nil {
+		log.Fatal("[ ! ] Error listing users: ", err)
+	}
+
+	err = each(ctx, client.Collection("posts"), func(doc *firestore.DocumentSnapshot) {
+		post := models.Post{}
+		err := doc.DataTo(&post)
+		if err != nil {
+			fmt.Println("[ ! ] Skipping unreadable post "+doc.Ref.ID+": ", err)
+			skipped++
+			return
+		}
+		indexer.PutPost(post)
+	})
+	if err != nil {
+		log.Fatal("[ ! ] Error listing posts: ", err)
+	}
+
+	err = idx.Save(*index)
+	if err != nil {
+		log.Fatal("[ ! ] Error saving the index: ", err)
+	}
+	fmt.Printf("[ * ] Done, indexed %s, %d skipped\n", indexer, skipped)
+}
+
+// each ... Calls fn with every document in a collection
+func each(ctx context.Context, collection *firestore.CollectionRef, fn func(doc *firestore.DocumentSnapshot)) error {
+	docs := collection.Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(doc)
+	}
+}
@@ -0,0 +1,111 @@
+// Command search serves GET /search over posts, users and hashtags. It keeps its own index, built
+// from the post and user events the API publishes on RabbitMQ and saved to a file every few
+// seconds and when it's stopped, so it picks up where it left off when it starts again. The index
+// belongs to one process, run a single search service. If the file is lost or falls behind, stop
+// the service and run rebuild-search to make it again from Firestore.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"github.com/gorilla/handlers"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/health"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
+	"github.com/jmlattanzi/itaic-backend/itaic/search"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"goji.io"
+	"goji.io/pat"
+	"google.golang.org/api/option"
+)
+
+// eventsQueue ... The queue the search service takes post and user events from
+const eventsQueue = "itaic-search.events"
+
+// saveInterval ... How often the index is written to disk if it's changed
+const saveInterval = 10 * time.Second
+
+func main() {
+	key := flag.String("key", "itaic-key.json", "service account credentials file")
+	index := flag.String("index", "search-index.json", "file the index is kept in")
+	addr := flag.String("addr", ":8003", "address to serve /search and /health on")
+	flag.Parse()
+
+	fmt.Println("[ * ] Starting search service....")
+	ctx := context.Background()
+
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(*key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client, err := app.Firestore(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	idx, err := search.Load(*index)
+	if err != nil {
+		log.Fatal("[ ! ] Error loading the index: ", err)
+	}
+
+	// events only carry ids, the indexer reads the posts and users from Firestore
+	db := store.NewFirestore(client)
+	indexer := search.NewIndexer(idx, db, db)
+	fmt.Println("[ * ] Loaded " + indexer.String())
+
+	url := os.Getenv("ITAIC_RABBITMQ_URL")
+	if url == "" {
+		url = "amqp://176.24.0.9:5672"
+	}
+	conn := mq.NewConn(url)
+	mq.Consume(conn, eventsQueue, search.Events, func(e events.Event) error {
+		return indexer.Handle(ctx, e)
+	})
+	go conn.Run()
+	go saveEvery(idx, *index, saveInterval)
+
+	// events are acked once they're in memory, so save what's come in since the last save on the
+	// way out
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		err := idx.Save(*index)
+		if err != nil {
+			log.Fatal("[ ! ] Error saving the index: ", err)
+		}
+		fmt.Println("[ * ] Saved " + indexer.String())
+		os.Exit(0)
+	}()
+
+	router := goji.NewMux()
+	router.HandleFunc(pat.Get("/search"), search.HandleSearch(ctx, idx))
+	router.HandleFunc(pat.Get("/health"), health.Handler(map[string]health.Check{"rabbitmq": conn.Health}))
+
+	fmt.Println("[ + ] Search service started")
+	log.Fatal(http.ListenAndServe(*addr, handlers.LoggingHandler(os.Stdout, router)))
+}
+
+// saveEvery ... Writes the index to path every interval if it's changed
+func saveEvery(idx *search.Index, path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if !idx.Unsaved() {
+			continue
+		}
+		err := idx.Save(path)
+		if err != nil {
+			fmt.Println("[ ! ] Error saving the index: ", err)
+		}
+	}
+}
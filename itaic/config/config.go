@@ -3,26 +3,29 @@ package config
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/jmlattanzi/itaic-backend/itaic/models"
 )
 
-var config models.Config
-
 // LoadConfigurationFile ...Loads a configuration file
-func LoadConfigurationFile(filename string) models.Config {
+func LoadConfigurationFile(filename string) (models.Config, error) {
 	fmt.Println("[-] Loading configuration....")
+	config := models.Config{}
+
 	// Open the file and defer closing it until the function is done
 	configFile, err := os.Open(filename)
-	defer configFile.Close()
 	if err != nil {
-		log.Fatal("[!] Error loading configuration: ", err)
+		return config, fmt.Errorf("loading configuration: %v", err)
 	}
+	defer configFile.Close()
 
 	// decode the json and store it in config
-	json.NewDecoder(configFile).Decode(&config)
+	err = json.NewDecoder(configFile).Decode(&config)
+	if err != nil {
+		return config, fmt.Errorf("decoding configuration: %v", err)
+	}
+
 	fmt.Println("[+] Configuration loaded successfully")
-	return config
+	return config, nil
 }
@@ -0,0 +1,118 @@
+// Package entities finds the hashtags and mentions in captions and comments. Hashtags are kept in
+// lower case so #Beach and #beach are the same tag, and mentions are looked up by username so they
+// point at the user even after they rename.
+package entities
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// Limits on what counts as a hashtag or mention. Mentions match the usernames users can pick.
+const (
+	maxHashtag  = 100
+	minUsername = 3
+	maxUsername = 30
+)
+
+// Parse ... Finds the hashtags and mentions in text, in the order they appear. A # or @ only
+// starts one when it isn't in the middle of a word, so email addresses and HTML entities aren't
+// picked up. Mentions are returned without a UID, Extract fills them in.
+func Parse(text string) []models.Entity {
+	found := []models.Entity{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		marker := runes[i]
+		if (marker != '#' && marker != '@') || (i > 0 && (inWord(runes[i-1]) || runes[i-1] == '&')) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && allowed(marker, runes[end]) {
+			end++
+		}
+		body := string(runes[i+1 : end])
+
+		if marker == '#' {
+			if n := utf8.RuneCountInString(body); n == 0 || n > maxHashtag || strings.IndexFunc(body, unicode.IsLetter) < 0 {
+				continue
+			}
+			found = append(found, models.Entity{Type: models.EntityHashtag, Text: Normalize(body), Start: i, End: end})
+			i = end - 1
+			continue
+		}
+
+		// a mention at the end of a sentence shouldn't take the full stop with it
+		body = strings.TrimRight(body, ".")
+		end = i + 1 + len(body)
+		if len(body) < minUsername || len(body) > maxUsername {
+			continue
+		}
+		found = append(found, models.Entity{Type: models.EntityMention, Text: body, Start: i, End: end})
+		i = end - 1
+	}
+	return found
+}
+
+// Extract ... Parses text and looks up who each mention is of. Mentions of usernames nobody has
+// are left out, they're just text.
+func Extract(ctx context.Context, users store.UserStore, text string) ([]models.Entity, error) {
+	found := Parse(text)
+
+	usernames := []string{}
+	for _, e := range found {
+		if e.Type == models.EntityMention {
+			usernames = append(usernames, e.Text)
+		}
+	}
+	if len(usernames) == 0 {
+		return found, nil
+	}
+
+	owners, err := users.LookupUsernames(ctx, usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := []models.Entity{}
+	for _, e := range found {
+		if e.Type == models.EntityMention {
+			uid, ok := owners[store.UsernameKey(e.Text)]
+			if !ok {
+				continue
+			}
+			e.UID = uid
+		}
+		entities = append(entities, e)
+	}
+	return entities, nil
+}
+
+// Normalize ... The form a hashtag is kept and looked up in, without the # and in lower case
+func Normalize(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// Valid ... Whether tag, without the #, is something Parse would find as a hashtag
+func Valid(tag string) bool {
+	found := Parse("#" + tag)
+	return len(found) == 1 && found[0].End == utf8.RuneCountInString(tag)+1
+}
+
+// inWord ... Whether r can be part of a word, so a # or @ after it is in the middle of one
+func inWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// allowed ... Whether r can be part of the hashtag or mention started by marker
+func allowed(marker, r rune) bool {
+	if marker == '#' {
+		return inWord(r)
+	}
+	return r == '_' || r == '.' || (r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)))
+}
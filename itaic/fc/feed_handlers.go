@@ -0,0 +1,97 @@
+package fc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/timeline"
+)
+
+// feedPage ... One page of the home feed
+type feedPage struct {
+	Posts      []models.Post `json:"posts"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// HandleGetFeed ... Gets the caller's home feed, newest first. It comes from the cached timeline
+// when there is one, otherwise it is built from Firestore and handed to the cache for next time.
+func HandleGetFeed(ctx context.Context, posts store.PostStore, users store.UserStore, tl timeline.Timeline) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := authn.UID(req)
+		params, err := page.FromRequest(req)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		cached, next, err := tl.Page(ctx, uid, params.Cursor, params.Limit)
+		if err == nil {
+			json.NewEncoder(res).Encode(&feedPage{Posts: cached, NextCursor: next})
+			return
+		}
+		if err != timeline.ErrCold {
+			fmt.Println("[ ! ] Error reading timeline from cache: ", err)
+		}
+
+		user, err := users.GetUser(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		// a timeline only ever holds the newest MaxEntries posts
+		all, err := posts.ListPostsByUsers(ctx, user.Following, timeline.MaxEntries)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		// posts still processing join the feed once the worker has made their images
+		followed := []models.Post{}
+		for _, post := range all {
+			if post.Ready() {
+				followed = append(followed, post)
+			}
+		}
+
+		entries := timeline.Sort(followed)
+		if len(entries) > timeline.MaxEntries {
+			entries = entries[:timeline.MaxEntries]
+		}
+
+		window, next, err := timeline.After(entries, params.Cursor, params.Limit)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		byID := map[string]models.Post{}
+		for _, post := range followed {
+			byID[post.ID] = post
+		}
+
+		result := feedPage{Posts: []models.Post{}, NextCursor: next}
+		for _, entry := range window {
+			result.Posts = append(result.Posts, byID[entry.ID])
+		}
+
+		// warm the cache in the background so the client doesn't wait on it
+		go func() {
+			err := tl.Fill(ctx, uid, entries)
+			if err != nil {
+				fmt.Println("[ ! ] Error filling timeline: ", err)
+			}
+		}()
+
+		json.NewEncoder(res).Encode(&result)
+	}
+}
@@ -0,0 +1,170 @@
+package lc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"goji.io/pat"
+)
+
+// Target ... Reads what a like route is for from the request's path
+type Target func(req *http.Request) store.LikeTarget
+
+// PostTarget ... The post in /posts/like/:id
+func PostTarget(req *http.Request) store.LikeTarget {
+	return store.LikeTarget{PostID: pat.Param(req, "id")}
+}
+
+// CommentTarget ... The comment in /comment/like/:post_id/:id
+func CommentTarget(req *http.Request) store.LikeTarget {
+	return store.LikeTarget{PostID: pat.Param(req, "post_id"), CommentID: pat.Param(req, "id")}
+}
+
+// likerPage ... One page of the users who liked something
+type likerPage struct {
+	Users      []models.UserSummary `json:"users"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// HandleLike ... Makes the caller like the target and responds with the post or comment liked.
+// Liking something twice counts once.
+func HandleLike(ctx context.Context, likes store.LikeStore, posts store.PostStore, comments store.CommentStore, target Target) func(res http.ResponseWriter, req *http.Request) {
+	return handleLikeEdge(ctx, likes.Like, posts, comments, target, true)
+}
+
+// HandleUnlike ... Takes the caller's like off the target, if they liked it
+func HandleUnlike(ctx context.Context, likes store.LikeStore, posts store.PostStore, comments store.CommentStore, target Target) func(res http.ResponseWriter, req *http.Request) {
+	return handleLikeEdge(ctx, likes.Unlike, posts, comments, target, false)
+}
+
+func handleLikeEdge(ctx context.Context, update func(ctx context.Context, uid string, target store.LikeTarget, outbox ...events.Event) (int, error), posts store.PostStore, comments store.CommentStore, target Target, liked bool) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := authn.UID(req)
+		t := target(req)
+
+		post, err := posts.GetPost(ctx, t.PostID)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
+
+		comment := models.Comment{}
+		if t.CommentID != "" {
+			comment, err = comments.GetComment(ctx, t.PostID, t.CommentID)
+			if err != nil {
+				apierr.Write(res, req, apierr.Missing(err, "comment"))
+				return
+			}
+		}
+
+		e, err := likeEvent(uid, post, comment, t, liked)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		// the event is only recorded if the like changed
+		count, err := update(ctx, uid, t, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, name(t)))
+			return
+		}
+
+		if t.CommentID != "" {
+			comment.Likes = count
+			json.NewEncoder(res).Encode(&comment)
+			return
+		}
+		post.Likes = count
+		json.NewEncoder(res).Encode(&post)
+	}
+}
+
+// HandleGetLikes ... Gets a page of the users who liked the target, most recent first
+func HandleGetLikes(ctx context.Context, likes store.LikeStore, users store.UserStore, target Target) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		params, err := page.FromRequest(req)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		// ask for one extra like to find out if there's another page
+		q := store.LikeQuery{Limit: params.Limit + 1}
+		if params.Cursor != "" {
+			q.After = &store.LikeCursor{}
+			err = page.DecodeCursor(params.Cursor, q.After)
+			if err != nil {
+				apierr.Write(res, req, err)
+				return
+			}
+		}
+
+		t := target(req)
+		result, err := likes.ListLikes(ctx, t, q)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, name(t)))
+			return
+		}
+
+		next := ""
+		if len(result) > params.Limit {
+			result = result[:params.Limit]
+			last := result[len(result)-1]
+			next = page.EncodeCursor(store.LikeCursor{Created: last.Created, UID: last.UID})
+		}
+
+		uids := []string{}
+		for _, like := range result {
+			uids = append(uids, like.UID)
+		}
+		found, err := users.GetUsers(ctx, uids)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		liked := likerPage{Users: []models.UserSummary{}, NextCursor: next}
+		for _, u := range found {
+			liked.Users = append(liked.Users, u.Summary())
+		}
+
+		json.NewEncoder(res).Encode(&liked)
+	}
+}
+
+// likeEvent ... Builds the event recorded when uid likes or unlikes a post or one of its comments
+func likeEvent(uid string, post models.Post, comment models.Comment, t store.LikeTarget, liked bool) (events.Event, error) {
+	if t.CommentID == "" {
+		eventType := events.PostUnliked
+		if liked {
+			eventType = events.PostLiked
+		}
+		return events.New(eventType, uid, events.Post{ID: post.ID, UID: post.UID})
+	}
+
+	eventType := events.CommentUnliked
+	if liked {
+		eventType = events.CommentLiked
+	}
+	return events.New(eventType, uid, events.Comment{PostID: post.ID, CommentID: t.CommentID, ParentID: comment.ParentID})
+}
+
+// name ... What to call the target in a not found error
+func name(t store.LikeTarget) string {
+	if t.CommentID == "" {
+		return "post"
+	}
+	return "comment"
+}
@@ -2,26 +2,83 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	firebase "firebase.google.com/go"
 	"github.com/gorilla/handlers"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/health"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
 	"github.com/jmlattanzi/itaic-backend/itaic/cc"
+	"github.com/jmlattanzi/itaic-backend/itaic/fc"
+	"github.com/jmlattanzi/itaic-backend/itaic/lc"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
 	"github.com/jmlattanzi/itaic-backend/itaic/pc"
+	"github.com/jmlattanzi/itaic-backend/itaic/search"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/timeline"
 	"github.com/jmlattanzi/itaic-backend/itaic/uc"
-	"github.com/streadway/amqp"
+	"github.com/jmlattanzi/itaic-backend/itaic/worker"
 	"goji.io"
 	"goji.io/pat"
 	"google.golang.org/api/option"
 )
 
+// relayInterval ... How often the outbox is checked for events to publish
+const relayInterval = time.Second
+
 func main() {
+	memory := flag.Bool("memory", false, "run against in-memory stores instead of Firebase and RabbitMQ")
+	media := flag.String("media", "", "keep uploaded images in this directory and serve them from "+blob.MediaPath+" instead of S3, media when -memory is set")
+	flag.Parse()
+
 	fmt.Println("[ * ] Starting API....")
 	ctx := context.Background()
 
+	if *memory {
+		fmt.Println("[ * ] Using in-memory stores")
+		db := store.NewMemory()
+
+		if *media == "" {
+			*media = "media"
+		}
+		blobs, err := blob.Open(*media)
+		if err != nil {
+			log.Fatal("[ ! ] Error setting up image storage: ", err)
+		}
+
+		// there's no queue to hand jobs to, so the relay runs them itself
+		auth := authn.NewMemory()
+		jobs := map[string]worker.Job{
+			events.MediaRequested:    worker.New(db, blobs),
+			events.DeletionRequested: worker.NewAccounts(db, auth, blobs),
+			events.ExportRequested:   worker.NewExports(db, blobs),
+		}
+
+		// and keeps a search index that's served by the API rather than the search service
+		idx := search.New()
+		indexer := search.NewIndexer(idx, db, db)
+		for _, eventType := range search.Events {
+			jobs[eventType] = indexer
+		}
+		go mq.NewRelay(db, worker.NewInline(mq.NewMemory(), jobs), relayInterval).Run(ctx)
+
+		router := NewRouter(ctx, db, auth, timeline.Cold{}, blobs)
+		router.HandleFunc(pat.Get("/search"), search.HandleSearch(ctx, idx))
+		router.HandleFunc(pat.Get("/health"), health.Handler(nil))
+
+		fmt.Println("[ + ] API Started")
+		http.ListenAndServe(":8000", handlers.LoggingHandler(os.Stdout, router))
+		return
+	}
+
 	// Use a service account
 	sa := option.WithCredentialsFile("itaic-key.json")
 	app, err := firebase.NewApp(ctx, nil, sa)
@@ -40,51 +97,88 @@ func main() {
 		log.Fatalf("[ ! ] Error getting Auth client: %v\n", err)
 	}
 
-	conn, err := amqp.Dial("amqp://176.24.0.9:5672")
-	if err != nil {
-		log.Fatal("[ ! ] Failed connecting to RabbitMQ: ", err)
-	}
-	defer conn.Close()
+	// handlers write events to the outbox, the relay publishes them whenever RabbitMQ is up
+	db := store.NewFirestore(client)
+	conn := mq.NewConn(getEnv("ITAIC_RABBITMQ_URL", "amqp://176.24.0.9:5672"))
+	pub := mq.NewAMQP(conn)
+	go conn.Run()
+	go mq.NewRelay(db, pub, relayInterval).Run(ctx)
 
-	ch, err := conn.Channel()
+	blobs, err := blob.Open(*media)
 	if err != nil {
-		log.Fatal("[ ! ] Error opening a channel: ", err)
+		log.Fatal("[ ! ] Error setting up image storage: ", err)
 	}
 
-	q, err := ch.QueueDeclare(
-		"test", // name
-		false,  // durable
-		false,  // delete when unused
-		false,  // exclusive
-		false,  // no-wait
-		nil,    // arguments
-	)
-	if err != nil {
-		log.Fatal("[ ! ] Error declaring a queue: ", err)
-	}
+	tl := timeline.NewCache(getEnv("ITAIC_CACHE_API", "http://cache-api:5000"))
+	router := NewRouter(ctx, db, authn.NewFirebase(auth), tl, blobs)
+	router.HandleFunc(pat.Get("/health"), health.Handler(map[string]health.Check{"rabbitmq": conn.Health}))
+
+	// MQProducer()
+	fmt.Println("[ + ] API Started")
+	http.ListenAndServe(":8000", handlers.LoggingHandler(os.Stdout, router))
+}
 
+// NewRouter ... Registers every API route against the given backends
+func NewRouter(ctx context.Context, db store.Store, authClient authn.Client, tl timeline.Timeline, blobs blob.Store) *goji.Mux {
 	router := goji.NewMux()
+	router.Use(apierr.RequestID)
+	router.Use(authn.Authenticate(authClient))
+
+	// images kept on local disk are served by the API itself
+	if files, ok := blobs.(http.Handler); ok {
+		router.Handle(pat.Get(blob.MediaPath+"*"), http.StripPrefix(blob.MediaPath, files))
+	}
 
 	// post routes
-	router.HandleFunc(pat.Get("/posts"), pc.HandleGetPosts(ctx, client))
-	router.HandleFunc(pat.Post("/posts"), pc.HandleCreatePost(ctx, client, ch, q))
-	router.HandleFunc(pat.Get("/posts/:id"), pc.HandleGetPostByID(ctx, client))
-	router.HandleFunc(pat.Put("/posts/:id"), pc.HandleEditPost(ctx, client, ch, q))
-	router.HandleFunc(pat.Delete("/posts/:id/:uid"), pc.HandleDeletePost(ctx, client))
-	router.HandleFunc(pat.Put("/posts/like/:id/:uid"), pc.HandleLikePost(ctx, client, ch, q))
+	router.HandleFunc(pat.Get("/posts"), pc.HandleGetPosts(ctx, db))
+	router.HandleFunc(pat.Post("/posts"), authn.Require(pc.HandleCreatePost(ctx, db, db, blobs)))
+	router.HandleFunc(pat.Get("/posts/:id"), pc.HandleGetPostByID(ctx, db))
+	router.HandleFunc(pat.Put("/posts/:id"), authn.Require(pc.HandleEditPost(ctx, db, db)))
+	router.HandleFunc(pat.Delete("/posts/:id"), authn.Require(pc.HandleDeletePost(ctx, db, blobs)))
+	router.HandleFunc(pat.Get("/posts/:id/status"), pc.HandleGetPostStatus(ctx, db))
+	router.HandleFunc(pat.Put("/posts/:id/media"), authn.Require(pc.HandleEditMedia(ctx, db)))
+	router.HandleFunc(pat.Get("/posts/:id/comments"), cc.HandleGetComments(ctx, db, db))
+	router.HandleFunc(pat.Get("/posts/like/:id"), lc.HandleGetLikes(ctx, db, db, lc.PostTarget))
+	router.HandleFunc(pat.Put("/posts/like/:id"), authn.Require(lc.HandleLike(ctx, db, db, db, lc.PostTarget)))
+	router.HandleFunc(pat.Delete("/posts/like/:id"), authn.Require(lc.HandleUnlike(ctx, db, db, db, lc.PostTarget)))
+
+	// tag routes, trending first so it isn't taken for a tag
+	router.HandleFunc(pat.Get("/tags/trending"), pc.HandleGetTrendingTags(ctx, db))
+	router.HandleFunc(pat.Get("/tags/:tag"), pc.HandleGetTaggedPosts(ctx, db))
+
+	// feed routes
+	router.HandleFunc(pat.Get("/feed"), authn.Require(fc.HandleGetFeed(ctx, db, db, tl)))
 
 	// comment routes
-	router.HandleFunc(pat.Post("/comment/:id"), cc.HandleAddComment(ctx, client, ch, q))
-	router.HandleFunc(pat.Delete("/comment/:id/:comment"), cc.HandleDeleteComment(ctx, client, ch, q))
-	router.HandleFunc(pat.Put("/comment/:id/:comment"), cc.HandleEditComment(ctx, client, ch, q))
-	router.HandleFunc(pat.Put("/comment/like/:post_id/:id/:uid"), cc.HandleLikeComment(ctx, client, ch, q))
+	router.HandleFunc(pat.Post("/comment/:id"), authn.Require(cc.HandleAddComment(ctx, db, db)))
+	router.HandleFunc(pat.Delete("/comment/:id/:comment"), authn.Require(cc.HandleDeleteComment(ctx, db)))
+	router.HandleFunc(pat.Put("/comment/:id/:comment"), authn.Require(cc.HandleEditComment(ctx, db, db)))
+	router.HandleFunc(pat.Get("/comment/like/:post_id/:id"), lc.HandleGetLikes(ctx, db, db, lc.CommentTarget))
+	router.HandleFunc(pat.Put("/comment/like/:post_id/:id"), authn.Require(lc.HandleLike(ctx, db, db, db, lc.CommentTarget)))
+	router.HandleFunc(pat.Delete("/comment/like/:post_id/:id"), authn.Require(lc.HandleUnlike(ctx, db, db, db, lc.CommentTarget)))
 
 	// user routes
-	router.HandleFunc(pat.Get("/user/:uid"), uc.HandleGetUser(ctx, client))
-	router.HandleFunc(pat.Post("/user"), uc.HandleRegisterUser(ctx, client, auth))
-	router.HandleFunc(pat.Put("/user/:uid"), uc.HandleEditUser(ctx, client))
+	router.HandleFunc(pat.Get("/user/:uid"), uc.HandleGetUser(ctx, db))
+	router.HandleFunc(pat.Post("/user"), uc.HandleRegisterUser(ctx, db, authClient))
+	router.HandleFunc(pat.Put("/user/:uid"), authn.Require(uc.HandleEditUser(ctx, db)))
+	router.HandleFunc(pat.Patch("/user/:uid"), authn.Require(uc.HandleUpdateProfile(ctx, db, db, blobs)))
+	router.HandleFunc(pat.Delete("/user/:uid"), authn.Require(uc.HandleDeleteUser(ctx, db)))
+	router.HandleFunc(pat.Get("/user/:uid/deletion"), authn.Require(uc.HandleGetDeletion(ctx, db)))
+	router.HandleFunc(pat.Post("/user/:uid/export"), authn.Require(uc.HandleRequestExport(ctx, db)))
+	router.HandleFunc(pat.Get("/user/:uid/export"), authn.Require(uc.HandleGetExport(ctx, db)))
+	router.HandleFunc(pat.Get("/user/:uid/export/download"), uc.HandleDownloadExport(ctx, db, blobs))
+	router.HandleFunc(pat.Post("/user/:uid/follow"), authn.Require(uc.HandleFollow(ctx, db)))
+	router.HandleFunc(pat.Delete("/user/:uid/follow"), authn.Require(uc.HandleUnfollow(ctx, db)))
+	router.HandleFunc(pat.Get("/user/:uid/followers"), uc.HandleGetFollowers(ctx, db))
+	router.HandleFunc(pat.Get("/user/:uid/following"), uc.HandleGetFollowing(ctx, db))
 
-	// MQProducer()
-	fmt.Println("[ + ] API Started")
-	http.ListenAndServe(":8000", handlers.LoggingHandler(os.Stdout, router))
+	return router
+}
+
+// getEnv ... Returns the value of an environment variable or a fallback if it is unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
 }
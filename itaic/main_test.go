@@ -1,45 +1,1836 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	firebase "firebase.google.com/go"
-	"github.com/jmlattanzi/itaic-backend/itaic/pc"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
+	"github.com/jmlattanzi/itaic-backend/itaic/search"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/timeline"
+	"github.com/jmlattanzi/itaic-backend/itaic/worker"
 	"github.com/stretchr/testify/assert"
 	"goji.io"
 	"goji.io/pat"
-	"google.golang.org/api/option"
 )
 
-func Router() *goji.Mux {
-	ctx := context.Background()
-	sa := option.WithCredentialsFile("itaic-key.json")
-	app, err := firebase.NewApp(ctx, nil, sa)
+func Router() (*goji.Mux, *store.Memory) {
+	db := store.NewMemory()
+	return NewRouter(context.Background(), db, authn.NewMemory(), timeline.Cold{}, blobs()), db
+}
+
+// blobs ... The blob store tests keep uploaded images in
+func blobs() *blob.Local {
+	local, err := blob.NewLocal(mediaDir, "http://localhost:8000"+blob.MediaPath)
 	if err != nil {
-		log.Fatalln(err)
+		panic(err)
 	}
+	return local
+}
 
-	client, err := app.Firestore(ctx)
+// mediaDir ... Where tests keep uploaded images, removed once they've run
+var mediaDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "itaic-media")
 	if err != nil {
-		log.Fatalln(err)
+		panic(err)
+	}
+	mediaDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// relay ... Publishes everything waiting in the outbox and returns what was sent. Jobs are run as
+// they're published, like they are with -memory.
+func relay(db *store.Memory) []events.Event {
+	pub := mq.NewMemory()
+	jobs := map[string]worker.Job{
+		events.MediaRequested:    worker.New(db, blobs()),
+		events.DeletionRequested: worker.NewAccounts(db, authn.NewMemory(), blobs()),
+		events.ExportRequested:   worker.NewExports(db, blobs()),
 	}
-	defer client.Close()
+	mq.NewRelay(db, worker.NewInline(pub, jobs), time.Second).Flush(context.Background())
+	return pub.Events()
+}
 
-	router := goji.NewMux()
-	router.HandleFunc(pat.Get("/posts"), pc.HandleGetPosts(ctx, client))
-	return router
+func do(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	return doAs(router, "", method, path, body)
+}
+
+func doAs(router http.Handler, uid, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if uid != "" {
+		req.Header.Set("Authorization", "Bearer "+authn.Token(uid))
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
 }
 
 func TestHandleGetPosts(t *testing.T) {
 	fmt.Println("[ t ] Testing HandleGetPosts....")
+	router, _ := Router()
+	res := do(router, "GET", "/posts", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+}
+
+func TestRegisterAndEditUser(t *testing.T) {
+	fmt.Println("[ t ] Testing user routes....")
+	router, _ := Router()
+
+	res := do(router, "POST", "/user", `{"username": "test", "email": "test@gmail.com"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	user := models.User{}
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.NotEmpty(t, user.UID, "registered user should have a uid")
+
+	res = do(router, "PUT", "/user/"+user.UID, `{"bio": "new bio"}`)
+	assert.Equal(t, 401, res.Code, "editing a profile needs a token")
+
+	res = doAs(router, "someone-else", "PUT", "/user/"+user.UID, `{"bio": "new bio"}`)
+	assert.Equal(t, 403, res.Code, "only the owner can edit a profile")
+
+	res = doAs(router, user.UID, "PUT", "/user/"+user.UID, `{"bio": "new bio"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	res = do(router, "GET", "/user/"+user.UID, "")
+	fetched := models.User{}
+	json.NewDecoder(res.Body).Decode(&fetched)
+	assert.Equal(t, "new bio", fetched.Bio)
+	assert.Equal(t, "test", fetched.Username)
+}
+
+func TestRegisterOnlyAllowedFields(t *testing.T) {
+	fmt.Println("[ t ] Testing registration fields....")
+	router, _ := Router()
+
+	res := do(router, "POST", "/user", `{"username": "test", "email": "test@gmail.com", "Followers": ["someone"]}`)
+	assert.Equal(t, 400, res.Code, "only the allowed fields can be sent")
+
+	res = do(router, "POST", "/user", `{"username": "no spaces", "email": "test@gmail.com"}`)
+	assert.Equal(t, 400, res.Code, "usernames are checked")
+
+	res = do(router, "POST", "/user", `{"username": "test", "email": "test@gmail.com", "display_name": "Test User", "bio": "hi"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user := models.User{}
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.Equal(t, "Test User", user.DisplayName)
+	assert.Equal(t, "hi", user.Bio)
+	assert.Empty(t, user.Followers)
+
+	res = do(router, "POST", "/user", `{"username": "TEST", "email": "other@gmail.com"}`)
+	assert.Equal(t, 409, res.Code, "usernames are unique whatever their case")
+
+	// the email from the failed registration can still be used
+	res = do(router, "POST", "/user", `{"username": "other", "email": "other@gmail.com"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+}
+
+// patchProfile ... Sends a multipart profile update as uid with the given fields and picture
+func patchProfile(router http.Handler, uid string, fields map[string]string, picture []byte) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if picture != nil {
+		file, _ := form.CreateFormFile("profile_pic", "me.png")
+		file.Write(picture)
+	}
+	form.Close()
+
+	req, _ := http.NewRequest("PATCH", "/user/"+uid, body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+authn.Token(uid))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func TestUpdateProfile(t *testing.T) {
+	fmt.Println("[ t ] Testing profile updates....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: "uid", Username: "test", Caption: "test"})
+	res := doAs(router, "uid", "POST", "/comment/"+post.ID, `{"comment": "nice"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	relay(db)
+
+	res = doAs(router, "other", "PATCH", "/user/uid", `{"bio": "hacked"}`)
+	assert.Equal(t, 403, res.Code, "only the owner can edit a profile")
+
+	res = doAs(router, "uid", "PATCH", "/user/uid", `{"posts": []}`)
+	assert.Equal(t, 400, res.Code, "only profile fields can be changed")
+
+	res = doAs(router, "uid", "PATCH", "/user/uid", `{"bio": "`+strings.Repeat("a", 151)+`"}`)
+	assert.Equal(t, 400, res.Code, "bios have a limit")
+
+	res = doAs(router, "uid", "PATCH", "/user/uid", `{"username": "OTHER"}`)
+	assert.Equal(t, 409, res.Code, "a username that's taken can't be used")
+
+	res = doAs(router, "uid", "PATCH", "/user/uid", `{"display_name": "Test User", "username": "renamed"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user := models.User{}
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.Equal(t, "renamed", user.Username)
+	assert.Equal(t, "Test User", user.DisplayName)
+	assert.Equal(t, []string{post.ID}, user.Posts, "changing the profile keeps everything else")
+
+	stored, _ := db.GetPost(ctx, post.ID)
+	assert.Equal(t, "renamed", stored.Username, "the new username is shown on the user's posts")
+
+	res = do(router, "GET", "/posts/"+post.ID+"/comments", "")
+	page := struct {
+		Comments []models.Comment `json:"comments"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&page)
+	assert.Equal(t, 1, len(page.Comments))
+	assert.Equal(t, "renamed", page.Comments[0].Username, "the new username is shown on the user's comments")
+
+	sent := relay(db)
+	types := []string{}
+	for _, e := range sent {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{events.UserUpdated, events.UserUpdated, events.PostUpdated}, types)
+
+	// the old name is free again
+	res = doAs(router, "other", "PATCH", "/user/other", `{"username": "test"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	photo := &bytes.Buffer{}
+	png.Encode(photo, image.NewRGBA(image.Rect(0, 0, 600, 400)))
+	res = patchProfile(router, "uid", map[string]string{"bio": "new bio"}, photo.Bytes())
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user = models.User{}
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.Equal(t, "new bio", user.Bio)
+	assert.Equal(t, "renamed", user.Username, "fields that aren't sent are left alone")
+	assert.Regexp(t, `^http://localhost:8000/media/images/users/uid/[0-9a-f]{64}\.png$`, user.ProfilePic)
+
+	res = do(router, "GET", strings.TrimPrefix(user.ProfilePic, "http://localhost:8000"), "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	config, err := png.DecodeConfig(res.Body)
+	assert.Nil(t, err, "the stored picture should decode")
+	assert.Equal(t, 320, config.Width, "profile pictures are square")
+	assert.Equal(t, 320, config.Height, "profile pictures are square")
+
+	first := user.ProfilePic
+	photo = &bytes.Buffer{}
+	png.Encode(photo, image.NewGray(image.Rect(0, 0, 400, 400)))
+	res = patchProfile(router, "uid", map[string]string{"username": "test"}, photo.Bytes())
+	assert.Equal(t, 409, res.Code, "a username that's taken can't be used")
+	assert.Equal(t, []string{path.Base(first)}, pictures(t, "uid"), "the picture sent with a failed update isn't kept")
+
+	res = patchProfile(router, "uid", nil, photo.Bytes())
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user = models.User{}
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.NotEqual(t, first, user.ProfilePic, "a new picture gets a new URL")
+	assert.Equal(t, []string{path.Base(user.ProfilePic)}, pictures(t, "uid"), "the replaced picture is deleted")
+	res = do(router, "GET", strings.TrimPrefix(first, "http://localhost:8000"), "")
+	assert.Equal(t, 404, res.Code, "the replaced picture isn't served")
+
+	res = patchProfile(router, "uid", map[string]string{"username": "test"}, photo.Bytes())
+	assert.Equal(t, 409, res.Code, "a username that's taken can't be used")
+	res = patchProfile(router, "uid", nil, photo.Bytes())
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	assert.Equal(t, []string{path.Base(user.ProfilePic)}, pictures(t, "uid"), "sending the same picture again keeps it")
+
+	res = patchProfile(router, "uid", nil, []byte("not an image"))
+	assert.Equal(t, 400, res.Code, "profile pictures have to be images")
+
+	res = patchProfile(router, "uid", map[string]string{"email": "new@gmail.com"}, nil)
+	assert.Equal(t, 400, res.Code, "only profile fields can be changed")
+}
+
+// pictures ... The names of the profile pictures kept for uid
+func pictures(t *testing.T, uid string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(mediaDir, "images", "users", uid))
+	assert.Nil(t, err, "no error expected")
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+// racingUsers ... A store where something else changes the user just after a handler reads them
+type racingUsers struct {
+	*store.Memory
+	meanwhile func()
+}
+
+func (r *racingUsers) GetUser(ctx context.Context, uid string) (models.User, error) {
+	user, err := r.Memory.GetUser(ctx, uid)
+	r.meanwhile()
+	return user, err
+}
+
+func TestUpdateProfileKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewMemory()
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+
+	racing := &racingUsers{Memory: db, meanwhile: func() {}}
+	router := NewRouter(ctx, racing, authn.NewMemory(), timeline.Cold{}, blobs())
+	racing.meanwhile = func() {
+		db.Follow(ctx, "other", "uid")
+	}
+
+	res := patchProfile(router, "uid", map[string]string{"bio": "new bio", "display_name": "Test"}, nil)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user, _ := db.GetUser(ctx, "uid")
+	assert.Equal(t, "new bio", user.Bio)
+	assert.Equal(t, "Test", user.DisplayName)
+	assert.Equal(t, []string{"other"}, user.Followers, "a follow made while the profile was edited is kept")
+
+	res = doAs(router, "uid", "PUT", "/user/uid", `{"bio": "edited"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	user, _ = db.GetUser(ctx, "uid")
+	assert.Equal(t, "edited", user.Bio)
+	assert.Equal(t, []string{"other"}, user.Followers, "editing the bio keeps followers")
+}
+
+func TestCommentOnPost(t *testing.T) {
+	fmt.Println("[ t ] Testing comment routes....")
+	router, db := Router()
+	ctx := context.Background()
+
+	user, _ := db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: user.UID, Caption: "test"})
+
+	res := doAs(router, "uid", "POST", "/comment/"+post.ID, `{"comment": "nice"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	added := models.Comment{}
+	json.NewDecoder(res.Body).Decode(&added)
+	assert.NotEmpty(t, added.ID)
+	assert.Equal(t, post.ID, added.PostID)
+	assert.Equal(t, "test", added.Username)
+	assert.False(t, added.Created.IsZero(), "comment should have a creation time")
+
+	commentID := added.ID
+	res = doAs(router, "uid", "PUT", "/comment/"+post.ID+"/"+commentID, `{"comment": "nicer"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	edited := models.Comment{}
+	json.NewDecoder(res.Body).Decode(&edited)
+	assert.Equal(t, "nicer", edited.Comment)
+	assert.Equal(t, added.Created, edited.Created, "editing keeps the creation time")
+	assert.True(t, edited.UpdatedAt.After(added.UpdatedAt), "editing bumps the update time")
+	res = doAs(router, "uid", "PUT", "/comment/like/"+post.ID+"/"+commentID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	stored, _ := db.GetComment(ctx, post.ID, commentID)
+	assert.Equal(t, 1, stored.Likes)
+	storedPost, _ := db.GetPost(ctx, post.ID)
+	assert.Equal(t, 1, storedPost.CommentCount)
+
+	res = doAs(router, "someone-else", "DELETE", "/comment/"+post.ID+"/"+commentID, "")
+	assert.Equal(t, 403, res.Code, "only the author can delete a comment")
+
+	res = doAs(router, "uid", "DELETE", "/comment/"+post.ID+"/"+commentID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	storedPost, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, 0, storedPost.CommentCount)
+}
+
+func TestCommentThreads(t *testing.T) {
+	fmt.Println("[ t ] Testing comment threads....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: "uid", Caption: "test"})
+
+	add := func(body string) models.Comment {
+		res := doAs(router, "uid", "POST", "/comment/"+post.ID, body)
+		assert.Equal(t, 200, res.Code, "OK response expected")
+		comment := models.Comment{}
+		json.NewDecoder(res.Body).Decode(&comment)
+		return comment
+	}
+
+	top := []models.Comment{}
+	for i := 0; i < 3; i++ {
+		top = append(top, add(`{"comment": "top"}`))
+	}
+	reply := add(`{"comment": "reply", "parent_id": "` + top[0].ID + `"}`)
+	assert.Equal(t, top[0].ID, reply.ParentID)
+	nested := add(`{"comment": "reply to a reply", "parent_id": "` + reply.ID + `"}`)
+	assert.Equal(t, top[0].ID, nested.ParentID, "replies to replies join the thread")
+
+	res := doAs(router, "uid", "POST", "/comment/"+post.ID, `{"comment": "lost", "parent_id": "missing"}`)
+	assert.Equal(t, 404, res.Code, "Not found expected")
+
+	stored, _ := db.GetPost(ctx, post.ID)
+	assert.Equal(t, 5, stored.CommentCount)
+
+	type commentPage struct {
+		Comments   []models.Comment `json:"comments"`
+		NextCursor string           `json:"next_cursor"`
+	}
+	res = do(router, "GET", "/posts/"+post.ID+"/comments?limit=2", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	first := commentPage{}
+	json.NewDecoder(res.Body).Decode(&first)
+	assert.Len(t, first.Comments, 2)
+	assert.Equal(t, top[0].ID, first.Comments[0].ID, "oldest first")
+	assert.Equal(t, 2, first.Comments[0].ReplyCount)
+	assert.NotEmpty(t, first.NextCursor)
+
+	res = do(router, "GET", "/posts/"+post.ID+"/comments?limit=2&cursor="+first.NextCursor, "")
+	second := commentPage{}
+	json.NewDecoder(res.Body).Decode(&second)
+	assert.Len(t, second.Comments, 1, "replies aren't listed with the top level comments")
+	assert.Equal(t, top[2].ID, second.Comments[0].ID)
+	assert.Empty(t, second.NextCursor)
+
+	res = do(router, "GET", "/posts/"+post.ID+"/comments?parent_id="+top[0].ID, "")
+	replies := commentPage{}
+	json.NewDecoder(res.Body).Decode(&replies)
+	assert.Len(t, replies.Comments, 2)
+	assert.Equal(t, reply.ID, replies.Comments[0].ID)
+
+	res = doAs(router, "uid", "DELETE", "/comment/"+post.ID+"/"+reply.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	parent, _ := db.GetComment(ctx, post.ID, top[0].ID)
+	assert.Equal(t, 1, parent.ReplyCount)
+
+	res = doAs(router, "uid", "DELETE", "/comment/"+post.ID+"/"+top[0].ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	_, err := db.GetComment(ctx, post.ID, nested.ID)
+	assert.Equal(t, store.ErrNotFound, err, "deleting a comment deletes its replies")
+	stored, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, 2, stored.CommentCount)
+
+	res = doAs(router, "uid", "PUT", "/posts/"+post.ID, `{"caption": "edited"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	stored, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, 2, stored.CommentCount, "editing a post keeps its comment count")
+
+	res = do(router, "GET", "/posts/missing/comments", "")
+	assert.Equal(t, 404, res.Code, "Not found expected")
+}
+
+func TestErrorResponses(t *testing.T) {
+	fmt.Println("[ t ] Testing error responses....")
+	router, _ := Router()
+
+	cases := []struct {
+		uid, method, path, body string
+		status                  int
+		code                    string
+	}{
+		{"", "GET", "/posts/missing", "", 404, "not_found"},
+		{"", "GET", "/user/missing", "", 404, "not_found"},
+		{"", "POST", "/user", `{"username": "test"}`, 400, "validation"},
+		{"", "PUT", "/posts/missing", `{"caption": "new"}`, 401, "unauthorized"},
+		{"uid", "POST", "/comment/missing", `{"comment": "nice"}`, 404, "not_found"},
+		{"uid", "PUT", "/posts/missing", `{"caption": "new"}`, 404, "not_found"},
+		{"uid", "PUT", "/posts/missing", `not json`, 400, "validation"},
+	}
+
+	for _, c := range cases {
+		res := doAs(router, c.uid, c.method, c.path, c.body)
+		assert.Equal(t, c.status, res.Code, c.method+" "+c.path)
+
+		body := struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, c.code, body.Code, c.method+" "+c.path)
+		assert.NotEmpty(t, body.RequestID, c.method+" "+c.path)
+	}
+
+	res := do(router, "POST", "/user", `{"username": "test", "email": "test@gmail.com"}`)
+	assert.Equal(t, 200, res.Code)
+	res = do(router, "POST", "/user", `{"username": "test", "email": "test@gmail.com"}`)
+	assert.Equal(t, 409, res.Code, "registering an email twice should conflict")
+}
+
+func TestPostOwnership(t *testing.T) {
+	fmt.Println("[ t ] Testing post ownership....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "author", Username: "author"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: "author", Caption: "test"})
+
+	res := doAs(router, "other", "PUT", "/posts/"+post.ID, `{"caption": "mine now"}`)
+	assert.Equal(t, 403, res.Code, "only the author can edit a post")
+
+	res = doAs(router, "other", "DELETE", "/posts/"+post.ID, "")
+	assert.Equal(t, 403, res.Code, "only the author can delete a post")
+
+	res = doAs(router, "author", "PUT", "/posts/"+post.ID, `{"caption": "edited"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	res = doAs(router, "author", "DELETE", "/posts/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	types := []string{}
+	for _, e := range relay(db) {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{events.PostUpdated, events.PostDeleted}, types, "rejected changes shouldn't publish anything")
+
 	req, _ := http.NewRequest("GET", "/posts", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, 401, res.Code, "a bad token should be rejected")
+}
+
+func TestFollow(t *testing.T) {
+	fmt.Println("[ t ] Testing follow routes....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "star", Username: "star"})
+	for _, uid := range []string{"a", "b", "c"} {
+		db.CreateUser(ctx, models.User{UID: uid, Username: uid})
+		res := doAs(router, uid, "POST", "/user/star/follow", "")
+		assert.Equal(t, 200, res.Code, "OK response expected")
+	}
+
+	res := doAs(router, "a", "POST", "/user/star/follow", "")
+	assert.Equal(t, 200, res.Code, "following twice should be a no-op")
+	res = doAs(router, "a", "POST", "/user/a/follow", "")
+	assert.Equal(t, 400, res.Code, "can't follow yourself")
+	res = doAs(router, "a", "POST", "/user/nobody/follow", "")
+	assert.Equal(t, 404, res.Code, "can't follow a missing user")
+
+	type userPage struct {
+		Users      []models.UserSummary `json:"users"`
+		NextCursor string               `json:"next_cursor"`
+	}
+
+	first := userPage{}
+	res = do(router, "GET", "/user/star/followers?limit=2", "")
+	json.NewDecoder(res.Body).Decode(&first)
+	assert.Len(t, first.Users, 2)
+	assert.NotEmpty(t, first.NextCursor)
+
+	second := userPage{}
+	res = do(router, "GET", "/user/star/followers?limit=2&cursor="+first.NextCursor, "")
+	json.NewDecoder(res.Body).Decode(&second)
+	assert.Len(t, second.Users, 1)
+	assert.Empty(t, second.NextCursor)
+	assert.Equal(t, "c", second.Users[0].UID)
+
+	res = doAs(router, "b", "DELETE", "/user/star/follow", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	star, _ := db.GetUser(ctx, "star")
+	b, _ := db.GetUser(ctx, "b")
+	assert.Equal(t, []string{"a", "c"}, star.Followers)
+	assert.Empty(t, b.Following)
+
+	following := userPage{}
+	res = do(router, "GET", "/user/a/following", "")
+	json.NewDecoder(res.Body).Decode(&following)
+	assert.Equal(t, []models.UserSummary{{UID: "star", Username: "star"}}, following.Users)
+
+	sent := relay(db)
+	last := sent[len(sent)-1]
+	assert.Equal(t, events.UserUnfollowed, last.Type)
+	assert.Equal(t, "b", last.Actor)
+	assert.Equal(t, events.Version, last.Version)
+	assert.JSONEq(t, `{"follower": "b", "followee": "star"}`, string(last.Payload))
+}
+
+func TestFeed(t *testing.T) {
+	fmt.Println("[ t ] Testing feed....")
+	router, db := Router()
+	ctx := context.Background()
+
+	for _, uid := range []string{"reader", "followed", "stranger"} {
+		db.CreateUser(ctx, models.User{UID: uid, Username: uid})
+	}
+	db.Follow(ctx, "reader", "followed")
+
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		created := start.Add(time.Duration(i) * time.Minute)
+		db.CreatePost(ctx, models.Post{UID: "followed", Caption: fmt.Sprint(i), Created: created})
+		db.CreatePost(ctx, models.Post{UID: "stranger", Caption: "nope", Created: created})
+	}
+
+	type feedPage struct {
+		Posts      []models.Post `json:"posts"`
+		NextCursor string        `json:"next_cursor"`
+	}
+
+	first := feedPage{}
+	res := doAs(router, "reader", "GET", "/feed?limit=2", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	json.NewDecoder(res.Body).Decode(&first)
+	assert.Len(t, first.Posts, 2)
+	assert.Equal(t, "2", first.Posts[0].Caption, "newest post first")
+	assert.Equal(t, "1", first.Posts[1].Caption)
+
+	second := feedPage{}
+	res = doAs(router, "reader", "GET", "/feed?limit=2&cursor="+first.NextCursor, "")
+	json.NewDecoder(res.Body).Decode(&second)
+	assert.Len(t, second.Posts, 1)
+	assert.Equal(t, "0", second.Posts[0].Caption)
+	assert.Empty(t, second.NextCursor)
+
+	res = do(router, "GET", "/feed", "")
+	assert.Equal(t, 401, res.Code, "the feed needs a token")
+
+	// a cold feed only reads as many posts as a timeline holds
+	newest, err := db.ListPostsByUsers(ctx, []string{"followed", "stranger"}, 3)
+	assert.Nil(t, err)
+	assert.Len(t, newest, 3)
+	assert.Equal(t, start.Add(2*time.Minute), newest[0].Created, "newest post first")
+	assert.Equal(t, newest[0].Created, newest[1].Created)
+	assert.True(t, newest[0].ID > newest[1].ID, "ties are broken by id like other listings")
+	assert.Equal(t, start.Add(time.Minute), newest[2].Created)
+}
+
+func TestListPostsPaging(t *testing.T) {
+	fmt.Println("[ t ] Testing post paging....")
+	router, db := Router()
+	ctx := context.Background()
+
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		created := start.Add(time.Duration(i) * time.Minute)
+		db.CreatePost(ctx, models.Post{UID: "uid", Caption: fmt.Sprint(i), Created: created})
+	}
+
+	type postPage struct {
+		Posts      []models.Post `json:"posts"`
+		NextCursor string        `json:"next_cursor"`
+	}
+
+	captions := func(order string) []string {
+		result := []string{}
+		cursor := ""
+		for {
+			p := postPage{}
+			res := do(router, "GET", "/posts?limit=2&order="+order+"&cursor="+cursor, "")
+			assert.Equal(t, 200, res.Code, "OK response expected")
+			json.NewDecoder(res.Body).Decode(&p)
+			for _, post := range p.Posts {
+				result = append(result, post.Caption)
+			}
+			if p.NextCursor == "" {
+				return result
+			}
+			cursor = p.NextCursor
+		}
+	}
+
+	assert.Equal(t, []string{"4", "3", "2", "1", "0"}, captions(""))
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, captions("asc"))
+
+	res := do(router, "GET", "/posts?order=sideways", "")
+	assert.Equal(t, 400, res.Code, "bad order should be rejected")
+	res = do(router, "GET", "/posts?limit=1000", "")
+	assert.Equal(t, 400, res.Code, "limit over the max should be rejected")
+}
+
+func TestTimestampsAreRFC3339(t *testing.T) {
+	fmt.Println("[ t ] Testing timestamp format....")
+	router, db := Router()
+	ctx := context.Background()
+
+	created := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	post, _ := db.CreatePost(ctx, models.Post{UID: "uid", Caption: "test", Created: created, UpdatedAt: created})
+
+	res := do(router, "GET", "/posts/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	body := map[string]interface{}{}
+	json.NewDecoder(res.Body).Decode(&body)
+	assert.Equal(t, "2018-10-01T12:00:00Z", body["Created"])
+	assert.Equal(t, "2018-10-01T12:00:00Z", body["UpdatedAt"])
+}
+
+func TestOutbox(t *testing.T) {
+	fmt.Println("[ t ] Testing outbox relay....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: "uid", Caption: "test"})
+
+	res := doAs(router, "uid", "PUT", "/posts/like/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	res = doAs(router, "uid", "POST", "/comment/"+post.ID, `{"comment": "nice"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	sent := relay(db)
+	assert.Len(t, sent, 2)
+	assert.Equal(t, events.PostLiked, sent[0].Type)
+	assert.Equal(t, events.CommentAdded, sent[1].Type)
+
+	payload := events.Comment{}
+	sent[1].Decode(&payload)
+	assert.Equal(t, post.ID, payload.PostID)
+
+	assert.Empty(t, relay(db), "sent events shouldn't be published again")
+
+	user, _ := db.GetUser(ctx, "uid")
+	assert.Equal(t, []string{post.ID}, user.Posts, "creating a post adds it to the author")
+	assert.Equal(t, []string{post.ID}, user.Likes)
+}
+
+// failingPublisher ... Publisher that fails after accepting a number of events
+type failingPublisher struct {
+	accept int
+	sent   []events.Event
+}
+
+func (p *failingPublisher) Publish(e events.Event) error {
+	if len(p.sent) == p.accept {
+		return mq.ErrDisconnected
+	}
+	p.sent = append(p.sent, e)
+	return nil
+}
+
+func TestOutboxRetriesUnsent(t *testing.T) {
+	fmt.Println("[ t ] Testing outbox retries....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "a", Username: "a"})
+	db.CreateUser(ctx, models.User{UID: "b", Username: "b"})
+	doAs(router, "a", "POST", "/user/b/follow", "")
+	doAs(router, "a", "DELETE", "/user/b/follow", "")
+
+	pub := &failingPublisher{accept: 1}
+	sent, err := mq.NewRelay(db, pub, time.Second).Flush(ctx)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, mq.ErrDisconnected, err)
+
+	rest := relay(db)
+	assert.Len(t, rest, 1, "the event that failed should still be pending")
+	assert.Equal(t, events.UserUnfollowed, rest[0].Type)
+	assert.NotEqual(t, pub.sent[0].ID, rest[0].ID)
+}
+
+func TestLikes(t *testing.T) {
+	fmt.Println("[ t ] Testing likes....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "author", Username: "author"})
+	post, _ := db.CreatePost(ctx, models.Post{UID: "author", Caption: "test"})
+	db.AddComment(ctx, post.ID, models.Comment{ID: "c1", UID: "author"})
+	relay(db)
+
+	// everyone likes the post at once, twice each
+	uids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	done := make(chan bool)
+	for _, uid := range uids {
+		db.CreateUser(ctx, models.User{UID: uid, Username: uid})
+	}
+	for _, uid := range uids {
+		for i := 0; i < 2; i++ {
+			go func(uid string) {
+				res := doAs(router, uid, "PUT", "/posts/like/"+post.ID, "")
+				assert.Equal(t, 200, res.Code, "OK response expected")
+				done <- true
+			}(uid)
+		}
+	}
+	for range uids {
+		<-done
+		<-done
+	}
+
+	stored, _ := db.GetPost(ctx, post.ID)
+	assert.Equal(t, len(uids), stored.Likes, "liking twice counts once")
+	assert.Len(t, relay(db), len(uids), "only likes that change something send an event")
+
+	res := doAs(router, "a", "DELETE", "/posts/like/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	res = doAs(router, "a", "DELETE", "/posts/like/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "unliking twice is fine")
+
+	stored, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, len(uids)-1, stored.Likes)
+	user, _ := db.GetUser(ctx, "a")
+	assert.Empty(t, user.Likes)
+	sent := relay(db)
+	assert.Len(t, sent, 1)
+	assert.Equal(t, events.PostUnliked, sent[0].Type)
+
+	res = do(router, "GET", "/posts/like/"+post.ID+"?limit=5", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	liked := struct {
+		Users      []models.UserSummary `json:"users"`
+		NextCursor string               `json:"next_cursor"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&liked)
+	assert.Len(t, liked.Users, 5)
+	assert.NotEmpty(t, liked.NextCursor)
+
+	seen := map[string]bool{}
+	for _, u := range liked.Users {
+		seen[u.UID] = true
+	}
+	res = do(router, "GET", "/posts/like/"+post.ID+"?limit=5&cursor="+liked.NextCursor, "")
+	liked.NextCursor = ""
+	json.NewDecoder(res.Body).Decode(&liked)
+	assert.Len(t, liked.Users, 2)
+	assert.Empty(t, liked.NextCursor)
+	for _, u := range liked.Users {
+		assert.False(t, seen[u.UID], "pages shouldn't overlap")
+		seen[u.UID] = true
+	}
+	assert.False(t, seen["a"], "unliked users aren't listed")
+
+	// comments
+	res = doAs(router, "b", "PUT", "/comment/like/"+post.ID+"/c1", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	res = doAs(router, "b", "PUT", "/comment/like/"+post.ID+"/c1", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	comment := models.Comment{}
+	json.NewDecoder(res.Body).Decode(&comment)
+	assert.Equal(t, 1, comment.Likes)
+	stored, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, len(uids)-1, stored.Likes, "liking a comment leaves the post alone")
+
+	res = do(router, "GET", "/comment/like/"+post.ID+"/c1", "")
+	liked.Users = nil
+	json.NewDecoder(res.Body).Decode(&liked)
+	assert.Len(t, liked.Users, 1)
+	assert.Equal(t, "b", liked.Users[0].UID)
+
+	res = doAs(router, "b", "PUT", "/comment/like/"+post.ID+"/missing", "")
+	assert.Equal(t, 404, res.Code, "Not found expected")
+	res = doAs(router, "b", "PUT", "/posts/like/missing", "")
+	assert.Equal(t, 404, res.Code, "Not found expected")
+	res = do(router, "GET", "/posts/like/missing", "")
+	assert.Equal(t, 404, res.Code, "Not found expected")
+}
+
+func TestLegacyLikes(t *testing.T) {
+	fmt.Println("[ t ] Testing likes made before like documents....")
+	router, db := Router()
+	ctx := context.Background()
+
+	post, _ := db.CreatePost(ctx, models.Post{UID: "author", Caption: "test", Likes: 1})
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test", Likes: []string{post.ID}})
+
+	res := doAs(router, "uid", "PUT", "/posts/like/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	stored, _ := db.GetPost(ctx, post.ID)
+	assert.Equal(t, 1, stored.Likes, "an old like isn't counted again")
+
+	res = doAs(router, "uid", "DELETE", "/posts/like/"+post.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	stored, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, 0, stored.Likes, "an old like can be taken back")
+}
+
+// postImage ... Sends a new post with the given image as uid
+func postImage(router http.Handler, uid, filename string, data []byte) *httptest.ResponseRecorder {
+	return postImages(router, uid, [][]byte{data}, nil, filename)
+}
+
+// postImages ... Sends a new post with the given images and alt text as uid, all named filename
+func postImages(router http.Handler, uid string, images [][]byte, altTexts []string, filename string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("caption", "test")
+	for _, data := range images {
+		file, _ := form.CreateFormFile("image", filename)
+		file.Write(data)
+	}
+	for _, alt := range altTexts {
+		form.WriteField("alt_text", alt)
+	}
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/posts", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+authn.Token(uid))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+// processed ... Runs the media job for the post in a create response and gets the post once it's done
+func processed(db *store.Memory, res *httptest.ResponseRecorder) models.Post {
+	post := models.Post{}
+	json.NewDecoder(res.Body).Decode(&post)
+	relay(db)
+	post, _ = db.GetPost(context.Background(), post.ID)
+	return post
+}
+
+func TestUploadImage(t *testing.T) {
+	fmt.Println("[ t ] Testing image uploads....")
+	router, db := Router()
+	db.CreateUser(context.Background(), models.User{UID: "uid", Username: "test"})
+	db.CreateUser(context.Background(), models.User{UID: "other", Username: "other"})
+
+	img := &bytes.Buffer{}
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+
+	// the filename the client sends doesn't matter
+	res := postImage(router, "uid", "photo.jpg", img.Bytes())
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	first := processed(db, res)
+	assert.Equal(t, models.PostReady, first.Status)
+	assert.Regexp(t, `^http://localhost:8000/media/images/posts/`+first.ID+`/[0-9a-f]{64}\.png$`, first.ImageURL)
+
+	// someone else posting the same image can't delete the first one by deleting theirs
+	res = postImage(router, "other", "copy.png", img.Bytes())
+	second := processed(db, res)
+	assert.NotEqual(t, first.ImageURL, second.ImageURL, "each post keeps its own images")
+	res = doAs(router, "other", "DELETE", "/posts/"+second.ID, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	res = do(router, "GET", strings.TrimPrefix(second.ImageURL, "http://localhost:8000"), "")
+	assert.Equal(t, 404, res.Code, "the deleted post's images are gone")
+
+	path := strings.TrimPrefix(first.ImageURL, "http://localhost:8000")
+	res = do(router, "GET", path, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	assert.Equal(t, "image/png", res.Header().Get("Content-Type"), "images with transparency stay PNGs")
+	served, err := png.Decode(res.Body)
+	assert.Nil(t, err, "the stored image should decode")
+	assert.Equal(t, image.Rect(0, 0, 1, 1), served.Bounds(), "small images aren't made bigger")
+
+	res = do(router, "GET", "/media/images/", "")
+	assert.Equal(t, 404, res.Code, "directories aren't listed")
+	res = do(router, "GET", "/media/"+blob.OriginalKey(blob.PostOwner(first.ID), img.Bytes(), "image/png"), "")
+	assert.Equal(t, 404, res.Code, "originals aren't served")
+
+	res = postImage(router, "uid", "notes.png", []byte("definitely not an image"))
+	assert.Equal(t, 400, res.Code, "only images can be posted")
+
+	res = postImage(router, "uid", "huge.png", append(img.Bytes(), make([]byte, 10<<20)...))
+	assert.Equal(t, 400, res.Code, "images have a size limit")
+
+	wide := &bytes.Buffer{}
+	png.Encode(wide, image.NewGray(image.Rect(0, 0, 8001, 1)))
+	res = postImage(router, "uid", "wide.png", wide.Bytes())
+	assert.Equal(t, 400, res.Code, "images have a dimension limit")
+}
+
+func TestMediaTraversal(t *testing.T) {
+	router, _ := Router()
+	local := blobs()
+	ctx := context.Background()
+
+	owner := blob.PostOwner("traversal")
+	data := []byte("original with exif")
+	_, err := local.Put(ctx, blob.OriginalKey(owner, data, "image/jpeg"), "image/jpeg", bytes.NewReader(data))
+	assert.Nil(t, err, "no error expected")
+	_, err = local.Put(ctx, blob.ExportKey("uid", "token"), "application/zip", strings.NewReader("archive"))
+	assert.Nil(t, err, "no error expected")
+	key := blob.Key(owner, data, "image/jpeg")
+	_, err = local.Put(ctx, key, "image/jpeg", bytes.NewReader(data))
+	assert.Nil(t, err, "no error expected")
+
+	original := blob.OriginalKey(owner, data, "image/jpeg")
+	paths := []string{
+		"/media/images/../" + original,
+		"/media/images/%2e%2e/" + original,
+		"/media/images/posts/../../" + original,
+		"/media/images/../" + blob.ExportKey("uid", "token"),
+	}
+	for _, path := range paths {
+		res := do(router, "GET", path, "")
+		assert.Equal(t, 404, res.Code, path+" reaches outside images/")
+		assert.NotContains(t, res.Body.String(), "original with exif")
+	}
+
+	res := do(router, "GET", "/media/images/posts/../"+strings.TrimPrefix(key, "images/"), "")
+	assert.Equal(t, 200, res.Code, "paths that stay inside images/ are served")
+}
+
+// fakeS3 ... An S3 store that talks to a test server instead of AWS
+func fakeS3(handler http.HandlerFunc) (*blob.S3, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Region:           aws.String("us-west-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return blob.NewS3(sess, "bucket"), server
+}
+
+// s3Error ... Responds like S3 does when a request fails
+func s3Error(res http.ResponseWriter, status int, code string) {
+	res.Header().Set("Content-Type", "application/xml")
+	res.WriteHeader(status)
+	fmt.Fprintf(res, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func TestS3Get(t *testing.T) {
+	fmt.Println("[ t ] Testing reading files back from S3....")
+	ctx := context.Background()
+	s3, server := fakeS3(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/bucket/originals/there.png":
+			res.Write([]byte("image"))
+		case "/bucket/originals/private.png":
+			s3Error(res, 403, "AccessDenied")
+		default:
+			s3Error(res, 404, "NoSuchKey")
+		}
+	})
+	defer server.Close()
+
+	data, err := s3.Get(ctx, "originals/there.png")
+	assert.Nil(t, err)
+	assert.Equal(t, "image", string(data))
+
+	_, err = s3.Get(ctx, "originals/missing.png")
+	assert.Equal(t, blob.ErrNotFound, err, "a missing key is reported like every other store does")
+
+	_, err = s3.Get(ctx, "originals/private.png")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, blob.ErrNotFound, err, "other errors aren't mistaken for a missing file")
+
+	file, err := s3.Open(ctx, "originals/there.png")
+	assert.Nil(t, err)
+	data, err = ioutil.ReadAll(file)
+	file.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "image", string(data), "files can be streamed too")
+
+	_, err = s3.Open(ctx, "originals/missing.png")
+	assert.Equal(t, blob.ErrNotFound, err, "a missing key is reported the same when streaming")
+
+	_, err = s3.Open(ctx, "originals/private.png")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, blob.ErrNotFound, err, "other errors aren't mistaken for a missing file")
+}
+
+func TestS3Put(t *testing.T) {
+	fmt.Println("[ t ] Testing uploads to S3....")
+	ctx := context.Background()
+	acls := map[string]string{}
+	s3, server := fakeS3(func(res http.ResponseWriter, req *http.Request) {
+		acls[strings.TrimPrefix(req.URL.Path, "/bucket/")] = req.Header.Get("X-Amz-Acl")
+	})
+	defer server.Close()
+
+	original := blob.OriginalKey(blob.PostOwner("post"), []byte("upload"), "image/jpeg")
+	_, err := s3.Put(ctx, original, "image/jpeg", strings.NewReader("upload"))
+	assert.Nil(t, err)
+	assert.Equal(t, "private", acls[original], "originals keep their EXIF data, so they're private")
+
+	export := blob.ExportKey("uid", "token")
+	_, err = s3.Put(ctx, export, "application/zip", strings.NewReader("archive"))
+	assert.Nil(t, err)
+	assert.Equal(t, "private", acls[export], "exports are private")
+
+	img := blob.Key(blob.PostOwner("post"), []byte("image"), "image/jpeg")
+	_, err = s3.Put(ctx, img, "image/jpeg", strings.NewReader("image"))
+	assert.Nil(t, err)
+	assert.Empty(t, acls[img], "images are left to the bucket's policy")
+}
+
+func TestMediaJobs(t *testing.T) {
+	fmt.Println("[ t ] Testing media jobs....")
+	router, db := Router()
+	ctx := context.Background()
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	relay(db)
+
+	img := &bytes.Buffer{}
+	jpeg.Encode(img, image.NewGray(image.Rect(0, 0, 10, 10)), nil)
+	res := postImage(router, "uid", "photo.jpg", img.Bytes())
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	post := models.Post{}
+	json.NewDecoder(res.Body).Decode(&post)
+	assert.Equal(t, models.PostProcessing, post.Status, "posts are processing until the worker is done")
+	assert.Empty(t, post.ImageURL)
+
+	res = do(router, "GET", "/posts/"+post.ID+"/status", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	assert.JSONEq(t, `{"status": "processing"}`, res.Body.String())
+
+	res = do(router, "GET", "/posts", "")
+	assert.JSONEq(t, `{"posts": []}`, res.Body.String(), "posts aren't listed until they're ready")
+
+	// editing the caption meanwhile doesn't get in the way
+	res = doAs(router, "uid", "PUT", "/posts/"+post.ID, `{"caption": "edited"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+
+	types := []string{}
+	for _, e := range relay(db) {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{events.PostCreated, events.MediaRequested, events.PostUpdated, events.PostReady}, types)
+
+	res = do(router, "GET", "/posts/"+post.ID+"/status", "")
+	assert.JSONEq(t, `{"status": "ready"}`, res.Body.String())
+	post, _ = db.GetPost(ctx, post.ID)
+	assert.Equal(t, "edited", post.Caption)
+	assert.NotEmpty(t, post.Variants.Thumbnail.URL)
+
+	res = do(router, "GET", "/posts", "")
+	listed := struct{ Posts []models.Post }{}
+	json.NewDecoder(res.Body).Decode(&listed)
+	assert.Len(t, listed.Posts, 1, "ready posts are listed")
+
+	// an upload that looks like an image but can't be decoded fails with a reason
+	broken := &bytes.Buffer{}
+	png.Encode(broken, image.NewGray(image.Rect(0, 0, 10, 10)))
+	res = postImage(router, "uid", "broken.png", broken.Bytes()[:40])
+	assert.Equal(t, 202, res.Code, "the upload is only checked as far as its header")
+	json.NewDecoder(res.Body).Decode(&post)
+
+	sent := relay(db)
+	assert.Equal(t, events.PostUpdated, sent[len(sent)-1].Type, "failing a post updates it")
+	res = do(router, "GET", "/posts/"+post.ID+"/status", "")
+	assert.JSONEq(t, `{"status": "failed", "reason": "image must be a JPEG, PNG or GIF"}`, res.Body.String())
+
+	// a job delivered again is skipped
+	job, _ := events.New(events.MediaRequested, "uid", events.Media{PostID: post.ID, UID: "uid", Items: []events.MediaItem{
+		{ID: post.Media[0].ID, Key: blob.OriginalKey(blob.PostOwner(post.ID), img.Bytes(), "image/jpeg")},
+	}})
+	assert.Nil(t, worker.New(db, blobs()).Handle(ctx, job))
+	assert.Empty(t, relay(db), "a job for a post that's done changes nothing")
+	res = do(router, "GET", "/posts/"+post.ID+"/status", "")
+	assert.JSONEq(t, `{"status": "failed", "reason": "image must be a JPEG, PNG or GIF"}`, res.Body.String())
+
+	res = do(router, "GET", "/posts/missing/status", "")
+	assert.Equal(t, 404, res.Code, "Not Found response expected")
+}
+
+func TestCarousel(t *testing.T) {
+	fmt.Println("[ t ] Testing posts with several images....")
+	router, db := Router()
+	ctx := context.Background()
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+
+	// three images of different shapes so they can be told apart
+	images := [][]byte{}
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 30, 10), image.Rect(0, 0, 10, 20), image.Rect(0, 0, 40, 40)} {
+		img := &bytes.Buffer{}
+		jpeg.Encode(img, image.NewGray(size), nil)
+		images = append(images, img.Bytes())
+	}
+
+	res := postImages(router, "uid", images, []string{"wide", "tall"}, "photo.jpg")
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	post := processed(db, res)
+	assert.Equal(t, models.PostReady, post.Status)
+	assert.Len(t, post.Media, 3)
+	assert.Equal(t, []string{"wide", "tall", ""}, []string{post.Media[0].AltText, post.Media[1].AltText, post.Media[2].AltText}, "alt text goes with the image in the same position")
+	assert.Equal(t, []int{30, 10, 40}, []int{post.Media[0].Width, post.Media[1].Width, post.Media[2].Width}, "images keep the order they were sent in")
+	assert.Equal(t, post.Media[0].URL, post.ImageURL, "the first image is the cover")
+	assert.Equal(t, post.Media[0].Variants, post.Variants, "the first image is the cover")
+
+	// move the last image to the front and describe it
+	edit := fmt.Sprintf(`{"media": [{"id": %q, "alt_text": "square"}, {"id": %q, "alt_text": "wide"}, {"id": %q, "alt_text": "tall"}]}`,
+		post.Media[2].ID, post.Media[0].ID, post.Media[1].ID)
+	res = doAs(router, "other", "PUT", "/posts/"+post.ID+"/media", edit)
+	assert.Equal(t, 403, res.Code, "only the author can edit a post")
+	res = doAs(router, "uid", "PUT", "/posts/"+post.ID+"/media", edit)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	edited := models.Post{}
+	json.NewDecoder(res.Body).Decode(&edited)
+	assert.Equal(t, []models.MediaItem{
+		{ID: post.Media[2].ID, URL: post.Media[2].URL, Width: 40, Height: 40, Variants: post.Media[2].Variants, Placeholder: post.Media[2].Placeholder, AltText: "square"},
+		{ID: post.Media[0].ID, URL: post.Media[0].URL, Width: 30, Height: 10, Variants: post.Media[0].Variants, Placeholder: post.Media[0].Placeholder, AltText: "wide"},
+		{ID: post.Media[1].ID, URL: post.Media[1].URL, Width: 10, Height: 20, Variants: post.Media[1].Variants, Placeholder: post.Media[1].Placeholder, AltText: "tall"},
+	}, edited.Media)
+	assert.Equal(t, post.Media[2].URL, edited.ImageURL, "the cover follows the first image")
+	assert.Equal(t, 40, edited.Width, "the cover follows the first image")
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"media": [{"id": %q}, {"id": %q}]}`, post.Media[0].ID, post.Media[1].ID),
+		fmt.Sprintf(`{"media": [{"id": %q}, {"id": %q}, {"id": %q}]}`, post.Media[0].ID, post.Media[0].ID, post.Media[1].ID),
+		fmt.Sprintf(`{"media": [{"id": %q}, {"id": %q}, {"id": "nope"}]}`, post.Media[0].ID, post.Media[1].ID),
+		fmt.Sprintf(`{"media": [{"id": %q, "alt_text": %q}, {"id": %q}, {"id": %q}]}`, post.Media[0].ID, strings.Repeat("a", 1001), post.Media[1].ID, post.Media[2].ID),
+	} {
+		res = doAs(router, "uid", "PUT", "/posts/"+post.ID+"/media", body)
+		assert.Equal(t, 400, res.Code, "bad edit should be rejected: "+body[:40])
+	}
+
+	// editing the caption keeps the images as they are
+	res = doAs(router, "uid", "PUT", "/posts/"+post.ID, `{"caption": "new"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	stored, _ := db.GetPost(ctx, post.ID)
+	for i := range stored.Media {
+		assert.NotEmpty(t, stored.Media[i].Original, "the upload each image was made from is kept, but not sent to clients")
+		stored.Media[i].Original = ""
+	}
+	assert.Equal(t, edited.Media, stored.Media)
+
+	tooMany := [][]byte{}
+	for i := 0; i <= models.MaxMedia; i++ {
+		tooMany = append(tooMany, images[0])
+	}
+	res = postImages(router, "uid", tooMany, nil, "photo.jpg")
+	assert.Equal(t, 400, res.Code, "posts have an image limit")
+	res = postImages(router, "uid", images[:1], []string{"one", "two"}, "photo.jpg")
+	assert.Equal(t, 400, res.Code, "alt text has to go with an image")
+	res = postImages(router, "uid", [][]byte{images[0], []byte("not an image")}, nil, "photo.jpg")
+	assert.Equal(t, 400, res.Code, "every image is checked")
+	assert.Contains(t, res.Body.String(), "image 2: ", "the bad image is pointed out")
+}
+
+// withOrientation ... Adds an EXIF segment to a JPEG saying which way up it was taken
+func withOrientation(data []byte, orientation byte) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0, 0, 0, 0, 0}
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}, exif...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestImageVariants(t *testing.T) {
+	fmt.Println("[ t ] Testing image variants....")
+	router, db := Router()
+	db.CreateUser(context.Background(), models.User{UID: "uid", Username: "test"})
+
+	// a landscape photo taken with the camera turned on its side
+	photo := image.NewRGBA(image.Rect(0, 0, 1200, 800))
+	draw.Draw(photo, photo.Bounds(), image.NewUniform(color.RGBA{200, 100, 50, 255}), image.Point{}, draw.Src)
+	img := &bytes.Buffer{}
+	jpeg.Encode(img, photo, nil)
+
+	res := postImage(router, "uid", "photo.jpg", withOrientation(img.Bytes(), 6))
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	post := processed(db, res)
+
+	assert.Equal(t, models.ImageVariant{URL: post.ImageURL, Width: 800, Height: 1200}, post.Variants.Full, "the full image is turned the right way up")
+	assert.Equal(t, 800, post.Width, "the post has the full image's size")
+	assert.Equal(t, 1200, post.Height, "the post has the full image's size")
+	assert.Equal(t, 533, post.Variants.Feed.Width, "the feed image fits the feed")
+	assert.Equal(t, 800, post.Variants.Feed.Height, "the feed image fits the feed")
+	assert.Equal(t, 150, post.Variants.Thumbnail.Width, "thumbnails are square")
+	assert.Equal(t, 150, post.Variants.Thumbnail.Height, "thumbnails are square")
+	assert.Regexp(t, `^http://localhost:8000/media/images/posts/`+post.ID+`/[0-9a-f]{64}\.jpg$`, post.Variants.Thumbnail.URL)
+	assert.True(t, strings.HasPrefix(post.Placeholder, "data:image/jpeg;base64,"), "the placeholder is inline")
+
+	for _, v := range []models.ImageVariant{post.Variants.Thumbnail, post.Variants.Feed, post.Variants.Full} {
+		res = do(router, "GET", strings.TrimPrefix(v.URL, "http://localhost:8000"), "")
+		assert.Equal(t, 200, res.Code, "OK response expected")
+		assert.Equal(t, "image/jpeg", res.Header().Get("Content-Type"))
+		assert.False(t, bytes.Contains(res.Body.Bytes(), []byte("Exif")), "EXIF data is stripped")
+
+		config, err := jpeg.DecodeConfig(res.Body)
+		assert.Nil(t, err, "the stored image should decode")
+		assert.Equal(t, v.Width, config.Width, "the stored image has the size in the post")
+		assert.Equal(t, v.Height, config.Height, "the stored image has the size in the post")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	fmt.Println("[ t ] Testing account deletion....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+
+	img := &bytes.Buffer{}
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 20, 20)))
+	mine := processed(db, postImage(router, "uid", "photo.png", img.Bytes()))
+	theirs, _ := db.CreatePost(ctx, models.Post{UID: "other", Username: "other", Caption: "theirs", Created: time.Now().UTC()})
+	res := patchProfile(router, "uid", map[string]string{}, img.Bytes())
+	profile := models.User{}
+	json.NewDecoder(res.Body).Decode(&profile)
+	assert.NotEmpty(t, profile.ProfilePic)
+
+	// the user comments and likes on someone else's post, and they do the same back
+	res = doAs(router, "other", "POST", "/comment/"+theirs.ID, `{"comment": "first"}`)
+	theirComment := models.Comment{}
+	json.NewDecoder(res.Body).Decode(&theirComment)
+	doAs(router, "uid", "POST", "/comment/"+theirs.ID, `{"comment": "mine"}`)
+	doAs(router, "uid", "PUT", "/posts/like/"+theirs.ID, "")
+	doAs(router, "uid", "PUT", "/comment/like/"+theirs.ID+"/"+theirComment.ID, "")
+	doAs(router, "other", "POST", "/comment/"+mine.ID, `{"comment": "nice"}`)
+	doAs(router, "other", "PUT", "/posts/like/"+mine.ID, "")
+	doAs(router, "uid", "POST", "/user/other/follow", "")
+	doAs(router, "other", "POST", "/user/uid/follow", "")
+	relay(db)
+
+	res = doAs(router, "other", "DELETE", "/user/uid", "")
+	assert.Equal(t, 403, res.Code, "only the owner can delete an account")
+	res = doAs(router, "uid", "GET", "/user/uid/deletion", "")
+	assert.Equal(t, 404, res.Code, "nothing is being deleted yet")
+
+	res = doAs(router, "uid", "DELETE", "/user/uid", "")
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	status := struct {
+		Status   string `json:"status"`
+		Likes    int    `json:"likes"`
+		Comments int    `json:"comments"`
+		Posts    int    `json:"posts"`
+		Follows  int    `json:"follows"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(t, models.DeletionPending, status.Status)
+
+	sent := relay(db)
+	types := map[string]int{}
+	for _, e := range sent {
+		types[e.Type]++
+	}
+	assert.Equal(t, 1, types[events.UserDeleted], "the cache is told the user is gone")
+	assert.Equal(t, 1, types[events.PostDeleted], "the cache is told the post is gone")
+	assert.Equal(t, 2, types[events.UserUnfollowed])
+
+	res = doAs(router, "uid", "GET", "/user/uid/deletion", "")
+	assert.Equal(t, 200, res.Code, "the deletion can be seen once the user is gone")
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(t, models.DeletionDone, status.Status)
+	assert.Equal(t, 2, status.Likes)
+	assert.Equal(t, 1, status.Comments)
+	assert.Equal(t, 1, status.Posts)
+	assert.Equal(t, 2, status.Follows)
+
+	res = do(router, "GET", "/user/uid", "")
+	assert.Equal(t, 404, res.Code, "the user is gone")
+	res = do(router, "GET", "/posts/"+mine.ID, "")
+	assert.Equal(t, 404, res.Code, "their post is gone")
+	res = do(router, "GET", strings.TrimPrefix(mine.ImageURL, "http://localhost:8000"), "")
+	assert.Equal(t, 404, res.Code, "their images are gone")
+	res = do(router, "GET", strings.TrimPrefix(profile.ProfilePic, "http://localhost:8000"), "")
+	assert.Equal(t, 404, res.Code, "their profile picture is gone")
+
+	stored, _ := db.GetPost(ctx, theirs.ID)
+	assert.Equal(t, 0, stored.Likes, "their likes are taken off the counts")
+	assert.Equal(t, 1, stored.CommentCount, "their comments are taken off the counts")
+	comment, _ := db.GetComment(ctx, theirs.ID, theirComment.ID)
+	assert.Equal(t, 0, comment.Likes, "their likes are taken off the counts")
+	other, _ := db.GetUser(ctx, "other")
+	assert.Empty(t, other.Following, "follows go both ways")
+	assert.Empty(t, other.Followers, "follows go both ways")
+	likes, _ := db.UserLikes(ctx, "other", 0)
+	assert.Empty(t, likes, "likes on their post go with it")
+
+	res = doAs(router, "other", "PATCH", "/user/other", `{"username": "test"}`)
+	assert.Equal(t, 200, res.Code, "their username is free again")
+}
+
+// flakyBlobs ... Blob store that fails to delete anything until it's fixed
+type flakyBlobs struct {
+	*blob.Local
+	broken bool
+}
+
+func (f *flakyBlobs) Delete(ctx context.Context, key string) error {
+	if f.broken {
+		return fmt.Errorf("storage unavailable")
+	}
+	return f.Local.Delete(ctx, key)
+}
+
+func TestDeleteAccountResumes(t *testing.T) {
+	fmt.Println("[ t ] Testing account deletion resuming....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+	theirs, _ := db.CreatePost(ctx, models.Post{UID: "other", Caption: "theirs", Created: time.Now().UTC()})
+	doAs(router, "uid", "PUT", "/posts/like/"+theirs.ID, "")
+	mine, _ := db.CreatePost(ctx, models.Post{ID: "mine", UID: "uid", Caption: "mine", ImageURL: "http://localhost:8000/media/images/posts/mine/gone.jpg", Created: time.Now().UTC()})
+	relay(db)
+
+	e, _ := events.New(events.DeletionRequested, "uid", events.User{UID: "uid"})
+	_, err := db.RequestDeletion(ctx, "uid", e)
+	assert.Nil(t, err)
+
+	blobs := &flakyBlobs{Local: blobs(), broken: true}
+	accounts := worker.NewAccounts(db, authn.NewMemory(), blobs)
+	err = accounts.Handle(ctx, e)
+	assert.NotNil(t, err, "a deletion that can't finish should be tried again")
+
+	deletion, _ := db.GetDeletion(ctx, "uid")
+	assert.Equal(t, models.DeletionRunning, deletion.Status)
+	assert.Equal(t, models.DeletePosts, deletion.Step, "the deletion stops at the step that failed")
+	assert.Equal(t, 1, deletion.Likes, "the steps before it are done")
+	assert.NotEmpty(t, deletion.Error)
+	_, err = db.GetPost(ctx, mine.ID)
+	assert.Nil(t, err, "the post is still there")
+
+	blobs.broken = false
+	err = accounts.Handle(ctx, e)
+	assert.Nil(t, err)
+	deletion, _ = db.GetDeletion(ctx, "uid")
+	assert.Equal(t, models.DeletionDone, deletion.Status)
+	assert.Equal(t, 1, deletion.Likes, "finished steps aren't run again")
+	assert.Equal(t, 1, deletion.Posts)
+	assert.Empty(t, deletion.Error)
+	_, err = db.GetUser(ctx, "uid")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	// a job delivered again once it's done does nothing
+	assert.Nil(t, accounts.Handle(ctx, e))
+}
+
+// goneTargets ... A store where the posts in gone were deleted after the likes on them were
+// listed, leaving the likes behind the way Firestore does
+type goneTargets struct {
+	*store.Memory
+	gone map[string]bool
+}
+
+func (g *goneTargets) Unlike(ctx context.Context, uid string, target store.LikeTarget, outbox ...events.Event) (int, error) {
+	if g.gone[target.PostID] {
+		return 0, store.ErrNotFound
+	}
+	return g.Memory.Unlike(ctx, uid, target, outbox...)
+}
+
+func TestDeleteAccountClearsLikesOnDeletedTargets(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewMemory()
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+	theirs, _ := db.CreatePost(ctx, models.Post{UID: "other", Caption: "theirs", Created: time.Now().UTC()})
+	comment, _ := db.AddComment(ctx, theirs.ID, models.Comment{UID: "other", Comment: "first", Created: time.Now().UTC()})
+	db.Like(ctx, "uid", store.LikeTarget{PostID: theirs.ID})
+	db.Like(ctx, "uid", store.LikeTarget{PostID: theirs.ID, CommentID: comment.ID})
+
+	e, _ := events.New(events.DeletionRequested, "uid", events.User{UID: "uid"})
+	_, err := db.RequestDeletion(ctx, "uid", e)
+	assert.Nil(t, err)
+
+	accounts := worker.NewAccounts(&goneTargets{Memory: db, gone: map[string]bool{theirs.ID: true}}, authn.NewMemory(), blobs())
+	done := make(chan error, 1)
+	go func() {
+		done <- accounts.Handle(ctx, e)
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the deletion to finish when the liked post and comment are gone")
+	}
+
+	deletion, _ := db.GetDeletion(ctx, "uid")
+	assert.Equal(t, models.DeletionDone, deletion.Status)
+	assert.Equal(t, 2, deletion.Likes, "each like is counted once")
+	likes, _ := db.UserLikes(ctx, "uid", 0)
+	assert.Empty(t, likes, "likes left behind are deleted")
+}
+
+// exportStatus ... The parts of an export's status the tests look at
+type exportStatus struct {
+	Status      string `json:"status"`
+	DownloadURL string `json:"download_url"`
+}
+
+// readZip ... Reads every file in a zip archive into a map by name
+func readZip(data []byte) (map[string][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		files[file.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func TestExport(t *testing.T) {
+	fmt.Println("[ t ] Testing data exports....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "other"})
+
+	img := &bytes.Buffer{}
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 20, 20)))
+	mine := processed(db, postImage(router, "uid", "photo.png", img.Bytes()))
+	theirs, _ := db.CreatePost(ctx, models.Post{UID: "other", Username: "other", Caption: "theirs", Created: time.Now().UTC()})
+	doAs(router, "uid", "POST", "/comment/"+theirs.ID, `{"comment": "mine"}`)
+	doAs(router, "uid", "PUT", "/posts/like/"+theirs.ID, "")
+	doAs(router, "other", "POST", "/user/uid/follow", "")
+	relay(db)
+
+	res := doAs(router, "other", "POST", "/user/uid/export", "")
+	assert.Equal(t, 403, res.Code, "only the owner can export their data")
+	res = doAs(router, "uid", "GET", "/user/uid/export", "")
+	assert.Equal(t, 404, res.Code, "nothing has been exported yet")
+
+	res = doAs(router, "uid", "POST", "/user/uid/export", "")
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	status := exportStatus{}
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(t, models.ExportPending, status.Status)
+	assert.Empty(t, status.DownloadURL, "there's nothing to download until it's built")
+
+	relay(db)
+	res = doAs(router, "uid", "GET", "/user/uid/export", "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(t, models.ExportReady, status.Status)
+	assert.Regexp(t, `^/user/uid/export/download\?token=[0-9a-f]{32}$`, status.DownloadURL)
+
+	// the link works without signing in, so it can be opened in a browser
+	res = do(router, "GET", status.DownloadURL, "")
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	assert.Equal(t, "application/zip", res.Header().Get("Content-Type"))
+	files, err := readZip(res.Body.Bytes())
+	assert.Nil(t, err)
+
+	user := models.User{}
+	json.Unmarshal(files["profile.json"], &user)
+	assert.Equal(t, "test", user.Username)
+	posts := []models.Post{}
+	json.Unmarshal(files["posts.json"], &posts)
+	assert.Len(t, posts, 1)
+	comments := []models.Comment{}
+	json.Unmarshal(files["comments.json"], &comments)
+	assert.Len(t, comments, 1)
+	assert.Equal(t, "mine", comments[0].Comment)
+	likes := []models.Like{}
+	json.Unmarshal(files["likes.json"], &likes)
+	assert.Len(t, likes, 1)
+	assert.Equal(t, theirs.ID, likes[0].PostID)
+	followers := []models.UserSummary{}
+	json.Unmarshal(files["followers.json"], &followers)
+	assert.Equal(t, []models.UserSummary{{UID: "other", Username: "other"}}, followers)
+	assert.Equal(t, "[]\n", string(files["following.json"]))
+	assert.Equal(t, img.Bytes(), files["images/"+mine.ID+"/1.png"], "images are exported as they were uploaded")
+
+	res = do(router, "GET", "/user/uid/export/download?token=nope", "")
+	assert.Equal(t, 404, res.Code, "the token has to match")
+	res = do(router, "GET", "/user/other/export/download?token=", "")
+	assert.Equal(t, 404, res.Code, "nothing was exported")
+
+	// asking again replaces the archive, the old link stops working straight away
+	first, _ := db.GetExport(ctx, "uid")
+	res = doAs(router, "uid", "POST", "/user/uid/export", "")
+	assert.Equal(t, 202, res.Code, "Accepted response expected")
+	res = do(router, "GET", status.DownloadURL, "")
+	assert.Equal(t, 404, res.Code, "the old link is gone")
+	relay(db)
+	second, _ := db.GetExport(ctx, "uid")
+	assert.NotEqual(t, first.Key, second.Key)
+	_, err = blobs().Get(ctx, first.Key)
+	assert.Equal(t, blob.ErrNotFound, err, "the old archive is deleted")
+
+	res = doAs(router, "uid", "GET", "/user/uid/export", "")
+	json.NewDecoder(res.Body).Decode(&status)
+	res = do(router, "GET", status.DownloadURL, "")
+	assert.Equal(t, 200, res.Code, "the new link works")
+
+	second.Expires = time.Now().UTC().Add(-time.Minute)
+	db.UpdateExport(ctx, second)
+	res = do(router, "GET", status.DownloadURL, "")
+	assert.Equal(t, 404, res.Code, "the link expires")
+
+	// deleting the account takes the archive with it
+	doAs(router, "uid", "DELETE", "/user/uid", "")
+	relay(db)
+	_, err = blobs().Get(ctx, second.Key)
+	assert.Equal(t, blob.ErrNotFound, err, "the archive goes with the account")
+	_, err = db.GetExport(ctx, "uid")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+// postCaption ... Sends a new post with one image and the given caption as uid, and runs its
+// media job
+func postCaption(router http.Handler, db *store.Memory, uid, caption string) models.Post {
+	return processed(db, sendCaption(router, uid, caption))
+}
+
+// sendCaption ... Sends a new post with one image and the given caption as uid
+func sendCaption(router http.Handler, uid, caption string) *httptest.ResponseRecorder {
+	img := &bytes.Buffer{}
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("caption", caption)
+	file, _ := form.CreateFormFile("image", "photo.png")
+	file.Write(img.Bytes())
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/posts", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+authn.Token(uid))
 	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+// tagPage ... The ids of the posts in a page of a tag and the cursor for the next one
+func tagPage(router http.Handler, path string) ([]string, string) {
+	listed := struct {
+		Posts      []models.Post `json:"posts"`
+		NextCursor string        `json:"next_cursor"`
+	}{}
+	json.NewDecoder(do(router, "GET", path, "").Body).Decode(&listed)
+
+	ids := []string{}
+	for _, post := range listed.Posts {
+		ids = append(ids, post.ID)
+	}
+	return ids, listed.NextCursor
+}
+
+func TestHashtagsAndMentions(t *testing.T) {
+	fmt.Println("[ t ] Testing hashtags and mentions....")
+	router, db := Router()
+	ctx := context.Background()
+
+	db.CreateUser(ctx, models.User{UID: "uid", Username: "test"})
+	db.CreateUser(ctx, models.User{UID: "other", Username: "Other.One"})
+
+	first := postCaption(router, db, "uid", "Café at the #Beach with @other.one. #beach #sunset_2 me@test.com @nobody &#39; #123")
+	assert.Equal(t, []models.Entity{
+		{Type: models.EntityHashtag, Text: "beach", Start: 12, End: 18},
+		{Type: models.EntityMention, Text: "other.one", UID: "other", Start: 24, End: 34},
+		{Type: models.EntityHashtag, Text: "beach", Start: 36, End: 42},
+		{Type: models.EntityHashtag, Text: "sunset_2", Start: 43, End: 52},
+	}, first.Entities, "mentions of nobody, email addresses, entities and numbers aren't picked out")
+	second := postCaption(router, db, "other", "#BEACH day")
+	db.CreatePost(ctx, models.Post{
+		ID:       "old",
+		UID:      "other",
+		Caption:  "#beach #old",
+		Entities: []models.Entity{{Type: models.EntityHashtag, Text: "beach"}, {Type: models.EntityHashtag, Text: "old"}},
+		Created:  time.Now().UTC().Add(-72 * time.Hour),
+	})
+
+	ids, next := tagPage(router, "/tags/Beach?limit=2")
+	assert.Equal(t, []string{second.ID, first.ID}, ids, "tags are matched whatever their case, newest first")
+	ids, next = tagPage(router, "/tags/beach?limit=2&cursor="+next)
+	assert.Equal(t, []string{"old"}, ids)
+	assert.Empty(t, next)
+	ids, _ = tagPage(router, "/tags/sunset_2")
+	assert.Equal(t, []string{first.ID}, ids)
+
+	res := do(router, "GET", "/tags/123", "")
+	assert.Equal(t, 400, res.Code, "a tag needs a letter")
+	pending := models.Post{}
+	json.NewDecoder(sendCaption(router, "other", "#beach still processing").Body).Decode(&pending)
 
-	Router().ServeHTTP(res, req)
+	trending := struct {
+		Tags []struct {
+			Tag   string `json:"tag"`
+			Posts int    `json:"posts"`
+		} `json:"tags"`
+		Hours int `json:"hours"`
+	}{}
+	res = do(router, "GET", "/tags/trending", "")
 	assert.Equal(t, 200, res.Code, "OK response expected")
+	json.NewDecoder(res.Body).Decode(&trending)
+	assert.Equal(t, 24, trending.Hours)
+	assert.Len(t, trending.Tags, 2, "the old post is outside the window")
+	assert.Equal(t, "beach", trending.Tags[0].Tag)
+	assert.Equal(t, 2, trending.Tags[0].Posts, "a post counts once however many times it uses a tag, and not until it's ready")
+	assert.Equal(t, "sunset_2", trending.Tags[1].Tag)
+
+	more, _ := db.CreatePost(ctx, models.Post{
+		UID:      "other",
+		Caption:  "more #beach",
+		Entities: []models.Entity{{Type: models.EntityHashtag, Text: "beach"}},
+		Created:  time.Now().UTC(),
+	})
+	res = do(router, "GET", "/tags/trending?limit=1", "")
+	json.NewDecoder(res.Body).Decode(&trending)
+	assert.Len(t, trending.Tags, 1)
+	assert.Equal(t, 2, trending.Tags[0].Posts, "the counts for a window are reused for a while")
+
+	res = do(router, "GET", "/tags/trending?hours=96&limit=1", "")
+	json.NewDecoder(res.Body).Decode(&trending)
+	assert.Len(t, trending.Tags, 1)
+	assert.Equal(t, 4, trending.Tags[0].Posts, "a longer window takes in the old post, and the new one once it's counted again")
+	res = do(router, "GET", "/tags/trending?hours=0", "")
+	assert.Equal(t, 400, res.Code, "the window has to be at least an hour")
+	doAs(router, "other", "DELETE", "/posts/"+pending.ID, "")
+	doAs(router, "other", "DELETE", "/posts/"+more.ID, "")
+
+	// editing the caption takes the post off the tags it no longer has
+	res = doAs(router, "uid", "PUT", "/posts/"+first.ID, `{"caption": "just @test"}`)
+	assert.Equal(t, 200, res.Code, "OK response expected")
+	edited := models.Post{}
+	json.NewDecoder(res.Body).Decode(&edited)
+	assert.Equal(t, []models.Entity{{Type: models.EntityMention, Text: "test", UID: "uid", Start: 5, End: 10}}, edited.Entities)
+	ids, _ = tagPage(router, "/tags/sunset_2")
+	assert.Empty(t, ids)
+
+	doAs(router, "other", "DELETE", "/posts/"+second.ID, "")
+	ids, _ = tagPage(router, "/tags/beach")
+	assert.Equal(t, []string{"old"}, ids, "deleted posts are gone from their tags")
+
+	// comments have their entities picked out too
+	res = doAs(router, "other", "POST", "/comment/"+first.ID, `{"comment": "@TEST nice #shot"}`)
+	comment := models.Comment{}
+	json.NewDecoder(res.Body).Decode(&comment)
+	assert.Equal(t, []models.Entity{
+		{Type: models.EntityMention, Text: "TEST", UID: "uid", Start: 0, End: 5},
+		{Type: models.EntityHashtag, Text: "shot", Start: 11, End: 16},
+	}, comment.Entities)
+	res = doAs(router, "other", "PUT", "/comment/"+first.ID+"/"+comment.ID, `{"comment": "never mind"}`)
+	json.NewDecoder(res.Body).Decode(&comment)
+	assert.Empty(t, comment.Entities)
+}
+
+// searchFor ... What a search finds, as the values of field in each result, and the cursor for
+// the next page
+func searchFor(router http.Handler, path, field string) ([]interface{}, string) {
+	found := struct {
+		Results    []map[string]interface{} `json:"results"`
+		NextCursor string                   `json:"next_cursor"`
+	}{}
+	json.NewDecoder(do(router, "GET", path, "").Body).Decode(&found)
+
+	values := []interface{}{}
+	for _, result := range found.Results {
+		values = append(values, result[field])
+	}
+	return values, found.NextCursor
+}
+
+func TestSearch(t *testing.T) {
+	fmt.Println("[ t ] Testing search....")
+	router, db := Router()
+	ctx := context.Background()
+
+	// the search service's indexer takes the events the relay publishes
+	idx := search.New()
+	indexer := search.NewIndexer(idx, db, db)
+	router.HandleFunc(pat.Get("/search"), search.HandleSearch(ctx, idx))
+	index := func() {
+		for _, e := range relay(db) {
+			assert.NoError(t, indexer.Handle(ctx, e))
+		}
+	}
+
+	register := func(username, displayName string) string {
+		user := models.User{}
+		res := do(router, "POST", "/user", `{"username": "`+username+`", "email": "`+username+`@gmail.com", "display_name": "`+displayName+`"}`)
+		json.NewDecoder(res.Body).Decode(&user)
+		return user.UID
+	}
+	test := register("test", "Test Person")
+	other := register("other.one", "Beach Lover")
+	register("otter", "")
+
+	first := models.Post{}
+	json.NewDecoder(sendCaption(router, test, "Sunset at the #Beach").Body).Decode(&first)
+	second := models.Post{}
+	json.NewDecoder(sendCaption(router, other, "Surfing #beach #waves with @test").Body).Decode(&second)
+	index()
+
+	found, _ := searchFor(router, "/search?q=othe&type=users", "username")
+	assert.Equal(t, []interface{}{"other.one"}, found, "usernames are found by how they start")
+	found, _ = searchFor(router, "/search?q=@one&type=users", "username")
+	assert.Equal(t, []interface{}{"other.one"}, found, "and by the words between their dots")
+	found, _ = searchFor(router, "/search?q=beach&type=users", "username")
+	assert.Equal(t, []interface{}{"other.one"}, found, "and by display name")
+
+	found, _ = searchFor(router, "/search?q=BEACH", "id")
+	assert.Equal(t, []interface{}{second.ID, first.ID}, found, "posts that match as well are newest first")
+	found, _ = searchFor(router, "/search?q=sunset+bea&type=posts", "id")
+	assert.Equal(t, []interface{}{first.ID}, found, "posts have to match every word")
+	found, next := searchFor(router, "/search?q=beach&limit=1", "id")
+	assert.Equal(t, []interface{}{second.ID}, found)
+	found, next = searchFor(router, "/search?q=beach&limit=1&cursor="+next, "id")
+	assert.Equal(t, []interface{}{first.ID}, found)
+	assert.Empty(t, next)
+
+	found, _ = searchFor(router, "/search?q=%23b&type=tags", "posts")
+	assert.Equal(t, []interface{}{float64(2)}, found, "tags come with how many posts have them")
+	found, _ = searchFor(router, "/search?q=wav&type=tags", "tag")
+	assert.Equal(t, []interface{}{"waves"}, found)
+
+	// edits, renames and deletes are picked up from their events
+	doAs(router, other, "PUT", "/posts/"+second.ID, `{"caption": "no tags now"}`)
+	patchProfile(router, other, map[string]string{"username": "another"}, nil)
+	doAs(router, test, "DELETE", "/posts/"+first.ID, "")
+	index()
+
+	found, _ = searchFor(router, "/search?q=waves&type=tags", "tag")
+	assert.Empty(t, found, "tags no post has are gone")
+	found, _ = searchFor(router, "/search?q=beach", "id")
+	assert.Empty(t, found)
+	found, _ = searchFor(router, "/search?q=anoth", "id")
+	assert.Equal(t, []interface{}{second.ID}, found, "posts are found by their author's new username")
+	found, _ = searchFor(router, "/search?q=ot&type=users", "username")
+	assert.Equal(t, []interface{}{"otter"}, found)
+
+	res := do(router, "GET", "/search?q=%23", "")
+	assert.Equal(t, 400, res.Code, "a search needs a word")
+	res = do(router, "GET", "/search?q=beach&type=comments", "")
+	assert.Equal(t, 400, res.Code, "comments can't be searched")
+
+	// the index comes back the same from disk
+	path := mediaDir + "/search-index.json"
+	assert.NoError(t, idx.Save(path))
+	assert.False(t, idx.Unsaved())
+	loaded, err := search.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, idx.Search(search.TypeUser, "o"), loaded.Search(search.TypeUser, "o"))
+	assert.Equal(t, 1, loaded.Len(search.TypePost))
+
+	// searches only read the index, so they can run while it's changing
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			loaded.Put(search.Document{Type: search.TypePost, ID: fmt.Sprint("new", i), Text: fmt.Sprint("zebra", i)})
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		loaded.Search(search.TypePost, "zebra")
+	}
+	<-done
+	assert.Len(t, loaded.Search(search.TypePost, "zebra"), 100)
+	loaded.Delete(search.TypePost, "new0")
+	assert.Empty(t, loaded.Search(search.TypePost, "zebra0"), "words are taken out with the last document they're in")
+	assert.Len(t, loaded.Search(search.TypePost, "zebra1"), 11)
 }
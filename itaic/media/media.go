@@ -0,0 +1,243 @@
+// Package media turns uploaded images into the sizes posts are shown at. Uploads are decoded,
+// checked and re-encoded, which drops any EXIF data like GPS location along the way.
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// registers the GIF decoder, GIFs are stored as their first frame
+	_ "image/gif"
+)
+
+// Limits on the images that can be uploaded, checked before the pixels are decoded
+const (
+	MaxDimension = 8000
+	MaxPixels    = 40000000
+)
+
+// jpegQuality ... Quality variants are encoded at
+const jpegQuality = 85
+
+// ErrUnsupported ... Returned for anything that isn't a JPEG, PNG or GIF that can be decoded
+var ErrUnsupported = errors.New("image must be a JPEG, PNG or GIF")
+
+// ErrTooLarge ... Returned for images over MaxDimension on a side or MaxPixels in total
+var ErrTooLarge = fmt.Errorf("images can be at most %dx%d pixels", MaxDimension, MaxDimension)
+
+// Size ... A size images are made in. The image is scaled to fit inside Width by Height without
+// being made bigger, or scaled and cropped to fill it exactly if Crop is set.
+type Size struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}
+
+// Sizes every upload is made in
+var (
+	Thumbnail = Size{Name: "thumbnail", Width: 150, Height: 150, Crop: true}
+	Feed      = Size{Name: "feed", Width: 640, Height: 800}
+	Full      = Size{Name: "full", Width: 1080, Height: 1350}
+)
+
+// Avatar ... Size profile pictures are made in
+var Avatar = Size{Name: "avatar", Width: 320, Height: 320, Crop: true}
+
+// placeholder ... Size of the image sent inline to show, blurred, while the real one loads
+var placeholder = Size{Name: "placeholder", Width: 16, Height: 16}
+
+// Variant ... An image encoded at one of the Sizes
+type Variant struct {
+	Size        Size
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Processed ... What Process makes out of an upload
+type Processed struct {
+	Thumbnail Variant
+	Feed      Variant
+	Full      Variant
+	// Placeholder ... A tiny version of the image as a data URI
+	Placeholder string
+}
+
+// Check ... Reads just enough of an upload to tell whether it's an image Process can take,
+// without decoding it, and returns its content type
+func Check(data []byte) (string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrUnsupported
+	}
+	if config.Width > MaxDimension || config.Height > MaxDimension || config.Width*config.Height > MaxPixels {
+		return "", ErrTooLarge
+	}
+	return "image/" + format, nil
+}
+
+// Process ... Decodes an upload, turns it the right way up and encodes it at every size.
+// Images with transparency stay PNGs, everything else becomes a JPEG.
+func Process(data []byte) (Processed, error) {
+	processed := Processed{}
+
+	img, err := decode(data)
+	if err != nil {
+		return processed, err
+	}
+	opaque := img.Opaque()
+
+	for _, v := range []struct {
+		size Size
+		into *Variant
+	}{{Thumbnail, &processed.Thumbnail}, {Feed, &processed.Feed}, {Full, &processed.Full}} {
+		*v.into, err = encode(resize(img, v.size), v.size, opaque)
+		if err != nil {
+			return processed, err
+		}
+	}
+
+	tiny, err := encode(resize(img, placeholder), placeholder, opaque)
+	if err != nil {
+		return processed, err
+	}
+	processed.Placeholder = "data:" + tiny.ContentType + ";base64," + base64.StdEncoding.EncodeToString(tiny.Data)
+	return processed, nil
+}
+
+// ProcessAvatar ... Decodes an upload, turns it the right way up and encodes it as a profile picture
+func ProcessAvatar(data []byte) (Variant, error) {
+	img, err := decode(data)
+	if err != nil {
+		return Variant{}, err
+	}
+	return encode(resize(img, Avatar), Avatar, img.Opaque())
+}
+
+// decode ... Checks and decodes an upload, turning JPEGs the right way up
+func decode(data []byte) (*image.RGBA, error) {
+	contentType, err := Check(data)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	img := toRGBA(decoded)
+	if contentType == "image/jpeg" {
+		img = orient(img, orientation(data))
+	}
+	return img, nil
+}
+
+// encode ... Encodes img as a JPEG, or a PNG if it isn't opaque
+func encode(img *image.RGBA, size Size, opaque bool) (Variant, error) {
+	v := Variant{Size: size, Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	out := &bytes.Buffer{}
+
+	var err error
+	if opaque {
+		v.ContentType = "image/jpeg"
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		v.ContentType = "image/png"
+		err = png.Encode(out, img)
+	}
+	v.Data = out.Bytes()
+	return v, err
+}
+
+// toRGBA ... Copies any image into an RGBA one starting at 0,0
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resize ... Scales img for size, cropping the middle out first if size is cropped
+func resize(img *image.RGBA, size Size) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if size.Crop {
+		// keep the largest part of the middle with the size's aspect ratio
+		cw, ch := w, w*size.Height/size.Width
+		if ch > h {
+			cw, ch = h*size.Width/size.Height, h
+		}
+		x, y := (w-cw)/2, (h-ch)/2
+		img = img.SubImage(image.Rect(x, y, x+cw, y+ch)).(*image.RGBA)
+		w, h = cw, ch
+	}
+
+	// fit inside the size without making it bigger
+	dw, dh := w, h
+	if dw > size.Width {
+		dw, dh = size.Width, h*size.Width/w
+	}
+	if dh > size.Height {
+		dw, dh = w*size.Height/h, size.Height
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return scale(img, dw, dh)
+}
+
+// scale ... Shrinks img to w by h, averaging the pixels that fall into each new one
+func scale(img *image.RGBA, w, h int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := span(y, h, sh)
+		for x := 0; x < w; x++ {
+			x0, x1 := span(x, w, sw)
+
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := img.PixOffset(b.Min.X+x0, b.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(img.Pix[i])
+					g += int(img.Pix[i+1])
+					bl += int(img.Pix[i+2])
+					a += int(img.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(bl / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// span ... The source pixels that shrink into pixel i of n, out of total, always at least one
+func span(i, n, total int) (int, int) {
+	start, end := i*total/n, (i+1)*total/n
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
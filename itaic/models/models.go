@@ -1,23 +1,57 @@
 package models
 
+import "time"
+
 // post json
 // {
 //     "id": "369",
 //     "uid": "test",
 //     "username": "new post",
-//     "caption": "new post",
+//     "caption": "new post #beach with @test",
+//     "entities": [
+//         {"type": "hashtag", "text": "beach", "uid": "", "start": 9, "end": 15},
+//         {"type": "mention", "text": "test", "uid": "test", "start": 21, "end": 26}
+//     ],
 //     "image": "test",
-//     "likes": 0,
-//     "created": "test",
-//     "comments": [
+//     "width": 1080,
+//     "height": 1350,
+//     "variants": {
+//         "thumbnail": {"url": "test", "width": 150, "height": 150},
+//         "feed": {"url": "test", "width": 640, "height": 800},
+//         "full": {"url": "test", "width": 1080, "height": 1350}
+//     },
+//     "placeholder": "data:image/jpeg;base64,...",
+//     "media": [
 //         {
-//             "id": "test",
-//             "uid": "test",
-//             "comment": "test",
-//             "time": "test",
-//             "likes": 0
+//             "id": "a1b2c3d4",
+//             "url": "test",
+//             "width": 1080,
+//             "height": 1350,
+//             "variants": {...},
+//             "placeholder": "data:image/jpeg;base64,...",
+//             "alt_text": "a dog on a beach"
 //         }
-//     ]
+//     ],
+//     "status": "ready",
+//     "status_reason": "",
+//     "likes": 0,
+//     "comment_count": 1,
+//     "created": "2018-10-01T12:00:00Z",
+//     "updated_at": "2018-10-01T12:00:00Z"
+// }
+
+// comment json, stored in posts/{id}/comments
+// {
+//     "id": "test",
+//     "post_id": "369",
+//     "parent_id": "",
+//     "uid": "test",
+//     "comment": "test",
+//     "entities": [],
+//     "likes": 0,
+//     "reply_count": 0,
+//     "created": "2018-10-01T12:00:00Z",
+//     "updated_at": "2018-10-01T12:00:00Z"
 // }
 
 // user json
@@ -35,26 +69,138 @@ package models
 // 	"followers": ["test"]
 // }
 
-// Comment ... Defines the structure of a comment in the post
+// Comment ... Defines the structure of a comment, kept in the comments subcollection of its post
 type Comment struct {
+	ID     string `firestore:"id"`
+	PostID string `firestore:"post_id"`
+	// ParentID ... The comment this replies to, empty for a top level comment
+	ParentID   string `firestore:"parent_id"`
+	UID        string `firestore:"uid"`
+	Comment    string `firestore:"comment"`
+	Likes      int    `firestore:"likes"`
+	ReplyCount int    `firestore:"reply_count"`
+	Username   string `firestore:"username"`
+	// Entities ... The hashtags and mentions in the comment
+	Entities []Entity `firestore:"entities"`
+	// Created and UpdatedAt are Firestore timestamps and RFC3339 in JSON
+	Created   time.Time `firestore:"created"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+}
+
+// Post statuses. A post is created processing while its image is made into every size, then
+// becomes ready, or failed if the image couldn't be processed. Posts from before images were
+// processed have no status and are ready.
+const (
+	PostProcessing = "processing"
+	PostReady      = "ready"
+	PostFailed     = "failed"
+)
+
+// Post ... Defines the structure of our post in firestore
+type Post struct {
 	ID       string `firestore:"id"`
 	UID      string `firestore:"uid"`
-	Comment  string `firestore:"comment"`
-	Created  string `firestore:"created"`
-	Likes    int    `firestore:"likes"`
 	Username string `firestore:"username"`
+	Caption  string `firestore:"caption"`
+	// Entities ... The hashtags and mentions in the caption
+	Entities []Entity `firestore:"entities"`
+	// ImageURL, Width, Height, Variants and Placeholder ... The cover, the first of Media, for
+	// clients that only show one image
+	ImageURL    string        `firestore:"imageURL"`
+	Width       int           `firestore:"width"`
+	Height      int           `firestore:"height"`
+	Variants    ImageVariants `firestore:"variants"`
+	Placeholder string        `firestore:"placeholder"`
+	// Media ... Every image on the post in the order they're shown, up to MaxMedia
+	Media []MediaItem `firestore:"media"`
+	// Status ... Whether the images are still being processed, see PostProcessing
+	Status string `firestore:"status"`
+	// StatusReason ... Why processing the images failed
+	StatusReason string `firestore:"status_reason"`
+	Likes        int    `firestore:"likes"`
+	// CommentCount ... How many comments and replies the post has
+	CommentCount int `firestore:"comment_count"`
+	// Created and UpdatedAt are Firestore timestamps and RFC3339 in JSON
+	Created   time.Time `firestore:"created"`
+	UpdatedAt time.Time `firestore:"updated_at"`
 }
 
-// Post ... Defines the structure of our post in firestore
-type Post struct {
-	ID       string    `firestore:"id"`
-	UID      string    `firestore:"uid"`
-	Username string    `firestore:"username"`
-	Caption  string    `firestore:"caption"`
-	ImageURL string    `firestore:"imageURL"`
-	Likes    int       `firestore:"likes"`
-	Created  string    `firestore:"created"`
-	Comments []Comment `firestore:"comments"`
+// Ready ... Whether the post's images have been processed and it can be shown
+func (p Post) Ready() bool {
+	return p.Status == "" || p.Status == PostReady
+}
+
+// Entity types
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+)
+
+// Entity ... A hashtag or mention in a caption or comment. Start and End count characters, not
+// bytes, from the start of the text to the # or @ and to just past the end.
+type Entity struct {
+	Type string `firestore:"type"`
+	// Text ... The hashtag in lower case, or the username as it was written, without the # or @
+	Text string `firestore:"text"`
+	// UID ... Who a mention is of
+	UID   string `firestore:"uid"`
+	Start int    `firestore:"start"`
+	End   int    `firestore:"end"`
+}
+
+// Hashtags ... Each hashtag in the caption once, in the order they first appear
+func (p Post) Hashtags() []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, e := range p.Entities {
+		if e.Type == EntityHashtag && !seen[e.Text] {
+			seen[e.Text] = true
+			tags = append(tags, e.Text)
+		}
+	}
+	return tags
+}
+
+// MaxMedia ... How many images a post can have
+const MaxMedia = 10
+
+// MediaItem ... One of the images on a post. The id stays with the image when the post's images
+// are reordered.
+type MediaItem struct {
+	ID string `firestore:"id"`
+	// URL, Width and Height ... The full size image, the same as Variants.Full
+	URL      string        `firestore:"url"`
+	Width    int           `firestore:"width"`
+	Height   int           `firestore:"height"`
+	Variants ImageVariants `firestore:"variants"`
+	// Placeholder ... A tiny version of the image as a data URI, to show blurred while it loads
+	Placeholder string `firestore:"placeholder"`
+	// AltText ... Describes the image for people who can't see it
+	AltText string `firestore:"alt_text"`
+	// Original ... Key of the upload the image was made from, which is private
+	Original string `firestore:"original" json:"-"`
+}
+
+// ImageVariant ... A post's image at one size
+type ImageVariant struct {
+	URL    string `firestore:"url"`
+	Width  int    `firestore:"width"`
+	Height int    `firestore:"height"`
+}
+
+// ImageVariants ... The sizes a post's image is stored at, so clients can pick the one they need
+type ImageVariants struct {
+	Thumbnail ImageVariant `firestore:"thumbnail"`
+	Feed      ImageVariant `firestore:"feed"`
+	Full      ImageVariant `firestore:"full"`
+}
+
+// Like ... One user's like of a post, or of a comment on it when CommentID is set
+type Like struct {
+	UID       string    `firestore:"uid"`
+	PostID    string    `firestore:"post_id"`
+	CommentID string    `firestore:"comment_id"`
+	Created   time.Time `firestore:"created"`
 }
 
 // User ... Defines what will be stored in the user object
@@ -62,6 +208,7 @@ type User struct {
 	UID          string   `firestore:"uid"`
 	ID           string   `firestore:"id"`
 	Username     string   `firestore:"username"`
+	DisplayName  string   `firestore:"display_name"`
 	Email        string   `firestore:"email"`
 	Bio          string   `firestore:"bio"`
 	ProfilePic   string   `firestore:"profile_pic"`
@@ -72,9 +219,84 @@ type User struct {
 	Followers    []string `firestore:"followers"`
 }
 
+// UserSummary ... The public parts of a user shown in lists like followers
+type UserSummary struct {
+	UID         string `firestore:"uid"`
+	Username    string `firestore:"username"`
+	DisplayName string `firestore:"display_name"`
+	ProfilePic  string `firestore:"profile_pic"`
+}
+
+// Summary ... Gets the summary of a user
+func (u User) Summary() UserSummary {
+	return UserSummary{UID: u.UID, Username: u.Username, DisplayName: u.DisplayName, ProfilePic: u.ProfilePic}
+}
+
+// Steps an account is deleted in, in order. Each one can be run again if it was interrupted.
+const (
+	DeleteAuth     = "auth"
+	DeleteLikes    = "likes"
+	DeleteComments = "comments"
+	DeletePosts    = "posts"
+	DeleteFollows  = "follows"
+	DeleteProfile  = "profile"
+)
+
+// Deletion statuses. A deletion that fails part way stays running and is tried again.
+const (
+	DeletionPending = "pending"
+	DeletionRunning = "running"
+	DeletionDone    = "done"
+)
+
+// Deletion ... The progress of deleting a user's account, kept once the user is gone so they can
+// see it finished
+type Deletion struct {
+	UID    string `firestore:"uid"`
+	Status string `firestore:"status"`
+	// Step ... The step being run, empty once the deletion is done
+	Step string `firestore:"step"`
+	// Likes, Comments, Posts and Follows ... How many of each have been deleted so far
+	Likes    int `firestore:"likes"`
+	Comments int `firestore:"comments"`
+	Posts    int `firestore:"posts"`
+	Follows  int `firestore:"follows"`
+	// Error ... Why the last try stopped, empty if it hasn't failed
+	Error     string    `firestore:"error"`
+	Requested time.Time `firestore:"requested"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+}
+
+// Export statuses
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export ... A copy of everything a user has put on the API, built in the background for them to
+// download
+type Export struct {
+	UID    string `firestore:"uid"`
+	Status string `firestore:"status"`
+	// Key ... Where the archive is kept in blob storage, the last one built until a new one is ready
+	Key string `firestore:"key"`
+	// Token ... The secret in the download link, empty until the archive is ready
+	Token string `firestore:"token"`
+	// Error ... Why the archive couldn't be built, if it failed
+	Error     string    `firestore:"error"`
+	Requested time.Time `firestore:"requested"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+	// Expires ... When the download link stops working
+	Expires time.Time `firestore:"expires"`
+}
+
 // Config ... Defines the shape of our config
 type Config struct {
 	S3AccessKey       string `json:"S3_ACCESS_KEY"`
 	S3SecretAccessKey string `json:"S3_SECRET_ACCESS_KEY"`
 	S3Bucket          string `json:"S3_BUCKET"`
+	// S3Region ... Region the bucket is in, us-west-1 if it's not set
+	S3Region string `json:"S3_REGION"`
 }
@@ -0,0 +1,71 @@
+package mq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/streadway/amqp"
+)
+
+// requeueDelay ... How long a consumer waits before handing back a message it couldn't handle,
+// so a message that keeps failing doesn't spin
+const requeueDelay = 5 * time.Second
+
+// Consume ... Has queue receive the events routed by any of keys and calls handle with each one,
+// one at a time, every time conn connects. A message is acked once handle returns nil and put
+// back on the queue if it returns an error. Messages that aren't events are dropped.
+func Consume(conn *Conn, queue string, keys []string, handle func(e events.Event) error) {
+	conn.OnConnect(func(ch *amqp.Channel) error {
+		err := ch.ExchangeDeclare(events.Exchange, "topic", true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = ch.QueueDeclare(queue, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = ch.QueueBind(queue, key, events.Exchange, false, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = ch.Qos(1, 0, false)
+		if err != nil {
+			return err
+		}
+
+		msgs, err := ch.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		// msgs is closed when the channel goes, which ends the loop
+		go func() {
+			for d := range msgs {
+				e, err := events.Parse(d.Body)
+				if err != nil {
+					fmt.Println("[ ! ] Dropping unreadable message "+d.MessageId+": ", err)
+					d.Nack(false, false)
+					continue
+				}
+
+				err = handle(e)
+				if err != nil {
+					fmt.Println("[ ! ] Error handling event "+e.ID+", requeueing: ", err)
+					time.Sleep(requeueDelay)
+					d.Nack(false, true)
+					continue
+				}
+				d.Ack(false)
+			}
+		}()
+
+		fmt.Println("[ * ] Waiting for messages on " + queue)
+		return nil
+	})
+}
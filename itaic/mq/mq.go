@@ -0,0 +1,172 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/streadway/amqp"
+)
+
+// Publisher ... Sends events to the services listening on the queue
+type Publisher interface {
+	Publish(e events.Event) error
+}
+
+// confirmTimeout ... How long to wait for RabbitMQ to confirm a publish
+const confirmTimeout = 5 * time.Second
+
+// confirmBuffer ... Room for confirmations that arrive after their publish stopped waiting, which
+// the next publish reads past
+const confirmBuffer = 16
+
+// errConfirmTimeout ... RabbitMQ didn't confirm a publish within confirmTimeout
+var errConfirmTimeout = errors.New("timed out waiting for a confirmation")
+
+// AMQP ... Publisher that sends events to the RabbitMQ events exchange. The channel is in confirm
+// mode, so Publish only returns nil once RabbitMQ has taken responsibility for the event.
+type AMQP struct {
+	conn *Conn
+
+	mu       sync.Mutex
+	confirms chan amqp.Confirmation
+	// published ... How many messages have been published on the current channel, which is the
+	// delivery tag RabbitMQ confirms the last one with
+	published uint64
+}
+
+// NewAMQP ... Creates a publisher on conn, which declares the exchange each time it connects
+func NewAMQP(conn *Conn) *AMQP {
+	p := &AMQP{conn: conn}
+	conn.OnConnect(func(ch *amqp.Channel) error {
+		err := ch.ExchangeDeclare(
+			events.Exchange, // name
+			"topic",         // kind
+			true,            // durable
+			false,           // delete when unused
+			false,           // internal
+			false,           // no-wait
+			nil,             // arguments
+		)
+		if err != nil {
+			return err
+		}
+
+		err = ch.Confirm(false)
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer))
+		p.published = 0
+		return nil
+	})
+	return p
+}
+
+// Publish ... Sends the event as a persistent JSON message routed by its type and waits for
+// RabbitMQ to confirm it. Fails with ErrDisconnected while the connection is down.
+func (p *AMQP) Publish(e events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// one publish at a time, so the next delivery tag is known before publishing
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = ch.Publish(
+		events.Exchange,
+		e.Type,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  events.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Type:         e.Type,
+			MessageId:    e.ID,
+			Timestamp:    e.OccurredAt,
+			Body:         body,
+		})
+	if err != nil {
+		return err
+	}
+	p.published++
+
+	ack, err := awaitConfirm(p.confirms, p.published, confirmTimeout)
+	if err == errConfirmTimeout {
+		return errors.New("timed out waiting for RabbitMQ to confirm event " + e.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if !ack {
+		return errors.New("RabbitMQ refused event " + e.ID)
+	}
+
+	fmt.Println("[ + ] Message sent: ", e.Type)
+	return nil
+}
+
+// awaitConfirm ... Waits for the confirmation of the message published with tag and reports whether
+// RabbitMQ took it. Confirmations of earlier messages, whose publishes gave up waiting for them, are
+// skipped so they're never taken for this one.
+func awaitConfirm(confirms <-chan amqp.Confirmation, tag uint64, timeout time.Duration) (bool, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case confirm, ok := <-confirms:
+			if !ok {
+				return false, ErrDisconnected
+			}
+			if confirm.DeliveryTag < tag {
+				continue
+			}
+			if confirm.DeliveryTag > tag {
+				return false, fmt.Errorf("got the confirmation of message %d while waiting for %d", confirm.DeliveryTag, tag)
+			}
+			return confirm.Ack, nil
+		case <-deadline:
+			return false, errConfirmTimeout
+		}
+	}
+}
+
+// Memory ... Publisher that records events instead of sending them, used when running offline
+type Memory struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+// NewMemory ... Creates a publisher that keeps events in memory
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Publish ... Records the event
+func (p *Memory) Publish(e events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.events = append(p.events, e)
+	return nil
+}
+
+// Events ... Returns every event published so far
+func (p *Memory) Events() []events.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]events.Event(nil), p.events...)
+}
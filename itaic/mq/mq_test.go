@@ -0,0 +1,45 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAwaitConfirm(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, confirmBuffer)
+
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	ack, err := awaitConfirm(confirms, 1, time.Second)
+	assert.Nil(t, err, "no error expected")
+	assert.True(t, ack, "the message was acked")
+
+	_, err = awaitConfirm(confirms, 2, 10*time.Millisecond)
+	assert.Equal(t, errConfirmTimeout, err, "nothing confirmed message 2 in time")
+
+	// message 2's ack turns up late, after message 3 has been published and refused
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	ack, err = awaitConfirm(confirms, 3, time.Second)
+	assert.Nil(t, err, "no error expected")
+	assert.False(t, ack, "a late ack for an earlier message isn't taken for this one")
+	assert.Equal(t, 0, len(confirms), "the late confirmation is used up")
+
+	// and a late nack doesn't fail the next message
+	_, err = awaitConfirm(confirms, 4, 10*time.Millisecond)
+	assert.Equal(t, errConfirmTimeout, err)
+	confirms <- amqp.Confirmation{DeliveryTag: 4, Ack: false}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		confirms <- amqp.Confirmation{DeliveryTag: 5, Ack: true}
+	}()
+	ack, err = awaitConfirm(confirms, 5, time.Second)
+	assert.Nil(t, err, "no error expected")
+	assert.True(t, ack, "a late nack for an earlier message isn't taken for this one")
+
+	close(confirms)
+	_, err = awaitConfirm(confirms, 6, time.Second)
+	assert.Equal(t, ErrDisconnected, err, "the channel closing means the connection went")
+}
@@ -0,0 +1,78 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// relayBatch ... How many outbox events are read at a time
+const relayBatch = 100
+
+// Relay ... Publishes the events waiting in the outbox and marks them sent. An event can be
+// published more than once if marking it fails, consumers use the event id to skip repeats.
+type Relay struct {
+	outbox   store.Outbox
+	pub      Publisher
+	interval time.Duration
+}
+
+// NewRelay ... Creates a relay that checks the outbox every interval
+func NewRelay(outbox store.Outbox, pub Publisher, interval time.Duration) *Relay {
+	return &Relay{outbox: outbox, pub: pub, interval: interval}
+}
+
+// Run ... Flushes the outbox every interval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := r.Flush(ctx)
+		if err != nil {
+			fmt.Println("[ ! ] Error relaying outbox: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush ... Publishes pending events in order until there are none left or one fails, returning
+// how many were sent
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		pending, err := r.outbox.PendingEvents(ctx, relayBatch)
+		if err != nil {
+			return sent, err
+		}
+		if len(pending) == 0 {
+			return sent, nil
+		}
+
+		ids := []string{}
+		var publishErr error
+		for _, e := range pending {
+			publishErr = r.pub.Publish(e)
+			if publishErr != nil {
+				break
+			}
+			ids = append(ids, e.ID)
+		}
+
+		err = r.outbox.MarkSent(ctx, ids)
+		if err != nil {
+			return sent, err
+		}
+		sent += len(ids)
+		if publishErr != nil {
+			return sent, publishErr
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package page
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+)
+
+// Limits on how many items a client can ask for at once
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Params ... The page a client asked for with ?limit= and ?cursor=
+type Params struct {
+	Limit  int
+	Cursor string
+}
+
+// FromRequest ... Reads and validates the paging query parameters
+func FromRequest(req *http.Request) (Params, error) {
+	params := Params{Limit: DefaultLimit, Cursor: req.URL.Query().Get("cursor")}
+
+	if raw := req.URL.Query().Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return params, apierr.Validation("limit must be a number from 1 to " + strconv.Itoa(MaxLimit))
+		}
+		params.Limit = limit
+	}
+
+	return params, nil
+}
+
+// Ascending ... Reads ?order=, which is desc (newest first) unless the client asks for asc
+func Ascending(req *http.Request) (bool, error) {
+	switch req.URL.Query().Get("order") {
+	case "", "desc":
+		return false, nil
+	case "asc":
+		return true, nil
+	}
+	return false, apierr.Validation("order must be asc or desc")
+}
+
+// EncodeCursor ... Makes an opaque cursor out of a position in a listing
+func EncodeCursor(position interface{}) string {
+	raw, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// DecodeCursor ... Reads a cursor made by EncodeCursor into position
+func DecodeCursor(cursor string, position interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return apierr.Validation("invalid cursor")
+	}
+
+	err = json.Unmarshal(raw, position)
+	if err != nil {
+		return apierr.Validation("invalid cursor")
+	}
+	return nil
+}
+
+// EncodeOffset ... Makes an opaque cursor pointing at the given position in a list
+func EncodeOffset(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// DecodeOffset ... Reads a cursor made by EncodeOffset, an empty cursor is the start of the list
+func DecodeOffset(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, apierr.Validation("invalid cursor")
+	}
+
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, apierr.Validation("invalid cursor")
+	}
+	return offset, nil
+}
+
+// Slice ... Pages through an in-memory list, returning the window and the cursor for the next one
+func Slice(length int, params Params) (start, end int, next string, err error) {
+	start, err = DecodeOffset(params.Cursor)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if start > length {
+		start = length
+	}
+
+	end = start + params.Limit
+	if end < length {
+		next = EncodeOffset(end)
+	} else {
+		end = length
+	}
+	return start, end, next, nil
+}
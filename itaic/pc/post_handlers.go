@@ -1,214 +1,341 @@
 package pc
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
-	"github.com/streadway/amqp"
-
-	"cloud.google.com/go/firestore"
 	"goji.io/pat"
-	"google.golang.org/api/iterator"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/fatih/structs"
-	"github.com/jmlattanzi/itaic-backend/itaic/config"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/entities"
+	"github.com/jmlattanzi/itaic-backend/itaic/media"
 	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/timeline"
 )
 
-// HandleGetPosts ... Gets all posts from the DB
-func HandleGetPosts(ctx context.Context, client *firestore.Client) func(res http.ResponseWriter, req *http.Request) {
+// maxImageSize ... The largest image a post can have, in bytes
+const maxImageSize = 10 << 20
+
+// maxPostSize ... The largest request creating a post can be, every image at its largest with
+// room for the rest of the form
+const maxPostSize = models.MaxMedia*maxImageSize + 1<<20
+
+// formMemory ... How much of a post's form is kept in memory, the rest is spooled to disk
+const formMemory = 32 << 20
+
+// maxAltText ... The most characters of alt text an image can have
+const maxAltText = 1000
+
+// postPage ... One page of a post listing
+type postPage struct {
+	Posts      []models.Post `json:"posts"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// HandleGetPosts ... Gets a page of posts from the DB ordered by creation time
+func HandleGetPosts(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
-		posts := []models.Post{}
-		iter := client.Collection("posts").Documents(ctx)
-		for {
-			post := models.Post{}
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
 
-			if err != nil {
-				log.Fatal("[ ! ] Error iterating document: ", err)
-			}
+		listed, err := listPosts(ctx, posts, req, "")
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
 
-			err = doc.DataTo(&post)
-			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
-			}
-			posts = append(posts, post)
+		json.NewEncoder(res).Encode(&listed)
+	}
+}
+
+// listPosts ... Gets the page of posts asked for in the request's query, only the ones tagged
+// with tag if it's set
+func listPosts(ctx context.Context, posts store.PostStore, req *http.Request, tag string) (postPage, error) {
+	params, err := page.FromRequest(req)
+	if err != nil {
+		return postPage{}, err
+	}
+
+	ascending, err := page.Ascending(req)
+	if err != nil {
+		return postPage{}, err
+	}
+
+	// ask for one extra post to find out if there's another page
+	q := store.PostQuery{Limit: params.Limit + 1, Ascending: ascending, Tag: tag}
+	if params.Cursor != "" {
+		q.After = &store.PostCursor{}
+		err = page.DecodeCursor(params.Cursor, q.After)
+		if err != nil {
+			return postPage{}, err
 		}
+	}
+
+	result, err := posts.ListPosts(ctx, q)
+	if err != nil {
+		return postPage{}, err
+	}
+
+	next := ""
+	if len(result) > params.Limit {
+		result = result[:params.Limit]
+		last := result[len(result)-1]
+		next = page.EncodeCursor(store.PostCursor{Created: last.Created, ID: last.ID})
+	}
 
-		json.NewEncoder(res).Encode(&posts)
+	// posts whose images aren't ready are left out, which can make a page come up short
+	listed := postPage{Posts: []models.Post{}, NextCursor: next}
+	for _, post := range result {
+		if post.Ready() {
+			listed.Posts = append(listed.Posts, post)
+		}
 	}
+	return listed, nil
 }
 
 // HandleGetPostByID ... Gets a single post based on id
-func HandleGetPostByID(ctx context.Context, client *firestore.Client) func(res http.ResponseWriter, req *http.Request) {
+func HandleGetPostByID(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		id := pat.Param(req, "id")
+		post, err := posts.GetPost(ctx, id)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
+
+		json.NewEncoder(res).Encode(&post)
+	}
+}
+
+// mediaEdit ... The body of a request editing a post's images
+type mediaEdit struct {
+	Media []struct {
+		ID      string `json:"id"`
+		AltText string `json:"alt_text"`
+	} `json:"media"`
+}
+
+// HandleEditMedia ... Reorders a post's images and edits their alt text. The body lists every one
+// of the post's media items by id, in the order they should be shown, with their alt text.
+func HandleEditMedia(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
-		post := models.Post{}
 		id := pat.Param(req, "id")
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
 
+		edit := mediaEdit{}
+		err := json.NewDecoder(req.Body).Decode(&edit)
+		if err != nil {
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON object with a media list"))
+			return
+		}
+
+		post, err := posts.GetPost(ctx, id)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
+		if post.UID != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("only the author can edit a post"))
+			return
+		}
+
+		current := map[string]models.MediaItem{}
+		for _, item := range post.Media {
+			current[item.ID] = item
+		}
+		if len(edit.Media) != len(current) {
+			apierr.Write(res, req, apierr.Validation("media must list each of the post's images once"))
+			return
+		}
+
+		// build a new list rather than changing the one the store handed back
+		media := []models.MediaItem{}
+		for i, e := range edit.Media {
+			item, ok := current[e.ID]
+			if !ok {
+				apierr.Write(res, req, apierr.Validation("media must list each of the post's images once"))
+				return
+			}
+			if utf8.RuneCountInString(e.AltText) > maxAltText {
+				apierr.Write(res, req, apierr.Validation(imageError(i, len(edit.Media), "alt text can be at most "+strconv.Itoa(maxAltText)+" characters")))
+				return
+			}
+			delete(current, e.ID)
+			item.AltText = e.AltText
+			media = append(media, item)
+		}
+		post.Media = media
+		post.UpdatedAt = time.Now().UTC()
+
+		e, err := events.New(events.PostUpdated, post.UID, events.Post{ID: id, UID: post.UID})
 		if err != nil {
-			fmt.Println("[ ! ] Document get returned an err: ", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			res.Write([]byte("500 - post not found"))
+			apierr.Write(res, req, err)
 			return
 		}
 
-		err = doc.DataTo(&post)
+		err = posts.UpdatePost(ctx, post, e)
 		if err != nil {
-			fmt.Println("[ ! ] Error mapping data into struct: ", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			res.Write([]byte("500 - post not found"))
+			apierr.Write(res, req, apierr.Missing(err, "post"))
 			return
 		}
 
+		// read it back for the cover, which is whichever image is now first
+		post, err = posts.GetPost(ctx, id)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
 		json.NewEncoder(res).Encode(&post)
 	}
 }
 
+// postStatus ... Where processing a post's image has got to
+type postStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HandleGetPostStatus ... Gets whether a post's image is still processing, so clients can poll
+// until it's ready or failed
+func HandleGetPostStatus(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		post, err := posts.GetPost(ctx, pat.Param(req, "id"))
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
+
+		status := postStatus{Status: post.Status, Reason: post.StatusReason}
+		if post.Ready() {
+			status.Status = models.PostReady
+		}
+		json.NewEncoder(res).Encode(&status)
+	}
+}
+
 //HandleCreatePost ...Inserts a post to the DB
-func HandleCreatePost(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+func HandleCreatePost(ctx context.Context, posts store.PostStore, users store.UserStore, blobs blob.Store) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
 		// setup the new post
 		newPost := models.Post{}
-		user := models.User{}
+		req.Body = http.MaxBytesReader(res, req.Body, maxPostSize)
+		err := req.ParseMultipartForm(formMemory)
+		if err != nil {
+			apierr.Write(res, req, apierr.Validation("request body must be a multipart form of at most "+strconv.Itoa(maxPostSize>>20)+"MB"))
+			return
+		}
+		defer req.MultipartForm.RemoveAll()
 		caption := req.FormValue("caption")
-		uid := req.FormValue("uid")
-		imageLocation := upload(req)
-
-		// create a new document in the collection
-		doc := client.Collection("posts").NewDoc()
-
-		// using the new doc, set the id in the post to the doc's id
-		newPost.ID = doc.ID
-		newPost.UID = uid
-		newPost.Caption = caption
-		newPost.Created = time.Now().String()
-		newPost.ImageURL = imageLocation
-
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
+		uid := authn.UID(req)
 
-			if err != nil {
-				fmt.Println("[ ! ] Error iterating documents: ", err)
-				res.WriteHeader(http.StatusInternalServerError)
-				res.Write([]byte("500 - post not found"))
-				return
-			}
+		user, err := users.GetUser(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
 
-			err = doc.DataTo(&user)
-			if err != nil {
-				fmt.Println("[ ! ] Error mapping data to struct: ", err)
-				res.WriteHeader(http.StatusInternalServerError)
-				res.Write([]byte("500 - post not found"))
-				return
-			}
+		found, err := entities.Extract(ctx, users, caption)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
 		}
-		user.Posts = append(user.Posts, doc.ID)
-		newPost.Username = user.Username
 
-		// write data to the doc
-		_, err := doc.Create(ctx, newPost)
+		// the id is picked first so the uploads can be kept under the post
+		newPost.ID = posts.NewPostID()
+		items, originals, err := upload(ctx, req, newPost.ID, blobs)
 		if err != nil {
-			fmt.Println("[ ! ] Error creating new document: ", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			res.Write([]byte("500 - post not found"))
+			apierr.Write(res, req, err)
 			return
 		}
 
-		_, err = client.Collection("users").Doc(user.ID).Set(ctx, user)
+		newPost.UID = uid
+		newPost.Username = user.Username
+		newPost.Caption = caption
+		newPost.Entities = found
+		newPost.Created = time.Now().UTC()
+		newPost.UpdatedAt = newPost.Created
+		newPost.Media = items
+		newPost.Status = models.PostProcessing
+
+		// the score lets the cache add the post to timelines without looking it up
+		created, err := events.New(events.PostCreated, uid, events.Post{
+			ID:    newPost.ID,
+			UID:   newPost.UID,
+			Score: timeline.Score(newPost),
+		})
 		if err != nil {
-			fmt.Println("[ ! ] Error assigning post to user: ", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			res.Write([]byte("500 - post not found"))
+			apierr.Write(res, req, err)
+			return
+		}
+		job, err := events.New(events.MediaRequested, uid, events.Media{PostID: newPost.ID, UID: uid, Items: originals})
+		if err != nil {
+			apierr.Write(res, req, err)
 			return
 		}
 
-		// send message saying a post was updated
-		body := doc.ID
-		err = ch.Publish(
-			"",
-			q.Name,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Type:        "UPDATE",
-				Body:        []byte(body),
-			})
+		// writes the post, adds it to the user's posts and queues the events together, the media
+		// worker makes the images and marks the post ready
+		newPost, err = posts.CreatePost(ctx, newPost, created, job)
 		if err != nil {
-			log.Fatal("[ ! ] Error publishing message")
+			apierr.Write(res, req, err)
+			return
 		}
-		fmt.Println("[ + ] Message sent")
+		res.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(res).Encode(&newPost)
 	}
 }
 
-// HandleDeletePost ...Deletes a document form the DB
-func HandleDeletePost(ctx context.Context, client *firestore.Client) func(res http.ResponseWriter, req *http.Request) {
+// HandleDeletePost ...Deletes a document form the DB, with its comments, likes and images
+func HandleDeletePost(ctx context.Context, posts store.PostStore, blobs blob.Store) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		id := pat.Param(req, "id")
-		uid := pat.Param(req, "uid")
-		user := models.User{}
-		_, err := client.Collection("posts").Doc(string(id)).Delete(ctx)
+		uid := authn.UID(req)
+		post, err := posts.GetPost(ctx, id)
 		if err != nil {
-			log.Fatal("[ ! ] Error deleting post: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
+		}
+		if post.UID != uid {
+			apierr.Write(res, req, apierr.Forbidden("only the author can delete a post"))
+			return
 		}
 
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				fmt.Println("[ ! ] Error iterating documents: ", err)
-				res.WriteHeader(http.StatusInternalServerError)
-				res.Write([]byte("500 - post not found"))
-				return
-			}
-
-			err = doc.DataTo(&user)
-			if err != nil {
-				fmt.Println("[ ! ] Error mapping data to struct: ", err)
-				res.WriteHeader(http.StatusInternalServerError)
-				res.Write([]byte("500 - post not found"))
-				return
-			}
+		e, err := events.New(events.PostDeleted, uid, events.Post{ID: id, UID: uid})
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
 		}
 
-		for i := 0; i < len(user.Posts); i++ {
-			if user.Posts[i] == id {
-				user.Posts = append(user.Posts[:i], user.Posts[i+1:]...)
-				i--
-				break
-			}
+		// also takes the post off the user's posts
+		err = posts.DeletePost(ctx, id, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
 		}
 
-		_, err = client.Collection("users").Doc(user.ID).Set(ctx, user)
+		// the post is already gone, so images that couldn't be removed are only wasted space
+		err = blob.DeletePostImages(ctx, blobs, post)
 		if err != nil {
-			log.Fatal("[ ! ] Error setting user: ", err)
+			fmt.Println("[ ! ] Error removing the images of post "+id+": ", err)
 		}
 
 		json.NewEncoder(res).Encode("Post deleted")
@@ -216,7 +343,7 @@ func HandleDeletePost(ctx context.Context, client *firestore.Client) func(res ht
 }
 
 // HandleEditPost ...Edits a post in the DB
-func HandleEditPost(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
+func HandleEditPost(ctx context.Context, posts store.PostStore, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 		type Caption struct {
@@ -226,174 +353,138 @@ func HandleEditPost(ctx context.Context, client *firestore.Client, ch *amqp.Chan
 		// setup some variable
 		var newCaption Caption
 		id := pat.Param(req, "id")
-		currentPost := models.Post{}
 
-		// get the document
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
+		// decode the new caption string
+		err := json.NewDecoder(req.Body).Decode(&newCaption)
 		if err != nil {
-			log.Fatal("[ ! ] Error getting document: ", err)
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON object with a caption"))
+			return
 		}
 
-		// populate the current post
-		err = doc.DataTo(&currentPost)
+		// get the post
+		currentPost, err := posts.GetPost(ctx, id)
 		if err != nil {
-			log.Fatal("[ ! ] Error mapping data to the struct: ", err)
+			apierr.Write(res, req, apierr.Missing(err, "post"))
+			return
 		}
-
-		// decode the new caption string
-		err = json.NewDecoder(req.Body).Decode(&newCaption)
+		if currentPost.UID != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("only the author can edit a post"))
+			return
+		}
+		found, err := entities.Extract(ctx, users, newCaption.Caption)
 		if err != nil {
-			log.Fatal("[ ! ] Error decoding request body")
+			apierr.Write(res, req, err)
+			return
 		}
 		currentPost.Caption = newCaption.Caption
+		currentPost.Entities = found
+		currentPost.UpdatedAt = time.Now().UTC()
 
-		// this is why I have to do in such a long manner
-		mappedPost := structs.Map(currentPost)
-		_, err = client.Collection("posts").Doc(id).Set(ctx, mappedPost)
+		e, err := events.New(events.PostUpdated, currentPost.UID, events.Post{ID: id, UID: currentPost.UID})
 		if err != nil {
-			log.Fatal("[ ! ] Error setting document: ", err)
-		}
-
-		body := id
-		err = ch.Publish(
-			"",
-			q.Name,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Type:        "UPDATE",
-				Body:        []byte(body),
-			})
+			apierr.Write(res, req, err)
+			return
+		}
+
+		err = posts.UpdatePost(ctx, currentPost, e)
 		if err != nil {
-			log.Fatal("[ ! ] Error publishing message")
+			apierr.Write(res, req, err)
+			return
 		}
-		fmt.Println("[ + ] Message sent")
 
 		json.NewEncoder(res).Encode(currentPost)
 	}
 }
 
-// HandleLikePost ... Handles liking a post
-func HandleLikePost(ctx context.Context, client *firestore.Client, ch *amqp.Channel, q amqp.Queue) func(res http.ResponseWriter, req *http.Request) {
-	return func(res http.ResponseWriter, req *http.Request) {
-		res.Header().Set("Content-Type", "application/json")
-
-		id := pat.Param(req, "id")
-		uid := pat.Param(req, "uid")
-		user := models.User{}
-		post := models.Post{}
-
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				log.Fatal("[ ! ] Error iterating documents: ", err)
-			}
-
-			err = doc.DataTo(&user)
-			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
-			}
-		}
+// upload ... Checks the images in the request look like ones a post can have and keeps each,
+// exactly as it was sent, under a key made from its contents within the post. Returns the post's media items, in
+// the order the images were sent with the alt_text sent in the same position, and the uploads
+// for the media job. Originals aren't public, the media worker reads them back to make the images
+// that are.
+func upload(ctx context.Context, r *http.Request, postID string, blobs blob.Store) ([]models.MediaItem, []events.MediaItem, error) {
+	files := r.MultipartForm.File["image"]
+	altTexts := r.MultipartForm.Value["alt_text"]
+	if len(files) == 0 {
+		return nil, nil, apierr.Validation("an image file is required")
+	}
+	if len(files) > models.MaxMedia {
+		return nil, nil, apierr.Validation("a post can have at most " + strconv.Itoa(models.MaxMedia) + " images")
+	}
+	if len(altTexts) > len(files) {
+		return nil, nil, apierr.Validation("there is more alt_text than there are images")
+	}
 
-		doc, err := client.Collection("posts").Doc(id).Get(ctx)
+	// check every image before keeping any, so a bad one doesn't leave the others behind
+	type original struct {
+		data        []byte
+		contentType string
+	}
+	originals := []original{}
+	for i, header := range files {
+		data, err := readImage(header)
 		if err != nil {
-			log.Fatal("[ ! ] Error finding post")
+			return nil, nil, err
 		}
 
-		err = doc.DataTo(&post)
+		contentType, err := media.Check(data)
 		if err != nil {
-			log.Fatal("[ ! ] Error mapping data to struct: ", err)
+			return nil, nil, apierr.Validation(imageError(i, len(files), err.Error()))
 		}
-
-		likes := user.Likes
-		addToLikes, i := remove(likes, id)
-		if addToLikes == false && i == 0 {
-			likes = append(likes, id)
-			post.Likes++
-		} else {
-			likes = append(likes[:i], likes[i+1:]...)
-			post.Likes--
+		if i < len(altTexts) && utf8.RuneCountInString(altTexts[i]) > maxAltText {
+			return nil, nil, apierr.Validation(imageError(i, len(files), "alt text can be at most "+strconv.Itoa(maxAltText)+" characters"))
 		}
+		originals = append(originals, original{data, contentType})
+	}
 
-		user.Likes = likes
-		_, err = client.Collection("posts").Doc(id).Set(ctx, post)
+	items := []models.MediaItem{}
+	uploads := []events.MediaItem{}
+	for i, o := range originals {
+		key := blob.OriginalKey(blob.PostOwner(postID), o.data, o.contentType)
+		_, err := blobs.Put(ctx, key, o.contentType, bytes.NewReader(o.data))
 		if err != nil {
-			log.Fatal("[ ! ] Error setting post: ", err)
+			return nil, nil, apierr.Upstream("error uploading image", err)
 		}
 
-		_, err = client.Collection("users").Doc(user.ID).Set(ctx, user)
-		if err != nil {
-			log.Fatal("[ ! ] Error setting user: ", err)
-		}
-
-		// TODO:
-		// 	+ this only sends a message about the post being updated
-		// 		if the cache needs to update the user as well I'll need to fix this
-		body := id
-		err = ch.Publish(
-			"",
-			q.Name,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Type:        "UPDATE",
-				Body:        []byte(body),
-			})
-		if err != nil {
-			log.Fatal("[ ! ] Error publishing message")
+		item := models.MediaItem{ID: newMediaID(), Original: key}
+		if i < len(altTexts) {
+			item.AltText = altTexts[i]
 		}
-		fmt.Println("[ + ] Message sent")
-
-		json.NewEncoder(res).Encode(&post)
+		items = append(items, item)
+		uploads = append(uploads, events.MediaItem{ID: item.ID, Key: key})
 	}
+	return items, uploads, nil
 }
 
-func upload(r *http.Request) string {
-	config := config.LoadConfigurationFile("config.json")
-
-	creds := credentials.NewStaticCredentials(config.S3AccessKey, config.S3SecretAccessKey, "")
-	sesh := session.Must(session.NewSession(&aws.Config{
-		Credentials: creds,
-		Region:      aws.String("us-west-1"),
-	}))
-	uploader := s3manager.NewUploader(sesh)
-
-	file, header, err := r.FormFile("image")
+// readImage ... Reads an uploaded file, as long as it's small enough to be an image on a post
+func readImage(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
 	if err != nil {
-		log.Fatal("[!] Error in FormFile: ", err)
+		return nil, apierr.Validation("error reading the image")
 	}
 	defer file.Close()
-	fmt.Println("[>] Filename: ", header.Filename)
-
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(config.S3Bucket),
-		Key:    aws.String(header.Filename),
-		Body:   file,
-	})
 
+	// read one byte past the limit to tell a file that fits exactly from one that's too big
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize+1))
 	if err != nil {
-		log.Fatal("[!] Error uploading file: ", err)
+		return nil, apierr.Validation("error reading the image")
 	}
-
-	fmt.Println("[+] File uploaded")
-	fmt.Println("[+] File URL: ", result.Location)
-	return result.Location
+	if len(data) > maxImageSize {
+		return nil, apierr.Validation("images can be at most " + strconv.Itoa(maxImageSize>>20) + "MB")
+	}
+	return data, nil
 }
 
-func remove(likes []string, id string) (bool, int) {
-	for i := 0; i < len(likes); i++ {
-		likeID := likes[i]
-		if likeID == id {
-			return true, i
-		}
+// imageError ... Says which image a problem is with when a post has more than one
+func imageError(i, n int, message string) string {
+	if n == 1 {
+		return message
 	}
-	return false, 0
+	return "image " + strconv.Itoa(i+1) + ": " + message
+}
+
+// newMediaID ... Picks an id for an image on a post, only unique within the post
+func newMediaID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
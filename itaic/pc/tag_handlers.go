@@ -0,0 +1,144 @@
+package pc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"goji.io/pat"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/entities"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// Limits on what GET /tags/trending can be asked for
+const (
+	defaultTrending = 10
+	maxTrending     = 50
+	defaultWindow   = 24
+	maxWindow       = 7 * 24
+)
+
+// trendingTTL ... How long the trending tags over a window are reused before they're counted
+// again. Counting reads the post_tags entry of every tagged post in the window, too many to read on
+// each request.
+const trendingTTL = time.Minute
+
+// trendingTag ... A hashtag and how many posts used it
+type trendingTag struct {
+	Tag   string `json:"tag"`
+	Posts int    `json:"posts"`
+}
+
+// trendingTags ... The most used hashtags over the last Hours hours
+type trendingTags struct {
+	Tags  []trendingTag `json:"tags"`
+	Hours int           `json:"hours"`
+}
+
+// countedTags ... The trending tags over a window and when they were counted
+type countedTags struct {
+	tags []store.TagCount
+	at   time.Time
+}
+
+// trendingCache ... The trending tags over each window asked for, counted at most once every
+// trendingTTL
+type trendingCache struct {
+	mu      sync.Mutex
+	windows map[int]countedTags
+}
+
+// get ... The maxTrending tags used on the most posts over the last hours hours, counting them
+// again if they're more than trendingTTL old. Requests for a window wait on the one counting it.
+func (c *trendingCache) get(ctx context.Context, posts store.PostStore, hours int) ([]store.TagCount, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if counted, ok := c.windows[hours]; ok && time.Since(counted.at) < trendingTTL {
+		return counted.tags, nil
+	}
+
+	since := time.Now().UTC().Add(-time.Duration(hours) * time.Hour)
+	tags, err := posts.TrendingTags(ctx, since, maxTrending)
+	if err != nil {
+		return nil, err
+	}
+	c.windows[hours] = countedTags{tags: tags, at: time.Now()}
+	return tags, nil
+}
+
+// HandleGetTaggedPosts ... Gets a page of the posts with a hashtag in their caption, newest first.
+// The tag is matched whatever its case and can be given with or without the #.
+func HandleGetTaggedPosts(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		tag := entities.Normalize(pat.Param(req, "tag"))
+		if !entities.Valid(tag) {
+			apierr.Write(res, req, apierr.Validation("tag must be letters, numbers and underscores with at least one letter"))
+			return
+		}
+
+		listed, err := listPosts(ctx, posts, req, tag)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		json.NewEncoder(res).Encode(&listed)
+	}
+}
+
+// HandleGetTrendingTags ... Gets the hashtags used on the most posts over the last ?hours=, a day
+// unless it's given, up to ?limit= of them. The counts can be up to trendingTTL old.
+func HandleGetTrendingTags(ctx context.Context, posts store.PostStore) func(res http.ResponseWriter, req *http.Request) {
+	cache := &trendingCache{windows: map[int]countedTags{}}
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		limit, err := number(req, "limit", defaultTrending, maxTrending)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+		hours, err := number(req, "hours", defaultWindow, maxWindow)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		counts, err := cache.get(ctx, posts, hours)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+		if len(counts) > limit {
+			counts = counts[:limit]
+		}
+
+		trending := trendingTags{Tags: []trendingTag{}, Hours: hours}
+		for _, c := range counts {
+			trending.Tags = append(trending.Tags, trendingTag{Tag: c.Tag, Posts: c.Posts})
+		}
+		json.NewEncoder(res).Encode(&trending)
+	}
+}
+
+// number ... Reads a whole number from 1 to max out of the query, or fallback if it isn't there
+func number(req *http.Request, name string, fallback, max int) (int, error) {
+	raw := req.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > max {
+		return 0, apierr.Validation(name + " must be a number from 1 to " + strconv.Itoa(max))
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+)
+
+// maxQuery ... How many characters a search can be
+const maxQuery = 200
+
+// types ... The document type searched for each ?type= a client can ask for
+var types = map[string]string{
+	"posts": TypePost,
+	"users": TypeUser,
+	"tags":  TypeTag,
+}
+
+// resultPage ... One page of what was found. Results are PostHits, UserHits or TagHits depending
+// on the type searched for.
+type resultPage struct {
+	Type       string            `json:"type"`
+	Results    []json.RawMessage `json:"results"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// HandleSearch ... Searches the posts, users or hashtags in ?type=, posts unless it's given, for
+// the words in ?q=. Each word also finds the words it starts, so it works for autocomplete.
+func HandleSearch(ctx context.Context, idx *Index) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		q := req.URL.Query().Get("q")
+		if len(Tokenize(q)) == 0 {
+			apierr.Write(res, req, apierr.Validation("q must have a word to search for"))
+			return
+		}
+		if utf8.RuneCountInString(q) > maxQuery {
+			apierr.Write(res, req, apierr.Validation("q must be at most "+strconv.Itoa(maxQuery)+" characters"))
+			return
+		}
+
+		name := req.URL.Query().Get("type")
+		if name == "" {
+			name = "posts"
+		}
+		docType, ok := types[name]
+		if !ok {
+			apierr.Write(res, req, apierr.Validation("type must be posts, users or tags"))
+			return
+		}
+
+		params, err := page.FromRequest(req)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		found := idx.Search(docType, q)
+		start, end, next, err := page.Slice(len(found), params)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		result := resultPage{Type: name, Results: []json.RawMessage{}, NextCursor: next}
+		for _, doc := range found[start:end] {
+			result.Results = append(result.Results, doc.Source)
+		}
+
+		json.NewEncoder(res).Encode(&result)
+	}
+}
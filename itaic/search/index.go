@@ -0,0 +1,418 @@
+// Package search finds posts, users and hashtags for GET /search. It keeps an inverted index, from
+// each word to the documents it's in, that the search service builds from the events the API
+// publishes and saves to disk between restarts. Every word in a query matches the words it's the
+// start of as well as itself, so usernames can be looked up as they're typed.
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Document types
+const (
+	TypePost = "post"
+	TypeUser = "user"
+	TypeTag  = "tag"
+)
+
+// snapshotVersion ... Version of the file Save writes, bumped when it changes in a way Load can't read
+const snapshotVersion = 1
+
+// Weights of a match on a keyword, a word from the text, and a whole word rather than its start
+const (
+	keywordWeight = 3
+	textWeight    = 1
+	exactBonus    = 2
+)
+
+// Document ... Something that can be searched for
+type Document struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// Text ... Words the document can be found by, like a caption
+	Text string `json:"text"`
+	// Keywords ... Words that count for more than the ones in Text, like a username
+	Keywords []string `json:"keywords,omitempty"`
+	// Tags ... The hashtags on a post, counted by Tagged
+	Tags []string `json:"tags,omitempty"`
+	// Rank ... Orders documents that match equally well, highest first
+	Rank float64 `json:"rank"`
+	// Source ... What's sent back when the document is found
+	Source json.RawMessage `json:"source"`
+}
+
+// snapshot ... The file Save writes, only the documents are kept and the rest is rebuilt by Load
+type snapshot struct {
+	Version   int         `json:"version"`
+	Documents []*Document `json:"documents"`
+}
+
+// shard ... The documents of one type and the words that find them
+type shard struct {
+	docs map[string]*Document
+	// postings ... The weight of each word in each document it's in, by document id
+	postings map[string]map[string]int
+	// terms ... Every word in postings in order, for finding the ones a query word starts. Words
+	// are put in their place as they're added, so searches never have to sort them.
+	terms []string
+}
+
+// addTerm ... Puts a new word in its place in terms
+func (s *shard) addTerm(term string) {
+	i := sort.SearchStrings(s.terms, term)
+	s.terms = append(s.terms, "")
+	copy(s.terms[i+1:], s.terms[i:])
+	s.terms[i] = term
+}
+
+// removeTerm ... Takes a word that's no longer in postings out of terms
+func (s *shard) removeTerm(term string) {
+	i := sort.SearchStrings(s.terms, term)
+	if i < len(s.terms) && s.terms[i] == term {
+		s.terms = append(s.terms[:i], s.terms[i+1:]...)
+	}
+}
+
+// Index ... An inverted index of documents, safe to use from many goroutines
+type Index struct {
+	mu     sync.RWMutex
+	shards map[string]*shard
+	// tagged ... The ids of the posts with each hashtag
+	tagged map[string]map[string]bool
+	// changes and saved ... Counts of changes made and of those that are on disk
+	changes, saved int
+	// loading ... Set while Load fills the index, which sorts each shard's words once at the end
+	// rather than putting each in its place
+	loading bool
+}
+
+// New ... Creates an empty index
+func New() *Index {
+	return &Index{shards: map[string]*shard{}, tagged: map[string]map[string]bool{}}
+}
+
+// Load ... Reads an index saved by Save, or creates an empty one if there's no file at path
+func Load(path string) (*Index, error) {
+	idx := New()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := snapshot{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+	if saved.Version != snapshotVersion {
+		return nil, errors.New("the index at " + path + " is from another version, rebuild it")
+	}
+
+	idx.loading = true
+	for _, doc := range saved.Documents {
+		idx.put(doc)
+	}
+	for _, s := range idx.shards {
+		sort.Strings(s.terms)
+	}
+	idx.loading = false
+
+	idx.changes, idx.saved = 0, 0
+	return idx, nil
+}
+
+// Save ... Writes every document to path, replacing the file in one step so a crash part way
+// through leaves the last save behind
+func (x *Index) Save(path string) error {
+	x.mu.RLock()
+	saved := snapshot{Version: snapshotVersion, Documents: []*Document{}}
+	for _, s := range x.shards {
+		for _, doc := range s.docs {
+			saved.Documents = append(saved.Documents, doc)
+		}
+	}
+	changes := x.changes
+	x.mu.RUnlock()
+
+	// documents are never changed once they're in the index, only replaced, so they can be
+	// written out without holding the lock
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	if changes > x.saved {
+		x.saved = changes
+	}
+	x.mu.Unlock()
+	return nil
+}
+
+// Unsaved ... Whether anything has changed since the last Save
+func (x *Index) Unsaved() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.changes != x.saved
+}
+
+// Put ... Adds a document, replacing the one of the same type and id if there is one
+func (x *Index) Put(doc Document) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.put(&doc)
+}
+
+// Delete ... Removes a document, if it's there
+func (x *Index) Delete(docType, id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(docType, id)
+}
+
+// Get ... Gets a document by type and id
+func (x *Index) Get(docType, id string) (Document, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	s, ok := x.shards[docType]
+	if !ok {
+		return Document{}, false
+	}
+	doc, ok := s.docs[id]
+	if !ok {
+		return Document{}, false
+	}
+	return *doc, true
+}
+
+// Len ... How many documents of a type there are
+func (x *Index) Len(docType string) int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if s, ok := x.shards[docType]; ok {
+		return len(s.docs)
+	}
+	return 0
+}
+
+// Tagged ... How many posts have the hashtag
+func (x *Index) Tagged(tag string) int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.tagged[tag])
+}
+
+// Search ... Finds the documents of a type with every word in query, or a word it's the start of,
+// best match first. Whole words count for more than the start of one, keywords for more than
+// text, and Rank decides between documents that match as well as each other.
+func (x *Index) Search(docType, query string) []Document {
+	words := Tokenize(query)
+	if len(words) == 0 {
+		return []Document{}
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	s, ok := x.shards[docType]
+	if !ok {
+		return []Document{}
+	}
+
+	// a document's score is the sum of its best match for each word, and it has to match them all
+	var scores map[string]int
+	for _, word := range words {
+		best := map[string]int{}
+		for i := sort.SearchStrings(s.terms, word); i < len(s.terms) && strings.HasPrefix(s.terms[i], word); i++ {
+			term := s.terms[i]
+			for id, weight := range s.postings[term] {
+				if term == word {
+					weight *= exactBonus
+				}
+				if weight > best[id] {
+					best[id] = weight
+				}
+			}
+		}
+
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id, score := range scores {
+			if b, ok := best[id]; ok {
+				scores[id] = score + b
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	found := make([]Document, 0, len(scores))
+	for id := range scores {
+		found = append(found, *s.docs[id])
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if scores[a.ID] != scores[b.ID] {
+			return scores[a.ID] > scores[b.ID]
+		}
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		return a.ID < b.ID
+	})
+	return found
+}
+
+// put ... Adds a document, the lock has to be held
+func (x *Index) put(doc *Document) {
+	x.remove(doc.Type, doc.ID)
+
+	s, ok := x.shards[doc.Type]
+	if !ok {
+		s = &shard{docs: map[string]*Document{}, postings: map[string]map[string]int{}}
+		x.shards[doc.Type] = s
+	}
+	s.docs[doc.ID] = doc
+
+	for term, weight := range weights(doc) {
+		ids, ok := s.postings[term]
+		if !ok {
+			ids = map[string]int{}
+			s.postings[term] = ids
+			if x.loading {
+				s.terms = append(s.terms, term)
+			} else {
+				s.addTerm(term)
+			}
+		}
+		ids[doc.ID] = weight
+	}
+
+	for _, tag := range doc.Tags {
+		if x.tagged[tag] == nil {
+			x.tagged[tag] = map[string]bool{}
+		}
+		x.tagged[tag][doc.ID] = true
+	}
+	x.changes++
+}
+
+// remove ... Removes a document, the lock has to be held
+func (x *Index) remove(docType, id string) {
+	s, ok := x.shards[docType]
+	if !ok {
+		return
+	}
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+
+	for term := range weights(doc) {
+		delete(s.postings[term], id)
+		if len(s.postings[term]) == 0 {
+			delete(s.postings, term)
+			s.removeTerm(term)
+		}
+	}
+	for _, tag := range doc.Tags {
+		delete(x.tagged[tag], id)
+		if len(x.tagged[tag]) == 0 {
+			delete(x.tagged, tag)
+		}
+	}
+	delete(s.docs, id)
+	x.changes++
+}
+
+// weights ... The words a document can be found by and how much each counts for. A word that's in
+// the text more than once counts that many times.
+func weights(doc *Document) map[string]int {
+	terms := map[string]int{}
+	for _, word := range Tokenize(doc.Text) {
+		for _, term := range parts(word) {
+			terms[term] += textWeight
+		}
+	}
+	for _, keyword := range doc.Keywords {
+		for _, word := range Tokenize(keyword) {
+			for _, term := range parts(word) {
+				if terms[term] < keywordWeight {
+					terms[term] = keywordWeight
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// Tokenize ... Splits text into the lower case words it's searched by. Dots and underscores are
+// kept inside words, so a username like other.one is one word, and the #s and @s of hashtags and
+// mentions are dropped.
+func Tokenize(text string) []string {
+	words := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), separator) {
+		word = strings.Trim(word, ".")
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// parts ... A word and, if it has dots in it, each of the words between them, so other.one can
+// also be found by one
+func parts(word string) []string {
+	if !strings.Contains(word, ".") {
+		return []string{word}
+	}
+
+	found := []string{word}
+	for _, part := range strings.Split(word, ".") {
+		if part != "" {
+			found = append(found, part)
+		}
+	}
+	return found
+}
+
+// separator ... Whether r comes between words
+func separator(r rune) bool {
+	return r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
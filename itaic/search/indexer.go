@@ -0,0 +1,230 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// Events ... The event types the indexer keeps the index up to date from
+var Events = []string{
+	events.PostCreated,
+	events.PostReady,
+	events.PostUpdated,
+	events.PostDeleted,
+	events.UserCreated,
+	events.UserUpdated,
+	events.UserDeleted,
+}
+
+// PostHit ... A post that was found, enough of it to show in a list of results
+type PostHit struct {
+	ID       string `json:"id"`
+	UID      string `json:"uid"`
+	Username string `json:"username"`
+	Caption  string `json:"caption"`
+	// ImageURL ... The thumbnail of the post's cover
+	ImageURL string    `json:"image_url"`
+	Created  time.Time `json:"created"`
+}
+
+// UserHit ... A user that was found
+type UserHit struct {
+	UID         string `json:"uid"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	ProfilePic  string `json:"profile_pic"`
+}
+
+// TagHit ... A hashtag that was found and how many posts have it
+type TagHit struct {
+	Tag   string `json:"tag"`
+	Posts int    `json:"posts"`
+}
+
+// Indexer ... Keeps an index up to date with the posts and users in a store. Events only say what
+// changed, so the indexer reads the post or user as it is now, which means events that arrive
+// twice or out of order still leave the index right. Changes are made one at a time, an indexer
+// isn't safe to use from more than one goroutine.
+type Indexer struct {
+	idx   *Index
+	posts store.PostStore
+	users store.UserStore
+}
+
+// NewIndexer ... Creates an indexer that reads posts and users from the store and writes to idx
+func NewIndexer(idx *Index, posts store.PostStore, users store.UserStore) *Indexer {
+	return &Indexer{idx: idx, posts: posts, users: users}
+}
+
+// Handle ... Indexes or removes the post or user in an event. Only returns an error if the store
+// couldn't be read, in which case the event should be tried again later.
+func (x *Indexer) Handle(ctx context.Context, e events.Event) error {
+	switch e.Type {
+	case events.PostCreated, events.PostReady, events.PostUpdated, events.PostDeleted:
+		payload := events.Post{}
+		err := e.Decode(&payload)
+		if err != nil {
+			fmt.Println("[ ! ] Skipping unreadable event "+e.ID+": ", err)
+			return nil
+		}
+		if e.Type == events.PostDeleted {
+			x.RemovePost(payload.ID)
+			return nil
+		}
+		return x.refreshPost(ctx, payload.ID)
+
+	case events.UserCreated, events.UserUpdated, events.UserDeleted:
+		payload := events.User{}
+		err := e.Decode(&payload)
+		if err != nil {
+			fmt.Println("[ ! ] Skipping unreadable event "+e.ID+": ", err)
+			return nil
+		}
+		if e.Type == events.UserDeleted {
+			x.idx.Delete(TypeUser, payload.UID)
+			return nil
+		}
+		return x.refreshUser(ctx, payload.UID)
+	}
+	return nil
+}
+
+// refreshPost ... Reads a post and indexes it, or removes it if it's gone or can't be shown yet
+func (x *Indexer) refreshPost(ctx context.Context, id string) error {
+	post, err := x.posts.GetPost(ctx, id)
+	if err == store.ErrNotFound {
+		x.RemovePost(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	x.PutPost(post)
+	return nil
+}
+
+// refreshUser ... Reads a user and indexes them, or removes them if they're gone
+func (x *Indexer) refreshUser(ctx context.Context, uid string) error {
+	user, err := x.users.GetUser(ctx, uid)
+	if err == store.ErrNotFound {
+		x.idx.Delete(TypeUser, uid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	x.PutUser(user)
+	return nil
+}
+
+// PutPost ... Indexes a post by its caption, hashtags and author, and counts it under its hashtags.
+// Posts that are still processing or failed aren't shown anywhere else, so they're left out.
+func (x *Indexer) PutPost(post models.Post) {
+	if !post.Ready() {
+		x.RemovePost(post.ID)
+		return
+	}
+
+	image := post.Variants.Thumbnail.URL
+	if image == "" {
+		image = post.ImageURL
+	}
+	source, _ := json.Marshal(PostHit{
+		ID:       post.ID,
+		UID:      post.UID,
+		Username: post.Username,
+		Caption:  post.Caption,
+		ImageURL: image,
+		Created:  post.Created,
+	})
+
+	tags := post.Hashtags()
+	before, _ := x.idx.Get(TypePost, post.ID)
+	x.idx.Put(Document{
+		Type:     TypePost,
+		ID:       post.ID,
+		Text:     post.Caption,
+		Keywords: append([]string{post.Username}, tags...),
+		Tags:     tags,
+		Rank:     float64(post.Created.UnixNano()),
+		Source:   source,
+	})
+	x.recount(before.Tags, tags)
+}
+
+// RemovePost ... Takes a post out of the index and off the counts of its hashtags
+func (x *Indexer) RemovePost(id string) {
+	before, ok := x.idx.Get(TypePost, id)
+	if !ok {
+		return
+	}
+	x.idx.Delete(TypePost, id)
+	x.recount(before.Tags)
+}
+
+// PutUser ... Indexes a user by their username and display name, the ones with more followers first
+func (x *Indexer) PutUser(user models.User) {
+	source, _ := json.Marshal(UserHit{
+		UID:         user.UID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		ProfilePic:  user.ProfilePic,
+	})
+
+	x.idx.Put(Document{
+		Type:     TypeUser,
+		ID:       user.UID,
+		Text:     user.DisplayName,
+		Keywords: []string{user.Username},
+		Rank:     float64(len(user.Followers)),
+		Source:   source,
+	})
+}
+
+// recount ... Updates the hashtags' documents with how many posts have them, removing the ones no
+// post has any more
+func (x *Indexer) recount(lists ...[]string) {
+	tags := []string{}
+	for _, list := range lists {
+		tags = append(tags, list...)
+	}
+
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		n := x.idx.Tagged(tag)
+		if n == 0 {
+			x.idx.Delete(TypeTag, tag)
+			continue
+		}
+
+		source, _ := json.Marshal(TagHit{Tag: tag, Posts: n})
+		x.idx.Put(Document{
+			Type:     TypeTag,
+			ID:       tag,
+			Keywords: []string{tag},
+			Rank:     float64(n),
+			Source:   source,
+		})
+	}
+}
+
+// String ... How many of each type of document are in the index, for logging
+func (x *Indexer) String() string {
+	return strconv.Itoa(x.idx.Len(TypePost)) + " posts, " +
+		strconv.Itoa(x.idx.Len(TypeUser)) + " users and " +
+		strconv.Itoa(x.idx.Len(TypeTag)) + " hashtags"
+}
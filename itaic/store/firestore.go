@@ -0,0 +1,1487 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// deleteBatch ... How many documents are deleted per write batch, Firestore allows up to 500
+const deleteBatch = 500
+
+// followChunk ... How many followed users' posts are queried at once when building a feed
+const followChunk = 10
+
+// Firestore ... Store backed by a Firestore client
+type Firestore struct {
+	client *firestore.Client
+}
+
+// NewFirestore ... Creates a store that reads and writes through the given client
+func NewFirestore(client *firestore.Client) *Firestore {
+	return &Firestore{client: client}
+}
+
+// ListPosts ... Gets a page of posts ordered by creation time, breaking ties by document id
+func (s *Firestore) ListPosts(ctx context.Context, q PostQuery) ([]models.Post, error) {
+	dir := firestore.Desc
+	if q.Ascending {
+		dir = firestore.Asc
+	}
+	if q.Tag != "" {
+		return s.listTagged(ctx, q, dir)
+	}
+
+	query := s.client.Collection("posts").OrderBy("created", dir).OrderBy(firestore.DocumentID, dir)
+	if q.After != nil {
+		query = query.StartAfter(q.After.Created, q.After.ID)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	posts := []models.Post{}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+
+	return posts, nil
+}
+
+// listTagged ... Gets a page of the posts tagged with q.Tag from the post_tags index, which is
+// ordered the same way as the posts
+func (s *Firestore) listTagged(ctx context.Context, q PostQuery, dir firestore.Direction) ([]models.Post, error) {
+	query := s.postTags().Where("tag", "==", q.Tag).OrderBy("created", dir).OrderBy("post_id", dir)
+	if q.After != nil {
+		query = query.StartAfter(q.After.Created, q.After.ID)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	refs := []*firestore.DocumentRef{}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := postTag{}
+		err = doc.DataTo(&entry)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, s.client.Collection("posts").Doc(entry.PostID))
+	}
+
+	posts := []models.Post{}
+	if len(refs) == 0 {
+		return posts, nil
+	}
+	docs, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// an entry outlives its post only until the delete that removes both is done
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// TrendingTags ... Counts the post_tags entries of posts created since since
+func (s *Firestore) TrendingTags(ctx context.Context, since time.Time, limit int) ([]TagCount, error) {
+	counts := map[string]int{}
+	iter := s.postTags().Where("created", ">=", since).Select("tag").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := postTag{}
+		err = doc.DataTo(&entry)
+		if err != nil {
+			return nil, err
+		}
+		counts[entry.Tag]++
+	}
+	return countTags(counts, limit), nil
+}
+
+// ListPostsByUsers ... Queries the newest posts of each user, followChunk users at a time. Once
+// limit posts have been found, the queries for later users only ask for posts at least as new as
+// the oldest of them, so following many users doesn't read all of their posts.
+func (s *Firestore) ListPostsByUsers(ctx context.Context, uids []string, limit int) ([]models.Post, error) {
+	posts := []models.Post{}
+	for start := 0; start < len(uids); start += followChunk {
+		end := start + followChunk
+		if end > len(uids) {
+			end = len(uids)
+		}
+
+		var since *time.Time
+		if limit > 0 && len(posts) == limit {
+			since = &posts[limit-1].Created
+		}
+
+		found := make([][]models.Post, end-start)
+		errs := make([]error, end-start)
+		wg := sync.WaitGroup{}
+		for i, uid := range uids[start:end] {
+			wg.Add(1)
+			go func(i int, uid string) {
+				defer wg.Done()
+				found[i], errs[i] = s.newestPosts(ctx, uid, since, limit)
+			}(i, uid)
+		}
+		wg.Wait()
+
+		for i := range found {
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			posts = append(posts, found[i]...)
+		}
+		posts = newest(posts, limit)
+	}
+	return posts, nil
+}
+
+// newestPosts ... Gets up to limit of uid's posts newest first, only those created at or after
+// since if it's set
+func (s *Firestore) newestPosts(ctx context.Context, uid string, since *time.Time, limit int) ([]models.Post, error) {
+	query := s.client.Collection("posts").Where("uid", "==", uid)
+	if since != nil {
+		query = query.Where("created", ">=", *since)
+	}
+	query = query.OrderBy("created", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	posts := []models.Post{}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// GetPost ... Gets a single post by its document id
+func (s *Firestore) GetPost(ctx context.Context, id string) (models.Post, error) {
+	post := models.Post{}
+	doc, err := s.client.Collection("posts").Doc(id).Get(ctx)
+	if err != nil {
+		return post, notFound(err)
+	}
+
+	err = doc.DataTo(&post)
+	return post, err
+}
+
+// NewPostID ... Picks the document id for a new post
+func (s *Firestore) NewPostID() string {
+	return s.client.Collection("posts").NewDoc().ID
+}
+
+// CreatePost ... Creates a new post document, adds it to the author's Posts and records the
+// outbox in one transaction. The post's id is set to the document id if it doesn't have one.
+func (s *Firestore) CreatePost(ctx context.Context, post models.Post, outbox ...events.Event) (models.Post, error) {
+	if post.ID == "" {
+		post.ID = s.NewPostID()
+	}
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		author, authorRef, err := s.txUser(tx, post.UID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		err = tx.Create(s.client.Collection("posts").Doc(post.ID), post)
+		if err != nil {
+			return err
+		}
+		err = s.tagPost(tx, post, nil)
+		if err != nil {
+			return err
+		}
+		if authorRef != nil {
+			author.Posts = append(author.Posts, post.ID)
+			err = tx.Set(authorRef, author)
+			if err != nil {
+				return err
+			}
+		}
+		return s.record(tx, outbox)
+	})
+	return post, err
+}
+
+// UpdatePost ... Overwrites an existing post, keeping the counts and image that are kept up to date elsewhere
+func (s *Firestore) UpdatePost(ctx context.Context, post models.Post, outbox ...events.Event) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := s.client.Collection("posts").Doc(post.ID)
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return notFound(err)
+		}
+
+		stored := models.Post{}
+		err = doc.DataTo(&stored)
+		if err != nil {
+			return err
+		}
+		post.Likes = stored.Likes
+		post.CommentCount = stored.CommentCount
+		keepImages(&post, stored)
+
+		err = tx.Set(ref, post)
+		if err != nil {
+			return err
+		}
+		err = s.tagPost(tx, post, stored.Hashtags())
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+}
+
+// FinishMedia ... Records the result of processing a post's image and the outbox in one
+// transaction, if the post is still processing
+func (s *Firestore) FinishMedia(ctx context.Context, id string, result MediaResult, outbox ...events.Event) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		post, ref, err := s.txPost(tx, id)
+		if err != nil {
+			return err
+		}
+		if post.Status != models.PostProcessing {
+			return nil
+		}
+
+		result.apply(&post)
+		err = tx.Set(ref, post)
+		if err != nil {
+			return err
+		}
+		err = s.tagPost(tx, post, post.Hashtags())
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+}
+
+// DeletePost ... Deletes a post document and takes it off the author's Posts in one transaction,
+// then deletes its comments and likes
+func (s *Firestore) DeletePost(ctx context.Context, id string, outbox ...events.Event) error {
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := s.client.Collection("posts").Doc(id)
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return notFound(err)
+		}
+
+		post := models.Post{}
+		err = doc.DataTo(&post)
+		if err != nil {
+			return err
+		}
+
+		author, authorRef, err := s.txUser(tx, post.UID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		err = tx.Delete(ref)
+		if err != nil {
+			return err
+		}
+		for _, tag := range post.Hashtags() {
+			err = tx.Delete(s.postTags().Doc(postTagID(id, tag)))
+			if err != nil {
+				return err
+			}
+		}
+		if authorRef != nil {
+			author.Posts, _ = without(author.Posts, id)
+			err = tx.Set(authorRef, author)
+			if err != nil {
+				return err
+			}
+		}
+		return s.record(tx, outbox)
+	})
+	if err != nil {
+		return err
+	}
+
+	// a post can have more comments and likes than fit in a transaction, and ones left behind
+	// are harmless since they can't be listed without the post
+	err = s.deleteDocs(ctx, s.comments(id).Query)
+	if err != nil {
+		return err
+	}
+	err = s.deleteDocs(ctx, s.userComments().Where("post_id", "==", id))
+	if err != nil {
+		return err
+	}
+	return s.deleteDocs(ctx, s.client.Collection("likes").Where("post_id", "==", id))
+}
+
+// ListComments ... Gets a page of a post's comments, or the replies to one, oldest first,
+// breaking ties by document id
+func (s *Firestore) ListComments(ctx context.Context, postID string, q CommentQuery) ([]models.Comment, error) {
+	_, err := s.client.Collection("posts").Doc(postID).Get(ctx)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	query := s.comments(postID).
+		Where("parent_id", "==", q.ParentID).
+		OrderBy("created", firestore.Asc).
+		OrderBy(firestore.DocumentID, firestore.Asc)
+	if q.After != nil {
+		query = query.StartAfter(q.After.Created, q.After.ID)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	comments := []models.Comment{}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		comment := models.Comment{}
+		err = doc.DataTo(&comment)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+
+	return comments, nil
+}
+
+// GetComment ... Gets a single comment from a post's comments subcollection
+func (s *Firestore) GetComment(ctx context.Context, postID, commentID string) (models.Comment, error) {
+	comment := models.Comment{}
+	doc, err := s.comments(postID).Doc(commentID).Get(ctx)
+	if err != nil {
+		return comment, notFound(err)
+	}
+
+	err = doc.DataTo(&comment)
+	return comment, err
+}
+
+// NewCommentID ... Picks the document id for a new comment on a post
+func (s *Firestore) NewCommentID(postID string) string {
+	return s.comments(postID).NewDoc().ID
+}
+
+// AddComment ... Creates the comment document and counts it on the post and its parent in one
+// transaction. The comment's id is set to the document id if it doesn't have one.
+func (s *Firestore) AddComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) (models.Comment, error) {
+	if comment.ID == "" {
+		comment.ID = s.NewCommentID(postID)
+	}
+	comment.PostID = postID
+
+	added := comment
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		added = comment
+		post, postRef, err := s.txPost(tx, postID)
+		if err != nil {
+			return err
+		}
+
+		var parent models.Comment
+		var parentRef *firestore.DocumentRef
+		if added.ParentID != "" {
+			parent, parentRef, err = s.txComment(tx, postID, added.ParentID)
+			if err == nil && parent.ParentID != "" {
+				parent, parentRef, err = s.txComment(tx, postID, parent.ParentID)
+			}
+			if err != nil {
+				return err
+			}
+			added.ParentID = parent.ID
+		}
+
+		err = tx.Create(s.comments(postID).Doc(added.ID), added)
+		if err != nil {
+			return err
+		}
+		err = tx.Set(s.userComments().Doc(userCommentID(postID, added.ID)), userComment{
+			UID:       added.UID,
+			PostID:    postID,
+			CommentID: added.ID,
+			Created:   added.Created,
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Update(postRef, []firestore.Update{{Path: "comment_count", Value: post.CommentCount + 1}})
+		if err != nil {
+			return err
+		}
+		if parentRef != nil {
+			err = tx.Update(parentRef, []firestore.Update{{Path: "reply_count", Value: parent.ReplyCount + 1}})
+			if err != nil {
+				return err
+			}
+		}
+		return s.record(tx, outbox)
+	})
+	return added, err
+}
+
+// UpdateComment ... Overwrites a comment, keeping its place in the thread and its counts
+func (s *Firestore) UpdateComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		stored, ref, err := s.txComment(tx, postID, comment.ID)
+		if err != nil {
+			return err
+		}
+
+		comment.PostID = stored.PostID
+		comment.ParentID = stored.ParentID
+		comment.Likes = stored.Likes
+		comment.ReplyCount = stored.ReplyCount
+		err = tx.Set(ref, comment)
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+}
+
+// DeleteComment ... Deletes a comment and its replies and takes them off the counts in one
+// transaction, then deletes their likes
+func (s *Firestore) DeleteComment(ctx context.Context, postID, commentID string, outbox ...events.Event) error {
+	deleted := []string{}
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		post, postRef, err := s.txPost(tx, postID)
+		if err != nil {
+			return err
+		}
+
+		comment, ref, err := s.txComment(tx, postID, commentID)
+		if err != nil {
+			return err
+		}
+
+		var parent models.Comment
+		var parentRef *firestore.DocumentRef
+		if comment.ParentID != "" {
+			parent, parentRef, err = s.txComment(tx, postID, comment.ParentID)
+			if err == ErrNotFound {
+				parentRef = nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		refs := []*firestore.DocumentRef{ref}
+		iter := tx.Documents(s.comments(postID).Where("parent_id", "==", commentID))
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return err
+			}
+			refs = append(refs, doc.Ref)
+		}
+		iter.Stop()
+
+		deleted = []string{}
+		for _, r := range refs {
+			err = tx.Delete(r)
+			if err != nil {
+				return err
+			}
+			err = tx.Delete(s.userComments().Doc(userCommentID(postID, r.ID)))
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, r.ID)
+		}
+		err = tx.Update(postRef, []firestore.Update{{Path: "comment_count", Value: uncount(post.CommentCount, len(refs))}})
+		if err != nil {
+			return err
+		}
+		if parentRef != nil {
+			err = tx.Update(parentRef, []firestore.Update{{Path: "reply_count", Value: uncount(parent.ReplyCount, 1)}})
+			if err != nil {
+				return err
+			}
+		}
+		return s.record(tx, outbox)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range deleted {
+		err = s.deleteDocs(ctx, s.client.Collection("likes").Where("post_id", "==", postID).Where("comment_id", "==", id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UserComments ... Gets up to limit of the comments uid has written from the user_comments index,
+// deleting the index entries, and any comments, left behind on posts that are gone
+func (s *Firestore) UserComments(ctx context.Context, uid string, limit int) ([]models.Comment, error) {
+	for {
+		entries := []*firestore.DocumentSnapshot{}
+		iter := limited(s.userComments().Where("uid", "==", uid), limit).Documents(ctx)
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return nil, err
+			}
+			entries = append(entries, doc)
+		}
+		iter.Stop()
+		if len(entries) == 0 {
+			return []models.Comment{}, nil
+		}
+
+		// read each comment along with its post to tell which ones are left behind
+		refs := []*firestore.DocumentRef{}
+		for _, doc := range entries {
+			entry := userComment{}
+			err := doc.DataTo(&entry)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, s.comments(entry.PostID).Doc(entry.CommentID), s.client.Collection("posts").Doc(entry.PostID))
+		}
+		docs, err := s.client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, err
+		}
+
+		comments := []models.Comment{}
+		batch := s.client.Batch()
+		stale := 0
+		for i, entry := range entries {
+			comment, post := docs[2*i], docs[2*i+1]
+			if comment.Exists() && post.Exists() {
+				c := models.Comment{}
+				err = comment.DataTo(&c)
+				if err != nil {
+					return nil, err
+				}
+				comments = append(comments, c)
+				continue
+			}
+
+			batch.Delete(entry.Ref)
+			if comment.Exists() {
+				batch.Delete(comment.Ref)
+			}
+			stale++
+		}
+		if stale > 0 {
+			_, err = batch.Commit(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(comments) > 0 {
+			return comments, nil
+		}
+	}
+}
+
+// limited ... Limits q to limit documents, or leaves it to get them all if limit is 0
+func limited(q firestore.Query, limit int) firestore.Query {
+	if limit > 0 {
+		return q.Limit(limit)
+	}
+	return q
+}
+
+// Like ... Creates uid's like document for target and counts it in one transaction, unless it's
+// already there
+func (s *Firestore) Like(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error) {
+	return s.updateLike(ctx, uid, target, outbox, true)
+}
+
+// Unlike ... Deletes uid's like document for target and takes it off the count in one transaction
+func (s *Firestore) Unlike(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error) {
+	return s.updateLike(ctx, uid, target, outbox, false)
+}
+
+// DeleteLike ... Deletes uid's like document for target
+func (s *Firestore) DeleteLike(ctx context.Context, uid string, target LikeTarget) error {
+	_, err := s.client.Collection("likes").Doc(LikeID(uid, target)).Delete(ctx)
+	return err
+}
+
+// ListLikes ... Gets a page of the likes on target, newest first, breaking ties by document id
+func (s *Firestore) ListLikes(ctx context.Context, target LikeTarget, q LikeQuery) ([]models.Like, error) {
+	_, err := s.client.Collection("posts").Doc(target.PostID).Get(ctx)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if target.CommentID != "" {
+		_, err = s.GetComment(ctx, target.PostID, target.CommentID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := s.client.Collection("likes").
+		Where("post_id", "==", target.PostID).
+		Where("comment_id", "==", target.CommentID).
+		OrderBy("created", firestore.Desc).
+		OrderBy(firestore.DocumentID, firestore.Desc)
+	if q.After != nil {
+		query = query.StartAfter(q.After.Created, LikeID(q.After.UID, target))
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	likes := []models.Like{}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		like := models.Like{}
+		err = doc.DataTo(&like)
+		if err != nil {
+			return nil, err
+		}
+		likes = append(likes, like)
+	}
+
+	return likes, nil
+}
+
+// UserLikes ... Gets up to limit of uid's likes, deleting any left behind on posts or comments
+// that are gone
+func (s *Firestore) UserLikes(ctx context.Context, uid string, limit int) ([]models.Like, error) {
+	for {
+		found := []*firestore.DocumentSnapshot{}
+		iter := limited(s.client.Collection("likes").Where("uid", "==", uid), limit).Documents(ctx)
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return nil, err
+			}
+			found = append(found, doc)
+		}
+		iter.Stop()
+		if len(found) == 0 {
+			return []models.Like{}, nil
+		}
+
+		// read what each like is for to tell which ones are left behind
+		all := []models.Like{}
+		refs := []*firestore.DocumentRef{}
+		for _, doc := range found {
+			like := models.Like{}
+			err := doc.DataTo(&like)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, like)
+			if like.CommentID != "" {
+				refs = append(refs, s.comments(like.PostID).Doc(like.CommentID))
+			} else {
+				refs = append(refs, s.client.Collection("posts").Doc(like.PostID))
+			}
+		}
+		targets, err := s.client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, err
+		}
+
+		likes := []models.Like{}
+		batch := s.client.Batch()
+		stale := 0
+		for i, target := range targets {
+			if target.Exists() {
+				likes = append(likes, all[i])
+				continue
+			}
+			batch.Delete(found[i].Ref)
+			stale++
+		}
+		if stale > 0 {
+			_, err = batch.Commit(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(likes) > 0 {
+			return likes, nil
+		}
+	}
+}
+
+// updateLike ... Reads the post or comment, the user and their like document for target, then
+// writes all three with the outbox in one transaction if the like changes. Firestore retries the
+// transaction if another like lands first, so no like is lost from the count.
+func (s *Firestore) updateLike(ctx context.Context, uid string, target LikeTarget, outbox []events.Event, liked bool) (int, error) {
+	count := 0
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		post, ref, err := s.txPost(tx, target.PostID)
+		if err != nil {
+			return err
+		}
+		count = post.Likes
+		if target.CommentID != "" {
+			comment := models.Comment{}
+			comment, ref, err = s.txComment(tx, target.PostID, target.CommentID)
+			if err != nil {
+				return err
+			}
+			count = comment.Likes
+		}
+
+		user, userRef, err := s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+
+		likeRef := s.client.Collection("likes").Doc(LikeID(uid, target))
+		_, err = tx.Get(likeRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		list, id := likeList(&user, target)
+		if !applyLike(&count, list, id, err == nil, liked) {
+			return nil
+		}
+
+		if liked {
+			err = tx.Create(likeRef, models.Like{UID: uid, PostID: target.PostID, CommentID: target.CommentID, Created: time.Now().UTC()})
+		} else {
+			err = tx.Delete(likeRef)
+		}
+		if err != nil {
+			return err
+		}
+
+		// only the count and the user's likes change, so leave the rest of each document alone
+		err = tx.Update(ref, []firestore.Update{{Path: "likes", Value: count}})
+		if err != nil {
+			return err
+		}
+		field := "likes"
+		if target.CommentID != "" {
+			field = "comment_likes"
+		}
+		err = tx.Update(userRef, []firestore.Update{{Path: field, Value: *list}})
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+
+	return count, err
+}
+
+// deleteDocs ... Deletes every document the query matches, a batch at a time
+func (s *Firestore) deleteDocs(ctx context.Context, query firestore.Query) error {
+	for {
+		refs := []*firestore.DocumentRef{}
+		iter := query.Limit(deleteBatch).Documents(ctx)
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return err
+			}
+			refs = append(refs, doc.Ref)
+		}
+		iter.Stop()
+		if len(refs) == 0 {
+			return nil
+		}
+
+		batch := s.client.Batch()
+		for _, ref := range refs {
+			batch.Delete(ref)
+		}
+		_, err := batch.Commit(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetUser ... Gets the user with the given auth uid
+func (s *Firestore) GetUser(ctx context.Context, uid string) (models.User, error) {
+	user := models.User{}
+	iter := s.client.Collection("users").Where("uid", "==", uid).Limit(1).Documents(ctx)
+	defer iter.Stop()
+
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	err = doc.DataTo(&user)
+	return user, err
+}
+
+// CreateUser ... Creates a new user document and sets the user's id to the document id, reserving
+// their username in the same transaction
+func (s *Firestore) CreateUser(ctx context.Context, user models.User, outbox ...events.Event) (models.User, error) {
+	doc := s.client.Collection("users").NewDoc()
+	user.ID = doc.ID
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		owner, err := s.reservedBy(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != user.UID {
+			return ErrUsernameTaken
+		}
+
+		err = tx.Set(s.usernames().Doc(UsernameKey(user.Username)), usernameRecord{UID: user.UID, Username: user.Username})
+		if err != nil {
+			return err
+		}
+		err = tx.Create(doc, user)
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+	return user, err
+}
+
+// UpdateProfile ... Writes only the fields being changed, in a transaction with reading the user
+// they're changed on
+func (s *Firestore) UpdateProfile(ctx context.Context, uid string, update ProfileUpdate, outbox ...events.Event) (models.User, models.User, error) {
+	before, after := models.User{}, models.User{}
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		user, ref, err := s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		before, after = user, user
+		update.apply(&after)
+
+		fields := []firestore.Update{}
+		if update.Bio != nil {
+			fields = append(fields, firestore.Update{Path: "bio", Value: after.Bio})
+		}
+		if update.DisplayName != nil {
+			fields = append(fields, firestore.Update{Path: "display_name", Value: after.DisplayName})
+		}
+		if update.ProfilePic != nil {
+			fields = append(fields, firestore.Update{Path: "profile_pic", Value: after.ProfilePic})
+		}
+		if len(fields) > 0 {
+			err = tx.Update(ref, fields)
+			if err != nil {
+				return err
+			}
+		}
+		return s.record(tx, outbox)
+	})
+	return before, after, err
+}
+
+// RenameUser ... Swaps the user's username reservation for the new one and changes their username
+// in one transaction
+func (s *Firestore) RenameUser(ctx context.Context, uid, username string, outbox ...events.Event) (models.User, error) {
+	renamed := models.User{}
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		user, ref, err := s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		renamed = user
+		if user.Username == username {
+			return nil
+		}
+
+		// every read has to come before the first write
+		owner, err := s.reservedBy(tx, username)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != uid {
+			return ErrUsernameTaken
+		}
+		oldOwner, err := s.reservedBy(tx, user.Username)
+		if err != nil {
+			return err
+		}
+
+		if oldOwner == uid && UsernameKey(user.Username) != UsernameKey(username) {
+			err = tx.Delete(s.usernames().Doc(UsernameKey(user.Username)))
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Set(s.usernames().Doc(UsernameKey(username)), usernameRecord{UID: uid, Username: username})
+		if err != nil {
+			return err
+		}
+
+		user.Username = username
+		err = tx.Set(ref, user)
+		if err != nil {
+			return err
+		}
+		renamed = user
+		return s.record(tx, outbox)
+	})
+	return renamed, err
+}
+
+// DeleteUser ... Deletes the user and their username reservation in one transaction
+func (s *Firestore) DeleteUser(ctx context.Context, uid string, outbox ...events.Event) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		user, ref, err := s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		owner, err := s.reservedBy(tx, user.Username)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(ref)
+		if err != nil {
+			return err
+		}
+		if owner == uid {
+			err = tx.Delete(s.usernames().Doc(UsernameKey(user.Username)))
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Delete(s.client.Collection("exports").Doc(uid))
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+}
+
+// RequestDeletion ... Creates the deletion document for the user's account in the same
+// transaction as the outbox, unless there already is one
+func (s *Firestore) RequestDeletion(ctx context.Context, uid string, outbox ...events.Event) (models.Deletion, error) {
+	deletion := models.Deletion{}
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := s.client.Collection("deletions").Doc(uid)
+		doc, err := tx.Get(ref)
+		if err == nil {
+			return doc.DataTo(&deletion)
+		}
+		if notFound(err) != ErrNotFound {
+			return err
+		}
+
+		_, _, err = s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+
+		deletion = newDeletion(uid)
+		err = tx.Create(ref, deletion)
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+	return deletion, err
+}
+
+// GetDeletion ... Gets the deletion document for the user's account
+func (s *Firestore) GetDeletion(ctx context.Context, uid string) (models.Deletion, error) {
+	deletion := models.Deletion{}
+	doc, err := s.client.Collection("deletions").Doc(uid).Get(ctx)
+	if err != nil {
+		return deletion, notFound(err)
+	}
+
+	err = doc.DataTo(&deletion)
+	return deletion, err
+}
+
+// UpdateDeletion ... Overwrites the deletion document for the user's account
+func (s *Firestore) UpdateDeletion(ctx context.Context, deletion models.Deletion) error {
+	_, err := s.client.Collection("deletions").Doc(deletion.UID).Set(ctx, deletion)
+	return err
+}
+
+// RequestExport ... Replaces the export document for the user in the same transaction as the
+// outbox, unless the one there is still being built
+func (s *Firestore) RequestExport(ctx context.Context, uid string, outbox ...events.Event) (models.Export, error) {
+	export := models.Export{}
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := s.client.Collection("exports").Doc(uid)
+		last := models.Export{}
+		doc, err := tx.Get(ref)
+		if err == nil {
+			err = doc.DataTo(&last)
+			if err != nil {
+				return err
+			}
+			if building(last) {
+				export = last
+				return nil
+			}
+		} else if notFound(err) != ErrNotFound {
+			return err
+		}
+
+		_, _, err = s.txUser(tx, uid)
+		if err != nil {
+			return err
+		}
+
+		export = newExport(uid, last)
+		err = tx.Set(ref, export)
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+	return export, err
+}
+
+// GetExport ... Gets the export document for the user
+func (s *Firestore) GetExport(ctx context.Context, uid string) (models.Export, error) {
+	export := models.Export{}
+	doc, err := s.client.Collection("exports").Doc(uid).Get(ctx)
+	if err != nil {
+		return export, notFound(err)
+	}
+
+	err = doc.DataTo(&export)
+	return export, err
+}
+
+// UpdateExport ... Overwrites the export document for the user
+func (s *Firestore) UpdateExport(ctx context.Context, export models.Export) error {
+	_, err := s.client.Collection("exports").Doc(export.UID).Set(ctx, export)
+	return err
+}
+
+// usernameRecord ... How a username reservation is kept in the usernames collection, keyed by
+// UsernameKey so no two users can hold the same one
+type usernameRecord struct {
+	UID      string `firestore:"uid"`
+	Username string `firestore:"username"`
+}
+
+// usernames ... The collection username reservations are kept in
+func (s *Firestore) usernames() *firestore.CollectionRef {
+	return s.client.Collection("usernames")
+}
+
+// reservedBy ... Gets the uid username is reserved for inside a transaction, empty if it's free
+func (s *Firestore) reservedBy(tx *firestore.Transaction, username string) (string, error) {
+	doc, err := tx.Get(s.usernames().Doc(UsernameKey(username)))
+	if notFound(err) == ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	reservation := usernameRecord{}
+	err = doc.DataTo(&reservation)
+	return reservation.UID, err
+}
+
+// LookupUsernames ... Reads the reservations of the usernames all at once
+func (s *Firestore) LookupUsernames(ctx context.Context, usernames []string) (map[string]string, error) {
+	owners := map[string]string{}
+	refs := []*firestore.DocumentRef{}
+	seen := map[string]bool{}
+	for _, username := range usernames {
+		key := UsernameKey(username)
+		if !seen[key] {
+			seen[key] = true
+			refs = append(refs, s.usernames().Doc(key))
+		}
+	}
+	if len(refs) == 0 {
+		return owners, nil
+	}
+
+	docs, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		reservation := usernameRecord{}
+		err = doc.DataTo(&reservation)
+		if err != nil {
+			return nil, err
+		}
+		owners[doc.Ref.ID] = reservation.UID
+	}
+	return owners, nil
+}
+
+// GetUsers ... Gets the users with the given uids in the same order, skipping any that don't exist
+func (s *Firestore) GetUsers(ctx context.Context, uids []string) ([]models.User, error) {
+	users := []models.User{}
+	for _, uid := range uids {
+		user, err := s.GetUser(ctx, uid)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Follow ... Updates both users in one transaction so the edge is never half written
+func (s *Firestore) Follow(ctx context.Context, follower, followee string, outbox ...events.Event) error {
+	return s.updateUsers(ctx, follower, followee, outbox, follow)
+}
+
+// Unfollow ... Removes the edge from both users in one transaction
+func (s *Firestore) Unfollow(ctx context.Context, follower, followee string, outbox ...events.Event) error {
+	return s.updateUsers(ctx, follower, followee, outbox, unfollow)
+}
+
+// updateUsers ... Reads two users, applies fn and writes them back with the outbox in one
+// transaction if fn changed them
+func (s *Firestore) updateUsers(ctx context.Context, a, b string, outbox []events.Event, fn func(a, b *models.User) bool) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		userA, refA, err := s.txUser(tx, a)
+		if err != nil {
+			return err
+		}
+
+		userB, refB, err := s.txUser(tx, b)
+		if err != nil {
+			return err
+		}
+
+		if !fn(&userA, &userB) {
+			return nil
+		}
+
+		err = tx.Set(refA, userA)
+		if err != nil {
+			return err
+		}
+		err = tx.Set(refB, userB)
+		if err != nil {
+			return err
+		}
+		return s.record(tx, outbox)
+	})
+}
+
+// txUser ... Looks up a user by uid inside a transaction
+func (s *Firestore) txUser(tx *firestore.Transaction, uid string) (models.User, *firestore.DocumentRef, error) {
+	user := models.User{}
+	iter := tx.Documents(s.client.Collection("users").Where("uid", "==", uid).Limit(1))
+	defer iter.Stop()
+
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return user, nil, ErrNotFound
+	}
+	if err != nil {
+		return user, nil, err
+	}
+
+	err = doc.DataTo(&user)
+	return user, doc.Ref, err
+}
+
+// txPost ... Gets a post inside a transaction
+func (s *Firestore) txPost(tx *firestore.Transaction, id string) (models.Post, *firestore.DocumentRef, error) {
+	post := models.Post{}
+	ref := s.client.Collection("posts").Doc(id)
+	doc, err := tx.Get(ref)
+	if err != nil {
+		return post, ref, notFound(err)
+	}
+
+	err = doc.DataTo(&post)
+	return post, ref, err
+}
+
+// txComment ... Gets a comment inside a transaction
+func (s *Firestore) txComment(tx *firestore.Transaction, postID, id string) (models.Comment, *firestore.DocumentRef, error) {
+	comment := models.Comment{}
+	ref := s.comments(postID).Doc(id)
+	doc, err := tx.Get(ref)
+	if err != nil {
+		return comment, ref, notFound(err)
+	}
+
+	err = doc.DataTo(&comment)
+	return comment, ref, err
+}
+
+// userComment ... An entry in the user_comments index, which finds the comments a user has written
+// on any post, since they're kept under each post
+type userComment struct {
+	UID       string    `firestore:"uid"`
+	PostID    string    `firestore:"post_id"`
+	CommentID string    `firestore:"comment_id"`
+	Created   time.Time `firestore:"created"`
+}
+
+// userComments ... The collection the user_comments index is kept in
+func (s *Firestore) userComments() *firestore.CollectionRef {
+	return s.client.Collection("user_comments")
+}
+
+// userCommentID ... The document id of a comment's entry in the user_comments index
+func userCommentID(postID, commentID string) string {
+	return postID + "_" + commentID
+}
+
+// postTag ... An entry in the post_tags index, which finds the posts with a hashtag and counts
+// how often each one is used
+type postTag struct {
+	Tag     string    `firestore:"tag"`
+	PostID  string    `firestore:"post_id"`
+	UID     string    `firestore:"uid"`
+	Created time.Time `firestore:"created"`
+}
+
+// postTags ... The collection the post_tags index is kept in
+func (s *Firestore) postTags() *firestore.CollectionRef {
+	return s.client.Collection("post_tags")
+}
+
+// postTagID ... The document id of a post's entry for tag in the post_tags index
+func postTagID(postID, tag string) string {
+	return postID + "_" + tag
+}
+
+// tagPost ... Brings the post's entries in the post_tags index in line with its caption inside a
+// transaction, given the tags it had before. Posts aren't shown until their images are ready, so
+// until then they have no entries and don't count towards trending tags.
+func (s *Firestore) tagPost(tx *firestore.Transaction, post models.Post, before []string) error {
+	tags := post.Hashtags()
+	if !post.Ready() {
+		tags = nil
+	}
+
+	keep := map[string]bool{}
+	for _, tag := range tags {
+		keep[tag] = true
+		err := tx.Set(s.postTags().Doc(postTagID(post.ID, tag)), postTag{
+			Tag:     tag,
+			PostID:  post.ID,
+			UID:     post.UID,
+			Created: post.Created,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range before {
+		if !keep[tag] {
+			err := tx.Delete(s.postTags().Doc(postTagID(post.ID, tag)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// comments ... The subcollection a post's comments are kept in
+func (s *Firestore) comments(postID string) *firestore.CollectionRef {
+	return s.client.Collection("posts").Doc(postID).Collection("comments")
+}
+
+// outboxRecord ... How an event is kept in the outbox collection until the relay sends it
+type outboxRecord struct {
+	ID         string    `firestore:"id"`
+	Type       string    `firestore:"type"`
+	Version    int       `firestore:"version"`
+	OccurredAt time.Time `firestore:"occurred_at"`
+	Actor      string    `firestore:"actor"`
+	Payload    string    `firestore:"payload"`
+	Sent       bool      `firestore:"sent"`
+}
+
+// record ... Adds events to the outbox collection as part of tx, keyed by event id
+func (s *Firestore) record(tx *firestore.Transaction, outbox []events.Event) error {
+	for _, e := range outbox {
+		err := tx.Create(s.client.Collection("outbox").Doc(e.ID), outboxRecord{
+			ID:         e.ID,
+			Type:       e.Type,
+			Version:    e.Version,
+			OccurredAt: e.OccurredAt,
+			Actor:      e.Actor,
+			Payload:    string(e.Payload),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingEvents ... Gets up to limit unsent events, oldest first
+func (s *Firestore) PendingEvents(ctx context.Context, limit int) ([]events.Event, error) {
+	pending := []events.Event{}
+	iter := s.client.Collection("outbox").Where("sent", "==", false).OrderBy("occurred_at", firestore.Asc).Limit(limit).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := outboxRecord{}
+		err = doc.DataTo(&record)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, events.Event{
+			ID:         record.ID,
+			Type:       record.Type,
+			Version:    record.Version,
+			OccurredAt: record.OccurredAt,
+			Actor:      record.Actor,
+			Payload:    json.RawMessage(record.Payload),
+		})
+	}
+	return pending, nil
+}
+
+// MarkSent ... Flags the events with the given ids as published
+func (s *Firestore) MarkSent(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	batch := s.client.Batch()
+	for _, id := range ids {
+		batch.Update(s.client.Collection("outbox").Doc(id), []firestore.Update{
+			{Path: "sent", Value: true},
+			{Path: "sent_at", Value: time.Now().UTC()},
+		})
+	}
+	_, err := batch.Commit(ctx)
+	return err
+}
+
+// notFound ... Translates Firestore's not found error into ErrNotFound
+func notFound(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
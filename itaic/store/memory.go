@@ -0,0 +1,806 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// Memory ... Store that keeps everything in process, used for running the API offline and in tests
+type Memory struct {
+	mu    sync.RWMutex
+	posts map[string]models.Post
+	// comments ... Each post's comments by id
+	comments map[string]map[string]models.Comment
+	users    map[string]models.User
+	// usernames ... The uid each reserved username belongs to, by UsernameKey
+	usernames map[string]string
+	likes     map[string]models.Like
+	// deletions ... Accounts being deleted, by uid
+	deletions map[string]models.Deletion
+	exports   map[string]models.Export
+	outbox    []outboxEntry
+}
+
+type outboxEntry struct {
+	event events.Event
+	sent  bool
+}
+
+// NewMemory ... Creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		posts:     map[string]models.Post{},
+		comments:  map[string]map[string]models.Comment{},
+		users:     map[string]models.User{},
+		usernames: map[string]string{},
+		likes:     map[string]models.Like{},
+		deletions: map[string]models.Deletion{},
+		exports:   map[string]models.Export{},
+	}
+}
+
+// ListPosts ... Gets a page of posts ordered the same way the Firestore query orders them
+func (s *Memory) ListPosts(ctx context.Context, q PostQuery) ([]models.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// before reports whether a comes first in the requested order
+	before := func(a, b PostCursor) bool {
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created) == q.Ascending
+		}
+		if a.ID != b.ID {
+			return (a.ID < b.ID) == q.Ascending
+		}
+		return false
+	}
+
+	posts := []models.Post{}
+	for _, post := range s.posts {
+		if q.After != nil && !before(*q.After, PostCursor{Created: post.Created, ID: post.ID}) {
+			continue
+		}
+		if q.Tag != "" && !hasTag(post, q.Tag) {
+			continue
+		}
+		posts = append(posts, post)
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		return before(PostCursor{posts[i].Created, posts[i].ID}, PostCursor{posts[j].Created, posts[j].ID})
+	})
+	if q.Limit > 0 && len(posts) > q.Limit {
+		posts = posts[:q.Limit]
+	}
+	return posts, nil
+}
+
+// TrendingTags ... Counts the hashtags on every ready post created since since
+func (s *Memory) TrendingTags(ctx context.Context, since time.Time, limit int) ([]TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, post := range s.posts {
+		if post.Created.Before(since) || !post.Ready() {
+			continue
+		}
+		for _, tag := range post.Hashtags() {
+			counts[tag]++
+		}
+	}
+	return countTags(counts, limit), nil
+}
+
+// ListPostsByUsers ... Gets the newest posts written by any of the given users
+func (s *Memory) ListPostsByUsers(ctx context.Context, uids []string, limit int) ([]models.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := []models.Post{}
+	for _, post := range s.posts {
+		for _, uid := range uids {
+			if post.UID == uid {
+				posts = append(posts, post)
+				break
+			}
+		}
+	}
+	return newest(posts, limit), nil
+}
+
+// GetPost ... Gets a single post by id
+func (s *Memory) GetPost(ctx context.Context, id string) (models.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return models.Post{}, ErrNotFound
+	}
+	return post, nil
+}
+
+// NewPostID ... Generates an id for a new post
+func (s *Memory) NewPostID() string {
+	return newID()
+}
+
+// CreatePost ... Stores a new post, under a generated id if it doesn't have one, and adds it to
+// the author's Posts if the author exists
+func (s *Memory) CreatePost(ctx context.Context, post models.Post, outbox ...events.Event) (models.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if post.ID == "" {
+		post.ID = newID()
+	}
+	s.posts[post.ID] = post
+	if author, ok := s.users[post.UID]; ok {
+		author = copyUser(author)
+		author.Posts = append(author.Posts, post.ID)
+		s.users[author.UID] = author
+	}
+	s.record(outbox)
+	return post, nil
+}
+
+// UpdatePost ... Overwrites an existing post, keeping the counts and image that are kept up to date elsewhere
+func (s *Memory) UpdatePost(ctx context.Context, post models.Post, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.posts[post.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	post.Likes = stored.Likes
+	post.CommentCount = stored.CommentCount
+	keepImages(&post, stored)
+	s.posts[post.ID] = post
+	s.record(outbox)
+	return nil
+}
+
+// FinishMedia ... Records the result of processing a post's image if it's still processing
+func (s *Memory) FinishMedia(ctx context.Context, id string, result MediaResult, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if post.Status != models.PostProcessing {
+		return nil
+	}
+	result.apply(&post)
+	s.posts[id] = post
+	s.record(outbox)
+	return nil
+}
+
+// DeletePost ... Deletes a post, its comments and likes, and takes it off the author's Posts
+func (s *Memory) DeletePost(ctx context.Context, id string, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.posts, id)
+	delete(s.comments, id)
+	for key, like := range s.likes {
+		if like.PostID == id {
+			delete(s.likes, key)
+		}
+	}
+	if author, ok := s.users[post.UID]; ok {
+		author = copyUser(author)
+		author.Posts, _ = without(author.Posts, id)
+		s.users[author.UID] = author
+	}
+	s.record(outbox)
+	return nil
+}
+
+// ListComments ... Gets a page of comments ordered the same way the Firestore query orders them
+func (s *Memory) ListComments(ctx context.Context, postID string, q CommentQuery) ([]models.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.posts[postID]; !ok {
+		return nil, ErrNotFound
+	}
+
+	// before reports whether a comes first, oldest first then by id
+	before := func(a, b CommentCursor) bool {
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+		return a.ID < b.ID
+	}
+
+	comments := []models.Comment{}
+	for _, comment := range s.comments[postID] {
+		if comment.ParentID != q.ParentID {
+			continue
+		}
+		if q.After != nil && !before(*q.After, CommentCursor{Created: comment.Created, ID: comment.ID}) {
+			continue
+		}
+		comments = append(comments, comment)
+	}
+
+	sort.Slice(comments, func(i, j int) bool {
+		return before(CommentCursor{comments[i].Created, comments[i].ID}, CommentCursor{comments[j].Created, comments[j].ID})
+	})
+	if q.Limit > 0 && len(comments) > q.Limit {
+		comments = comments[:q.Limit]
+	}
+	return comments, nil
+}
+
+// GetComment ... Gets a single comment from a post
+func (s *Memory) GetComment(ctx context.Context, postID, commentID string) (models.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comment, ok := s.comments[postID][commentID]
+	if !ok {
+		return models.Comment{}, ErrNotFound
+	}
+	return comment, nil
+}
+
+// NewCommentID ... Generates an id for a new comment
+func (s *Memory) NewCommentID(postID string) string {
+	return newID()
+}
+
+// AddComment ... Stores a comment, under a generated id if it doesn't have one, and counts it on
+// the post and its parent
+func (s *Memory) AddComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) (models.Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[postID]
+	if !ok {
+		return comment, ErrNotFound
+	}
+
+	if comment.ParentID != "" {
+		parent, ok := s.comments[postID][comment.ParentID]
+		if !ok {
+			return comment, ErrNotFound
+		}
+		if parent.ParentID != "" {
+			parent = s.comments[postID][parent.ParentID]
+		}
+		parent.ReplyCount++
+		comment.ParentID = parent.ID
+		s.comments[postID][parent.ID] = parent
+	}
+
+	if comment.ID == "" {
+		comment.ID = newID()
+	}
+	comment.PostID = postID
+	if s.comments[postID] == nil {
+		s.comments[postID] = map[string]models.Comment{}
+	}
+	s.comments[postID][comment.ID] = comment
+	post.CommentCount++
+	s.posts[postID] = post
+	s.record(outbox)
+	return comment, nil
+}
+
+// UpdateComment ... Overwrites a comment, keeping its place in the thread and its counts
+func (s *Memory) UpdateComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[postID][comment.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	comment.PostID = stored.PostID
+	comment.ParentID = stored.ParentID
+	comment.Likes = stored.Likes
+	comment.ReplyCount = stored.ReplyCount
+	s.comments[postID][comment.ID] = comment
+	s.record(outbox)
+	return nil
+}
+
+// DeleteComment ... Deletes a comment, its replies and their likes, and takes them off the counts
+func (s *Memory) DeleteComment(ctx context.Context, postID, commentID string, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comment, ok := s.comments[postID][commentID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	deleted := []string{commentID}
+	for id, reply := range s.comments[postID] {
+		if reply.ParentID == commentID {
+			deleted = append(deleted, id)
+		}
+	}
+	for _, id := range deleted {
+		delete(s.comments[postID], id)
+	}
+	for key, like := range s.likes {
+		if like.PostID == postID && contains(deleted, like.CommentID) {
+			delete(s.likes, key)
+		}
+	}
+
+	if parent, ok := s.comments[postID][comment.ParentID]; ok {
+		parent.ReplyCount = uncount(parent.ReplyCount, 1)
+		s.comments[postID][parent.ID] = parent
+	}
+	post := s.posts[postID]
+	post.CommentCount = uncount(post.CommentCount, len(deleted))
+	s.posts[postID] = post
+	s.record(outbox)
+	return nil
+}
+
+// UserComments ... Gets up to limit of the comments uid has written, in a fixed order
+func (s *Memory) UserComments(ctx context.Context, uid string, limit int) ([]models.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []models.Comment{}
+	for _, byID := range s.comments {
+		for _, comment := range byID {
+			if comment.UID == uid {
+				comments = append(comments, comment)
+			}
+		}
+	}
+
+	sort.Slice(comments, func(i, j int) bool {
+		if comments[i].PostID != comments[j].PostID {
+			return comments[i].PostID < comments[j].PostID
+		}
+		return comments[i].ID < comments[j].ID
+	})
+	if limit > 0 && len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, nil
+}
+
+// Like ... Records uid's like of target if it isn't there already
+func (s *Memory) Like(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error) {
+	return s.updateLike(uid, target, outbox, true)
+}
+
+// Unlike ... Removes uid's like of target if there is one
+func (s *Memory) Unlike(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error) {
+	return s.updateLike(uid, target, outbox, false)
+}
+
+// DeleteLike ... Deletes uid's like of target
+func (s *Memory) DeleteLike(ctx context.Context, uid string, target LikeTarget) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.likes, LikeID(uid, target))
+	return nil
+}
+
+// ListLikes ... Gets a page of the likes on target ordered the same way the Firestore query orders them
+func (s *Memory) ListLikes(ctx context.Context, target LikeTarget, q LikeQuery) ([]models.Like, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.posts[target.PostID]; !ok {
+		return nil, ErrNotFound
+	}
+	if _, ok := s.comments[target.PostID][target.CommentID]; target.CommentID != "" && !ok {
+		return nil, ErrNotFound
+	}
+
+	// before reports whether a comes first, newest first then by document id
+	before := func(a, b models.Like) bool {
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return LikeID(a.UID, target) > LikeID(b.UID, target)
+	}
+
+	likes := []models.Like{}
+	for _, like := range s.likes {
+		if like.PostID != target.PostID || like.CommentID != target.CommentID {
+			continue
+		}
+		if q.After != nil && !before(models.Like{UID: q.After.UID, Created: q.After.Created}, like) {
+			continue
+		}
+		likes = append(likes, like)
+	}
+
+	sort.Slice(likes, func(i, j int) bool {
+		return before(likes[i], likes[j])
+	})
+	if q.Limit > 0 && len(likes) > q.Limit {
+		likes = likes[:q.Limit]
+	}
+	return likes, nil
+}
+
+// UserLikes ... Gets up to limit of uid's likes, in a fixed order
+func (s *Memory) UserLikes(ctx context.Context, uid string, limit int) ([]models.Like, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	for key, like := range s.likes {
+		if like.UID == uid {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	likes := []models.Like{}
+	for _, key := range keys {
+		likes = append(likes, s.likes[key])
+	}
+	return likes, nil
+}
+
+// GetUser ... Gets the user with the given auth uid
+func (s *Memory) GetUser(ctx context.Context, uid string) (models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[uid]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return copyUser(user), nil
+}
+
+// CreateUser ... Stores a new user under a generated document id and reserves their username
+func (s *Memory) CreateUser(ctx context.Context, user models.User, outbox ...events.Event) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := UsernameKey(user.Username)
+	if uid, ok := s.usernames[key]; ok && uid != user.UID {
+		return user, ErrUsernameTaken
+	}
+
+	user.ID = newID()
+	s.users[user.UID] = copyUser(user)
+	s.usernames[key] = user.UID
+	s.record(outbox)
+	return user, nil
+}
+
+// UpdateProfile ... Changes the fields in update on the stored user
+func (s *Memory) UpdateProfile(ctx context.Context, uid string, update ProfileUpdate, outbox ...events.Event) (models.User, models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[uid]
+	if !ok {
+		return models.User{}, models.User{}, ErrNotFound
+	}
+	before := copyUser(user)
+	update.apply(&user)
+	s.users[uid] = user
+	s.record(outbox)
+	return before, copyUser(user), nil
+}
+
+// RenameUser ... Moves the user's username reservation and changes their username
+func (s *Memory) RenameUser(ctx context.Context, uid, username string, outbox ...events.Event) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[uid]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	if user.Username == username {
+		return copyUser(user), nil
+	}
+
+	key, oldKey := UsernameKey(username), UsernameKey(user.Username)
+	if owner, ok := s.usernames[key]; ok && owner != uid {
+		return models.User{}, ErrUsernameTaken
+	}
+	if s.usernames[oldKey] == uid {
+		delete(s.usernames, oldKey)
+	}
+	s.usernames[key] = uid
+
+	user.Username = username
+	s.users[uid] = user
+	s.record(outbox)
+	return copyUser(user), nil
+}
+
+// GetUsers ... Gets the users with the given uids in the same order, skipping any that don't exist
+func (s *Memory) GetUsers(ctx context.Context, uids []string) ([]models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []models.User{}
+	for _, uid := range uids {
+		if user, ok := s.users[uid]; ok {
+			users = append(users, copyUser(user))
+		}
+	}
+	return users, nil
+}
+
+// LookupUsernames ... Gets who has each of the usernames from their reservations
+func (s *Memory) LookupUsernames(ctx context.Context, usernames []string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owners := map[string]string{}
+	for _, username := range usernames {
+		key := UsernameKey(username)
+		if uid, ok := s.usernames[key]; ok {
+			owners[key] = uid
+		}
+	}
+	return owners, nil
+}
+
+// Follow ... Adds the edge to both users
+func (s *Memory) Follow(ctx context.Context, follower, followee string, outbox ...events.Event) error {
+	return s.updateUsers(follower, followee, outbox, follow)
+}
+
+// Unfollow ... Removes the edge from both users
+func (s *Memory) Unfollow(ctx context.Context, follower, followee string, outbox ...events.Event) error {
+	return s.updateUsers(follower, followee, outbox, unfollow)
+}
+
+// DeleteUser ... Deletes the user and frees their username
+func (s *Memory) DeleteUser(ctx context.Context, uid string, outbox ...events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[uid]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.users, uid)
+	if key := UsernameKey(user.Username); s.usernames[key] == uid {
+		delete(s.usernames, key)
+	}
+	delete(s.exports, uid)
+	s.record(outbox)
+	return nil
+}
+
+// RequestDeletion ... Starts deleting the user's account unless it's already being deleted
+func (s *Memory) RequestDeletion(ctx context.Context, uid string, outbox ...events.Event) (models.Deletion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if deletion, ok := s.deletions[uid]; ok {
+		return deletion, nil
+	}
+	if _, ok := s.users[uid]; !ok {
+		return models.Deletion{}, ErrNotFound
+	}
+
+	deletion := newDeletion(uid)
+	s.deletions[uid] = deletion
+	s.record(outbox)
+	return deletion, nil
+}
+
+// GetDeletion ... Gets the deletion of the user's account
+func (s *Memory) GetDeletion(ctx context.Context, uid string) (models.Deletion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deletion, ok := s.deletions[uid]
+	if !ok {
+		return deletion, ErrNotFound
+	}
+	return deletion, nil
+}
+
+// UpdateDeletion ... Overwrites a deletion
+func (s *Memory) UpdateDeletion(ctx context.Context, deletion models.Deletion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletions[deletion.UID] = deletion
+	return nil
+}
+
+// RequestExport ... Starts building an archive of the user's data unless one is being built
+func (s *Memory) RequestExport(ctx context.Context, uid string, outbox ...events.Event) (models.Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.exports[uid]
+	if ok && building(last) {
+		return last, nil
+	}
+	if _, ok := s.users[uid]; !ok {
+		return models.Export{}, ErrNotFound
+	}
+
+	export := newExport(uid, last)
+	s.exports[uid] = export
+	s.record(outbox)
+	return export, nil
+}
+
+// GetExport ... Gets the latest archive of the user's data
+func (s *Memory) GetExport(ctx context.Context, uid string) (models.Export, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	export, ok := s.exports[uid]
+	if !ok {
+		return export, ErrNotFound
+	}
+	return export, nil
+}
+
+// UpdateExport ... Overwrites an export
+func (s *Memory) UpdateExport(ctx context.Context, export models.Export) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exports[export.UID] = export
+	return nil
+}
+
+// PendingEvents ... Gets up to limit unsent events in the order they were recorded
+func (s *Memory) PendingEvents(ctx context.Context, limit int) ([]events.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pending := []events.Event{}
+	for _, entry := range s.outbox {
+		if len(pending) == limit {
+			break
+		}
+		if !entry.sent {
+			pending = append(pending, entry.event)
+		}
+	}
+	return pending, nil
+}
+
+// MarkSent ... Records that the events with the given ids were published
+func (s *Memory) MarkSent(ctx context.Context, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.outbox {
+		if contains(ids, s.outbox[i].event.ID) {
+			s.outbox[i].sent = true
+		}
+	}
+	return nil
+}
+
+// record ... Adds events to the outbox. Call with s.mu held.
+func (s *Memory) record(outbox []events.Event) {
+	for _, e := range outbox {
+		s.outbox = append(s.outbox, outboxEntry{event: e})
+	}
+}
+
+// updateUsers ... Applies fn to copies of two users and stores them, with the outbox, if fn changed them
+func (s *Memory) updateUsers(a, b string, outbox []events.Event, fn func(a, b *models.User) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userA, ok := s.users[a]
+	if !ok {
+		return ErrNotFound
+	}
+	userB, ok := s.users[b]
+	if !ok {
+		return ErrNotFound
+	}
+
+	userA, userB = copyUser(userA), copyUser(userB)
+	if fn(&userA, &userB) {
+		s.users[a] = userA
+		s.users[b] = userB
+		s.record(outbox)
+	}
+	return nil
+}
+
+// updateLike ... Adds or removes uid's like of target, with the outbox, if it changes anything
+func (s *Memory) updateLike(uid string, target LikeTarget, outbox []events.Event, liked bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[target.PostID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	comment, ok := s.comments[target.PostID][target.CommentID]
+	if target.CommentID != "" && !ok {
+		return 0, ErrNotFound
+	}
+	user, ok := s.users[uid]
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	count := &post.Likes
+	if target.CommentID != "" {
+		count = &comment.Likes
+	}
+	user = copyUser(user)
+	list, id := likeList(&user, target)
+	key := LikeID(uid, target)
+	_, exists := s.likes[key]
+	if !applyLike(count, list, id, exists, liked) {
+		return *count, nil
+	}
+
+	if liked {
+		s.likes[key] = models.Like{UID: uid, PostID: target.PostID, CommentID: target.CommentID, Created: time.Now().UTC()}
+	} else {
+		delete(s.likes, key)
+	}
+	if target.CommentID != "" {
+		s.comments[target.PostID][target.CommentID] = comment
+	} else {
+		s.posts[post.ID] = post
+	}
+	s.users[uid] = user
+	s.record(outbox)
+	return *count, nil
+}
+
+// copyUser ... Copies a user so callers can't modify what is stored
+func copyUser(user models.User) models.User {
+	user.Posts = append([]string(nil), user.Posts...)
+	user.Likes = append([]string(nil), user.Likes...)
+	user.CommentLikes = append([]string(nil), user.CommentLikes...)
+	user.Following = append([]string(nil), user.Following...)
+	user.Followers = append([]string(nil), user.Followers...)
+	return user
+}
+
+const idAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// newID ... Generates a random 20 character id in the same shape as Firestore's
+func newID() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := range b {
+		b[i] = idAlphabet[int(b[i])%len(idAlphabet)]
+	}
+	return string(b)
+}
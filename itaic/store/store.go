@@ -0,0 +1,464 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// ErrNotFound ... Returned when the requested document does not exist
+var ErrNotFound = errors.New("document not found")
+
+// ErrUsernameTaken ... Returned when a username is already reserved by another user
+var ErrUsernameTaken = errors.New("username taken")
+
+// PostCursor ... A position in a listing of posts ordered by creation time then id
+type PostCursor struct {
+	Created time.Time `json:"created"`
+	ID      string    `json:"id"`
+}
+
+// PostQuery ... Which page of posts to list
+type PostQuery struct {
+	Limit     int
+	Ascending bool
+	// After ... Where the previous page ended, nil for the first page
+	After *PostCursor
+	// Tag ... Only lists posts with this hashtag in their caption, in the form entities.Normalize
+	// gives, if it's set
+	Tag string
+}
+
+// TagCount ... How many posts used a hashtag
+type TagCount struct {
+	Tag   string
+	Posts int
+}
+
+// PostStore ... Reads and writes posts
+type PostStore interface {
+	// ListPosts ... Gets a page of posts ordered by creation time, newest first unless q.Ascending
+	ListPosts(ctx context.Context, q PostQuery) ([]models.Post, error)
+	// TrendingTags ... Gets the limit hashtags used on the most posts created since since, most
+	// used first and then alphabetically. Only posts whose images are ready are counted.
+	TrendingTags(ctx context.Context, since time.Time, limit int) ([]TagCount, error)
+	GetPost(ctx context.Context, id string) (models.Post, error)
+	// ListPostsByUsers ... Gets the newest limit posts written by any of the given users, newest
+	// first and then by id like ListPosts, or all of them if limit is 0
+	ListPostsByUsers(ctx context.Context, uids []string, limit int) ([]models.Post, error)
+	// NewPostID ... Reserves an id for a post that's about to be created
+	NewPostID() string
+	// CreatePost ... Stores a new post, using post.ID if it's set, and adds it to the author's Posts
+	CreatePost(ctx context.Context, post models.Post, outbox ...events.Event) (models.Post, error)
+	// UpdatePost ... Overwrites a post, keeping its counts and images, which are kept up to date
+	// elsewhere. Only the order and alt text of its media items can be changed.
+	UpdatePost(ctx context.Context, post models.Post, outbox ...events.Event) error
+	// FinishMedia ... Records how processing a post's images went, filling them in and marking
+	// it ready, or marking it failed with the reason. Does nothing, outbox included, unless the post
+	// is still processing.
+	FinishMedia(ctx context.Context, id string, result MediaResult, outbox ...events.Event) error
+	// DeletePost ... Deletes a post and takes it off the author's Posts
+	DeletePost(ctx context.Context, id string, outbox ...events.Event) error
+}
+
+// MediaResult ... What came of processing a post's images
+type MediaResult struct {
+	// Reason ... Why processing failed, empty if it worked
+	Reason string
+	// Items ... The processed images, matched to the post's media items by id. Their order and
+	// alt text come from the post, which may have been edited while they were processed.
+	Items []models.MediaItem
+}
+
+// apply ... Fills in the post's images and status from the result
+func (r MediaResult) apply(post *models.Post) {
+	if r.Reason != "" {
+		post.Status = models.PostFailed
+		post.StatusReason = r.Reason
+		return
+	}
+
+	post.Status = models.PostReady
+	post.StatusReason = ""
+	post.Media = mergeMedia(post.Media, r.Items)
+	setCover(post)
+}
+
+// keepImages ... Copies what only FinishMedia changes from the stored post onto an edited one.
+// The edited post keeps its order and alt text for the media items the stored post has.
+func keepImages(post *models.Post, stored models.Post) {
+	post.ImageURL = stored.ImageURL
+	post.Width = stored.Width
+	post.Height = stored.Height
+	post.Variants = stored.Variants
+	post.Placeholder = stored.Placeholder
+	post.Status = stored.Status
+	post.StatusReason = stored.StatusReason
+	post.Media = mergeMedia(post.Media, stored.Media)
+	setCover(post)
+}
+
+// mergeMedia ... A new list with the items in order, each with its images from the item in
+// images with the same id. Items images doesn't have are dropped. The key of the original is
+// kept from whichever item has it.
+func mergeMedia(order, images []models.MediaItem) []models.MediaItem {
+	byID := map[string]models.MediaItem{}
+	for _, item := range images {
+		byID[item.ID] = item
+	}
+
+	merged := []models.MediaItem{}
+	for _, item := range order {
+		image, ok := byID[item.ID]
+		if !ok {
+			continue
+		}
+		image.AltText = item.AltText
+		if image.Original == "" {
+			image.Original = item.Original
+		}
+		merged = append(merged, image)
+	}
+	return merged
+}
+
+// setCover ... Makes the first media item the post's cover, if it has any
+func setCover(post *models.Post) {
+	if len(post.Media) == 0 {
+		return
+	}
+
+	cover := post.Media[0]
+	post.ImageURL = cover.URL
+	post.Width = cover.Width
+	post.Height = cover.Height
+	post.Variants = cover.Variants
+	post.Placeholder = cover.Placeholder
+}
+
+// CommentCursor ... A position in a listing of comments ordered by creation time then id
+type CommentCursor struct {
+	Created time.Time `json:"created"`
+	ID      string    `json:"id"`
+}
+
+// CommentQuery ... Which page of comments to list
+type CommentQuery struct {
+	Limit int
+	// ParentID ... Lists the replies to this comment, or the top level comments if it's empty
+	ParentID string
+	// After ... Where the previous page ended, nil for the first page
+	After *CommentCursor
+}
+
+// CommentStore ... Reads and writes the comments on a post, which are kept apart from the post
+// so adding one doesn't rewrite it. Replies are one level deep, a reply to a reply joins the
+// thread of the comment at the top.
+type CommentStore interface {
+	// ListComments ... Gets a page of a post's comments, or of the replies to one, oldest first
+	ListComments(ctx context.Context, postID string, q CommentQuery) ([]models.Comment, error)
+	GetComment(ctx context.Context, postID, commentID string) (models.Comment, error)
+	// NewCommentID ... Reserves an id for a comment that's about to be added to a post
+	NewCommentID(postID string) string
+	// AddComment ... Stores a new comment, using comment.ID if it's set, and counts it on the post
+	// and on its parent. Returns the comment as stored.
+	AddComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) (models.Comment, error)
+	UpdateComment(ctx context.Context, postID string, comment models.Comment, outbox ...events.Event) error
+	// DeleteComment ... Deletes a comment and its replies and takes them off the counts
+	DeleteComment(ctx context.Context, postID, commentID string, outbox ...events.Event) error
+	// UserComments ... Gets up to limit of the comments uid has written on any post, or all of them
+	// if limit is 0. Comments left behind on posts that are gone are deleted rather than returned.
+	UserComments(ctx context.Context, uid string, limit int) ([]models.Comment, error)
+}
+
+// LikeTarget ... What a like is for, a post or, when CommentID is set, a comment on it
+type LikeTarget struct {
+	PostID    string
+	CommentID string
+}
+
+// LikeCursor ... A position in a listing of likes ordered newest first
+type LikeCursor struct {
+	Created time.Time `json:"created"`
+	UID     string    `json:"uid"`
+}
+
+// LikeQuery ... Which page of likes to list
+type LikeQuery struct {
+	Limit int
+	// After ... Where the previous page ended, nil for the first page
+	After *LikeCursor
+}
+
+// LikeStore ... Records likes as one document per user and target, so liking twice counts once
+type LikeStore interface {
+	// Like ... Records uid's like of target and counts it, or does nothing if it's already there.
+	// Returns how many likes target has.
+	Like(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error)
+	// Unlike ... Undoes Like, doing nothing if uid doesn't like target
+	Unlike(ctx context.Context, uid string, target LikeTarget, outbox ...events.Event) (int, error)
+	// DeleteLike ... Deletes uid's like of target without counting it off, for a like left behind
+	// on a post or comment that's gone and so can't be unliked
+	DeleteLike(ctx context.Context, uid string, target LikeTarget) error
+	// ListLikes ... Gets a page of the likes on target, newest first
+	ListLikes(ctx context.Context, target LikeTarget, q LikeQuery) ([]models.Like, error)
+	// UserLikes ... Gets up to limit of uid's likes, or all of them if limit is 0. Likes left behind
+	// on posts or comments that are gone are deleted rather than returned.
+	UserLikes(ctx context.Context, uid string, limit int) ([]models.Like, error)
+}
+
+// ProfileUpdate ... The parts of a profile UpdateProfile changes, nil ones are left as they're stored
+type ProfileUpdate struct {
+	Bio         *string
+	DisplayName *string
+	ProfilePic  *string
+}
+
+// apply ... Sets the fields being changed on user
+func (u ProfileUpdate) apply(user *models.User) {
+	if u.Bio != nil {
+		user.Bio = *u.Bio
+	}
+	if u.DisplayName != nil {
+		user.DisplayName = *u.DisplayName
+	}
+	if u.ProfilePic != nil {
+		user.ProfilePic = *u.ProfilePic
+	}
+}
+
+// UserStore ... Reads and writes user profiles, looked up by their auth uid
+type UserStore interface {
+	GetUser(ctx context.Context, uid string) (models.User, error)
+	// CreateUser ... Stores a new user and reserves their username in the same write, failing with
+	// ErrUsernameTaken if someone else has it
+	CreateUser(ctx context.Context, user models.User, outbox ...events.Event) (models.User, error)
+	// UpdateProfile ... Changes only the fields in update on uid's user as it's stored at the time,
+	// so a follow or like that lands while the profile is being edited isn't lost. Returns the user
+	// before and after the change.
+	UpdateProfile(ctx context.Context, uid string, update ProfileUpdate, outbox ...events.Event) (models.User, models.User, error)
+	// RenameUser ... Moves uid's username reservation to username and changes their username in one
+	// write, failing with ErrUsernameTaken if someone else has it. Returns the renamed user.
+	RenameUser(ctx context.Context, uid, username string, outbox ...events.Event) (models.User, error)
+	// GetUsers ... Gets the users with the given uids in the same order, skipping any that don't exist
+	GetUsers(ctx context.Context, uids []string) ([]models.User, error)
+	// LookupUsernames ... Gets who has each of the usernames, by UsernameKey, leaving out the ones
+	// nobody has
+	LookupUsernames(ctx context.Context, usernames []string) (map[string]string, error)
+	// Follow ... Adds followee to follower's Following and follower to followee's Followers in one write
+	Follow(ctx context.Context, follower, followee string, outbox ...events.Event) error
+	// Unfollow ... Undoes Follow
+	Unfollow(ctx context.Context, follower, followee string, outbox ...events.Event) error
+	// DeleteUser ... Deletes a user and their export, and frees their username. Whatever else they
+	// left behind has to be deleted first.
+	DeleteUser(ctx context.Context, uid string, outbox ...events.Event) error
+}
+
+// DeletionStore ... Keeps track of accounts being deleted
+type DeletionStore interface {
+	// RequestDeletion ... Starts deleting uid's account, recording outbox with it, or gets the
+	// deletion already under way without recording anything
+	RequestDeletion(ctx context.Context, uid string, outbox ...events.Event) (models.Deletion, error)
+	GetDeletion(ctx context.Context, uid string) (models.Deletion, error)
+	// UpdateDeletion ... Records how far a deletion has got
+	UpdateDeletion(ctx context.Context, deletion models.Deletion) error
+}
+
+// ExportStore ... Keeps track of the archives users ask for of their data
+type ExportStore interface {
+	// RequestExport ... Starts building a new archive of uid's data, recording outbox with it, or
+	// gets the one already being built without recording anything. The last archive built can't
+	// be downloaded once a new one is asked for.
+	RequestExport(ctx context.Context, uid string, outbox ...events.Event) (models.Export, error)
+	GetExport(ctx context.Context, uid string) (models.Export, error)
+	// UpdateExport ... Records how building an archive went
+	UpdateExport(ctx context.Context, export models.Export) error
+}
+
+// Outbox ... Events written in the same transaction as the change that caused them, waiting for
+// the relay to publish them. Every write method takes the events to record as its outbox argument.
+type Outbox interface {
+	// PendingEvents ... Gets up to limit unsent events, oldest first
+	PendingEvents(ctx context.Context, limit int) ([]events.Event, error)
+	// MarkSent ... Records that the events with the given ids were published
+	MarkSent(ctx context.Context, ids []string) error
+}
+
+// Store ... Everything the API persists
+type Store interface {
+	PostStore
+	CommentStore
+	LikeStore
+	UserStore
+	DeletionStore
+	ExportStore
+	Outbox
+}
+
+// newDeletion ... A deletion of uid's account that hasn't started yet
+func newDeletion(uid string) models.Deletion {
+	now := time.Now().UTC()
+	return models.Deletion{
+		UID:       uid,
+		Status:    models.DeletionPending,
+		Step:      models.DeleteAuth,
+		Requested: now,
+		UpdatedAt: now,
+	}
+}
+
+// newExport ... An archive of uid's data that hasn't been built yet, keeping the key of the last
+// one so it can be deleted once the new one is ready
+func newExport(uid string, last models.Export) models.Export {
+	now := time.Now().UTC()
+	return models.Export{
+		UID:       uid,
+		Status:    models.ExportPending,
+		Key:       last.Key,
+		Requested: now,
+		UpdatedAt: now,
+	}
+}
+
+// building ... Whether an export is still being built
+func building(export models.Export) bool {
+	return export.Status == models.ExportPending || export.Status == models.ExportRunning
+}
+
+// hasTag ... Whether tag is one of the hashtags in the post's caption
+func hasTag(post models.Post, tag string) bool {
+	for _, t := range post.Hashtags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// countTags ... The limit most used tags in counts, most used first and then alphabetically
+func countTags(counts map[string]int, limit int) []TagCount {
+	trending := []TagCount{}
+	for tag, n := range counts {
+		trending = append(trending, TagCount{Tag: tag, Posts: n})
+	}
+
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Posts != trending[j].Posts {
+			return trending[i].Posts > trending[j].Posts
+		}
+		return trending[i].Tag < trending[j].Tag
+	})
+	if limit > 0 && len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending
+}
+
+// newest ... The limit newest of posts, ordered like ListPosts orders them
+func newest(posts []models.Post, limit int) []models.Post {
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].Created.Equal(posts[j].Created) {
+			return posts[i].Created.After(posts[j].Created)
+		}
+		return posts[i].ID > posts[j].ID
+	})
+	if limit > 0 && len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts
+}
+
+// UsernameKey ... The id of username's reservation, usernames differing only in case are the same
+func UsernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// LikeID ... The document id of uid's like of target
+func LikeID(uid string, target LikeTarget) string {
+	key := uid + ":" + target.PostID
+	if target.CommentID != "" {
+		key += ":" + target.CommentID
+	}
+	return key
+}
+
+// likeList ... The list on the user that records likes of target's kind, and target's id in it
+func likeList(user *models.User, target LikeTarget) (*[]string, string) {
+	if target.CommentID != "" {
+		return &user.CommentLikes, target.CommentID
+	}
+	return &user.Likes, target.PostID
+}
+
+// applyLike ... Adds a like to count and id to the user's list when liked is true, or takes it
+// away when it's false. exists says whether there's a like document already. Returns false if
+// the like was already in that state.
+func applyLike(count *int, list *[]string, id string, exists, liked bool) bool {
+	// likes from before there were like documents are only in the user's list
+	if (exists || contains(*list, id)) == liked {
+		return false
+	}
+
+	if liked {
+		*count++
+		if !contains(*list, id) {
+			*list = append(*list, id)
+		}
+	} else {
+		*count = uncount(*count, 1)
+		*list, _ = without(*list, id)
+	}
+	return true
+}
+
+// uncount ... Takes n off a count without going below zero
+func uncount(count, n int) int {
+	if count < n {
+		return 0
+	}
+	return count - n
+}
+
+// follow ... Links two users, returning false if they were already linked
+func follow(follower, followee *models.User) bool {
+	if contains(follower.Following, followee.UID) {
+		return false
+	}
+
+	follower.Following = append(follower.Following, followee.UID)
+	if !contains(followee.Followers, follower.UID) {
+		followee.Followers = append(followee.Followers, follower.UID)
+	}
+	return true
+}
+
+// unfollow ... Unlinks two users, returning false if they weren't linked
+func unfollow(follower, followee *models.User) bool {
+	var removed bool
+	follower.Following, removed = without(follower.Following, followee.UID)
+	followee.Followers, _ = without(followee.Followers, follower.UID)
+	return removed
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, value string) ([]string, bool) {
+	for i, item := range list {
+		if item == value {
+			return append(list[:i:i], list[i+1:]...), true
+		}
+	}
+	return list, false
+}
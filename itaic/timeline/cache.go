@@ -0,0 +1,91 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// Cache ... Timeline kept in Redis by the itaic-cache service
+type Cache struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewCache ... Creates a timeline that talks to the cache api at baseURL
+func NewCache(baseURL string) *Cache {
+	return &Cache{baseURL: baseURL, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+type cachePage struct {
+	Posts      []models.Post `json:"posts"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+// Page ... Gets a page of uid's timeline from the cache
+func (c *Cache) Page(ctx context.Context, uid, cursor string, limit int) ([]models.Post, string, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	req, err := http.NewRequest("GET", c.baseURL+"/timeline/"+url.PathEscape(uid)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", ErrCold
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("cache api returned %s", res.Status)
+	}
+
+	result := cachePage{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Posts, result.NextCursor, nil
+}
+
+// Fill ... Sends uid's timeline to the cache
+func (c *Cache) Fill(ctx context.Context, uid string, entries []Entry) error {
+	body, err := json.Marshal(struct {
+		Entries []Entry `json:"entries"`
+	}{entries})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", c.baseURL+"/timeline/"+url.PathEscape(uid), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("cache api returned %s", res.Status)
+	}
+	return nil
+}
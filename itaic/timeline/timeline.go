@@ -0,0 +1,122 @@
+package timeline
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+)
+
+// MaxEntries ... How many posts a timeline keeps, older ones fall off the end
+const MaxEntries = 500
+
+// ErrCold ... Returned when the cache has no timeline for a user yet
+var ErrCold = errors.New("timeline not cached")
+
+// Entry ... A post on a timeline, scored by its creation time in milliseconds
+type Entry struct {
+	ID    string `json:"id"`
+	Score int64  `json:"score"`
+}
+
+// Timeline ... Per-user home timelines kept by the cache
+type Timeline interface {
+	// Page ... Gets the posts on uid's timeline after the cursor, newest first
+	Page(ctx context.Context, uid, cursor string, limit int) ([]models.Post, string, error)
+	// Fill ... Replaces uid's timeline with the given entries
+	Fill(ctx context.Context, uid string, entries []Entry) error
+}
+
+// Cold ... Timeline that never has anything cached, used when running offline
+type Cold struct{}
+
+// Page ... Always reports a cold cache
+func (Cold) Page(ctx context.Context, uid, cursor string, limit int) ([]models.Post, string, error) {
+	return nil, "", ErrCold
+}
+
+// Fill ... Does nothing
+func (Cold) Fill(ctx context.Context, uid string, entries []Entry) error {
+	return nil
+}
+
+// Score ... Gets the timeline score of a post
+func Score(post models.Post) int64 {
+	return post.Created.UnixNano() / int64(time.Millisecond)
+}
+
+// Sort ... Orders posts newest first, breaking ties by id the same way the cache does
+func Sort(posts []models.Post) []Entry {
+	entries := make([]Entry, len(posts))
+	for i, post := range posts {
+		entries[i] = Entry{ID: post.ID, Score: Score(post)}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	return entries
+}
+
+// After ... Gets up to limit entries that come after the cursor in an already sorted list
+func After(entries []Entry, cursor string, limit int) ([]Entry, string, error) {
+	start := 0
+	if cursor != "" {
+		last, err := DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for start < len(entries) && !Older(entries[start], last) {
+			start++
+		}
+	}
+
+	end := start + limit
+	if end >= len(entries) {
+		return entries[start:], "", nil
+	}
+	return entries[start:end], EncodeCursor(entries[end-1]), nil
+}
+
+// Older ... Reports whether a comes after b on a timeline
+func Older(a, b Entry) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.ID < b.ID
+}
+
+// EncodeCursor ... Makes an opaque cursor pointing just past the given entry
+func EncodeCursor(last Entry) string {
+	raw := strconv.FormatInt(last.Score, 10) + ":" + last.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor ... Reads a cursor made by EncodeCursor
+func DecodeCursor(cursor string) (Entry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Entry{}, apierr.Validation("invalid cursor")
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return Entry{}, apierr.Validation("invalid cursor")
+	}
+
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Entry{}, apierr.Validation("invalid cursor")
+	}
+	return Entry{ID: parts[1], Score: score}, nil
+}
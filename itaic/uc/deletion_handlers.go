@@ -0,0 +1,96 @@
+package uc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"goji.io/pat"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// deletionStatus ... How far deleting an account has got
+type deletionStatus struct {
+	Status    string    `json:"status"`
+	Step      string    `json:"step,omitempty"`
+	Likes     int       `json:"likes"`
+	Comments  int       `json:"comments"`
+	Posts     int       `json:"posts"`
+	Follows   int       `json:"follows"`
+	Error     string    `json:"error,omitempty"`
+	Requested time.Time `json:"requested"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// statusOf ... The status sent to the client for a deletion
+func statusOf(d models.Deletion) deletionStatus {
+	return deletionStatus{
+		Status:    d.Status,
+		Step:      d.Step,
+		Likes:     d.Likes,
+		Comments:  d.Comments,
+		Posts:     d.Posts,
+		Follows:   d.Follows,
+		Error:     d.Error,
+		Requested: d.Requested,
+		UpdatedAt: d.UpdatedAt,
+	}
+}
+
+// HandleDeleteUser ... Queues the caller's account to be deleted along with their posts, comments,
+// likes and follows. Responds with the deletion's status, which can be followed at
+// GET /user/:uid/deletion. Asking again while it runs gets the same deletion.
+func HandleDeleteUser(ctx context.Context, deletions store.DeletionStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := pat.Param(req, "uid")
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only delete your own account"))
+			return
+		}
+
+		e, err := events.New(events.DeletionRequested, uid, events.User{UID: uid})
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		// the job is queued with the deletion, the account worker does the rest
+		deletion, err := deletions.RequestDeletion(ctx, uid, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		res.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(res).Encode(statusOf(deletion))
+	}
+}
+
+// HandleGetDeletion ... Gets how far deleting the caller's account has got
+func HandleGetDeletion(ctx context.Context, deletions store.DeletionStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := pat.Param(req, "uid")
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only see the deletion of your own account"))
+			return
+		}
+
+		deletion, err := deletions.GetDeletion(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "deletion"))
+			return
+		}
+
+		json.NewEncoder(res).Encode(statusOf(deletion))
+	}
+}
@@ -0,0 +1,146 @@
+package uc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"goji.io/pat"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// exportStatus ... How building an archive of a user's data is going
+type exportStatus struct {
+	Status string `json:"status"`
+	// DownloadURL ... Path on the API the archive can be downloaded from without signing in, until
+	// Expires
+	DownloadURL string     `json:"download_url,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Requested   time.Time  `json:"requested"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// exportStatusOf ... The status sent to the client for an export, with the download link while
+// it works
+func exportStatusOf(x models.Export) exportStatus {
+	status := exportStatus{
+		Status:    x.Status,
+		Error:     x.Error,
+		Requested: x.Requested,
+		UpdatedAt: x.UpdatedAt,
+	}
+	if downloadable(x) {
+		status.DownloadURL = "/user/" + url.PathEscape(x.UID) + "/export/download?token=" + x.Token
+		status.Expires = &x.Expires
+	}
+	return status
+}
+
+// downloadable ... Whether an export's archive can be downloaded right now
+func downloadable(x models.Export) bool {
+	return x.Status == models.ExportReady && x.Token != "" && time.Now().Before(x.Expires)
+}
+
+// HandleRequestExport ... Queues an archive of the caller's profile, posts, comments, likes,
+// followers, following and images to be built. Responds with its status, which can be followed
+// at GET /user/:uid/export. Asking again while it's built gets the same export.
+func HandleRequestExport(ctx context.Context, exports store.ExportStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := pat.Param(req, "uid")
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only export your own data"))
+			return
+		}
+
+		e, err := events.New(events.ExportRequested, uid, events.User{UID: uid})
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		// the job is queued with the export, the account worker builds it
+		export, err := exports.RequestExport(ctx, uid, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		res.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(res).Encode(exportStatusOf(export))
+	}
+}
+
+// HandleGetExport ... Gets how building the caller's archive is going, with the link to download
+// it once it's ready
+func HandleGetExport(ctx context.Context, exports store.ExportStore) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := pat.Param(req, "uid")
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only see your own export"))
+			return
+		}
+
+		export, err := exports.GetExport(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "export"))
+			return
+		}
+
+		json.NewEncoder(res).Encode(exportStatusOf(export))
+	}
+}
+
+// HandleDownloadExport ... Sends the archive of a user's data to anyone with the token from its
+// download link, until the link expires
+func HandleDownloadExport(ctx context.Context, exports store.ExportStore, blobs blob.Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		uid := pat.Param(req, "uid")
+		token := req.URL.Query().Get("token")
+
+		export, err := exports.GetExport(ctx, uid)
+		if err != nil && err != store.ErrNotFound {
+			apierr.Write(res, req, err)
+			return
+		}
+		if err == store.ErrNotFound || !downloadable(export) || subtle.ConstantTimeCompare([]byte(token), []byte(export.Token)) != 1 {
+			apierr.Write(res, req, apierr.NotFound("the download link is invalid or has expired"))
+			return
+		}
+
+		archive, err := blobs.Open(ctx, export.Key)
+		if err == blob.ErrNotFound {
+			apierr.Write(res, req, apierr.NotFound("the archive is gone, ask for a new export"))
+			return
+		}
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+		defer archive.Close()
+
+		// archives are streamed, they can be too big to hold in memory
+		res.Header().Set("Content-Type", "application/zip")
+		res.Header().Set("Content-Disposition", `attachment; filename="itaic-export.zip"`)
+		res.Header().Set("Cache-Control", "private, no-store")
+		_, err = io.Copy(res, archive)
+		if err != nil {
+			fmt.Println("[ ! ] Error sending the export of "+uid+": ", err)
+		}
+	}
+}
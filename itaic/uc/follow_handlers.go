@@ -0,0 +1,107 @@
+package uc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/page"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"goji.io/pat"
+)
+
+// userPage ... One page of a followers or following list
+type userPage struct {
+	Users      []models.UserSummary `json:"users"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// HandleFollow ... Makes the caller follow the user in the path
+func HandleFollow(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
+	return handleFollowEdge(ctx, users.Follow, events.UserFollowed)
+}
+
+// HandleUnfollow ... Makes the caller stop following the user in the path
+func HandleUnfollow(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
+	return handleFollowEdge(ctx, users.Unfollow, events.UserUnfollowed)
+}
+
+func handleFollowEdge(ctx context.Context, update func(ctx context.Context, follower, followee string, outbox ...events.Event) error, eventType string) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		follower := authn.UID(req)
+		followee := pat.Param(req, "uid")
+		if follower == followee {
+			apierr.Write(res, req, apierr.Validation("you can't follow yourself"))
+			return
+		}
+
+		event := events.Follow{Follower: follower, Followee: followee}
+		e, err := events.New(eventType, follower, event)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		err = update(ctx, follower, followee, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		json.NewEncoder(res).Encode(&event)
+	}
+}
+
+// HandleGetFollowers ... Gets a page of the users following the user in the path
+func HandleGetFollowers(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
+	return handleUserList(ctx, users, func(user models.User) []string { return user.Followers })
+}
+
+// HandleGetFollowing ... Gets a page of the users the user in the path follows
+func HandleGetFollowing(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
+	return handleUserList(ctx, users, func(user models.User) []string { return user.Following })
+}
+
+func handleUserList(ctx context.Context, users store.UserStore, list func(user models.User) []string) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		params, err := page.FromRequest(req)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		user, err := users.GetUser(ctx, pat.Param(req, "uid"))
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		uids := list(user)
+		start, end, next, err := page.Slice(len(uids), params)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		found, err := users.GetUsers(ctx, uids[start:end])
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		result := userPage{Users: []models.UserSummary{}, NextCursor: next}
+		for _, u := range found {
+			result.Users = append(result.Users, u.Summary())
+		}
+
+		json.NewEncoder(res).Encode(&result)
+	}
+}
@@ -1,76 +1,124 @@
 package uc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
-	"cloud.google.com/go/firestore"
-	"firebase.google.com/go/auth"
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/apierr"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/media"
 	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
 	"goji.io/pat"
-	"google.golang.org/api/iterator"
 )
 
+// usernamePattern ... Usernames are 3 to 30 letters, numbers, underscores and dots
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.]{3,30}$`)
+
+// Limits on the text in a profile, in characters
+const (
+	maxDisplayName = 50
+	maxBio         = 150
+)
+
+// maxPictureSize ... The largest profile picture that can be uploaded, in bytes
+const maxPictureSize = 10 << 20
+
+// formMemory ... How much of a profile form is kept in memory, the rest is spooled to disk
+const formMemory = 16 << 20
+
 // HandleGetUser ... Gets a single user based on uid
-func HandleGetUser(ctx context.Context, client *firestore.Client) func(res http.ResponseWriter, req *http.Request) {
+func HandleGetUser(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 		uid := pat.Param(req, "uid")
-		user := models.User{}
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				log.Fatal("[ ! ] Error iterating documents: ", err)
-			}
-
-			// fmt.Println(doc.Data())
-			err = doc.DataTo(&user)
-			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
-			}
+		user, err := users.GetUser(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
 		}
 
 		json.NewEncoder(res).Encode(user)
 	}
 }
 
+// registration ... The fields a new user can set, anything else in the body is rejected
+type registration struct {
+	Email       string `json:"email"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+}
+
 // HandleRegisterUser ... Handles registering a user to the auth system and adding them to the db
-func HandleRegisterUser(ctx context.Context, client *firestore.Client, authClient *auth.Client) func(res http.ResponseWriter, req *http.Request) {
+func HandleRegisterUser(ctx context.Context, users store.UserStore, authClient authn.Client) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
-		// register user
-		// add to the db
-		newUser := models.User{}
-		err := json.NewDecoder(req.Body).Decode(&newUser)
+		form := registration{}
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&form)
+		if err != nil {
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON object with only email, username, display_name and bio"))
+			return
+		}
+		if form.Email == "" || form.Username == "" {
+			apierr.Write(res, req, apierr.Validation("email and username are required"))
+			return
+		}
+		err = validateProfile(profileUpdate{Bio: &form.Bio, DisplayName: &form.DisplayName, Username: &form.Username})
 		if err != nil {
-			log.Fatal("[ ! ] Error decoding the request body: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
-		params := (&auth.UserToCreate{}).Email(newUser.Email).DisplayName(newUser.Username)
+		displayName := form.DisplayName
+		if displayName == "" {
+			displayName = form.Username
+		}
 
-		user, err := authClient.CreateUser(ctx, params)
+		// register user
+		uid, err := authClient.CreateUser(ctx, form.Email, displayName)
 		if err != nil {
-			log.Fatal("[ ! ] Error creating user: ", err)
+			apierr.Write(res, req, err)
+			return
 		}
 
 		fmt.Println("[ + ] User created")
-		doc := client.Collection("users").NewDoc()
-		newUser.UID = user.UID
-		newUser.ID = doc.ID
 
-		_, err = doc.Create(ctx, newUser)
+		// add to the db, which reserves the username
+		newUser := models.User{
+			UID:         uid,
+			Username:    form.Username,
+			DisplayName: form.DisplayName,
+			Email:       form.Email,
+			Bio:         form.Bio,
+		}
+		e, err := events.New(events.UserCreated, uid, events.User{UID: uid})
+		if err == nil {
+			newUser, err = users.CreateUser(ctx, newUser, e)
+		}
 		if err != nil {
-			log.Fatal("[ ! ] Error adding document to users collection: ", err)
+			// don't leave an account behind that can sign in but has no profile
+			delErr := authClient.DeleteUser(ctx, uid)
+			if delErr != nil {
+				fmt.Println("[ ! ] Error removing auth user "+uid+" after a failed registration: ", delErr)
+			}
+			apierr.Write(res, req, err)
+			return
 		}
 
 		json.NewEncoder(res).Encode(&newUser)
@@ -78,7 +126,7 @@ func HandleRegisterUser(ctx context.Context, client *firestore.Client, authClien
 }
 
 // HandleEditUser ... Handles editing the user's bio
-func HandleEditUser(ctx context.Context, client *firestore.Client) func(res http.ResponseWriter, req *http.Request) {
+func HandleEditUser(ctx context.Context, users store.UserStore) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
@@ -87,38 +135,273 @@ func HandleEditUser(ctx context.Context, client *firestore.Client) func(res http
 		}
 
 		uid := pat.Param(req, "uid")
-		user := models.User{}
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only edit your own profile"))
+			return
+		}
 		newBio := NewBio{}
 
 		err := json.NewDecoder(req.Body).Decode(&newBio)
 		if err != nil {
-			log.Fatal("[ ! ] Error decoding request body: ", err)
+			apierr.Write(res, req, apierr.Validation("request body must be a JSON object with a bio"))
+			return
 		}
-		query := client.Collection("users").Where("uid", "==", uid)
-		iter := query.Documents(ctx)
 
-		for {
-			doc, err := iter.Next()
-			if err == iterator.Done {
-				break
+		err = validateProfile(profileUpdate{Bio: &newBio.Bio})
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		e, err := events.New(events.UserUpdated, uid, events.User{UID: uid})
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		_, user, err := users.UpdateProfile(ctx, uid, store.ProfileUpdate{Bio: &newBio.Bio}, e)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		json.NewEncoder(res).Encode(&user)
+	}
+}
+
+// HandleUpdateProfile ... Changes any of the caller's bio, display name and username, and their
+// profile picture when sent as a multipart form with a profile_pic file. A new username is shown on
+// every one of their posts before this returns.
+func HandleUpdateProfile(ctx context.Context, users store.UserStore, posts store.PostStore, blobs blob.Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		uid := pat.Param(req, "uid")
+		if uid != authn.UID(req) {
+			apierr.Write(res, req, apierr.Forbidden("you can only edit your own profile"))
+			return
+		}
+
+		update, picture, err := readProfileUpdate(res, req)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+		err = validateProfile(update)
+		if err != nil {
+			apierr.Write(res, req, err)
+			return
+		}
+
+		user, err := users.GetUser(ctx, uid)
+		if err != nil {
+			apierr.Write(res, req, apierr.Missing(err, "user"))
+			return
+		}
+
+		// what the profile was, for telling a picture that was just stored from the one they had
+		stored := user
+
+		profile := store.ProfileUpdate{Bio: update.Bio, DisplayName: update.DisplayName}
+		if picture != nil {
+			profilePic, err := storePicture(ctx, blobs, uid, picture)
+			if err != nil {
+				apierr.Write(res, req, err)
+				return
 			}
+			profile.ProfilePic = &profilePic
+		}
 
+		if update.Username != nil {
+			e, err := events.New(events.UserUpdated, uid, events.User{UID: uid})
+			renamed := models.User{}
+			if err == nil {
+				renamed, err = users.RenameUser(ctx, uid, *update.Username, e)
+			}
 			if err != nil {
-				log.Fatal("[ ! ] Error iterating documents: ", err)
+				discardPicture(ctx, blobs, stored, profile.ProfilePic)
+				apierr.Write(res, req, apierr.Missing(err, "user"))
+				return
 			}
+			user = renamed
+		}
 
-			err = doc.DataTo(&user)
+		if update.Bio != nil || update.DisplayName != nil || picture != nil {
+			e, err := events.New(events.UserUpdated, uid, events.User{UID: uid})
+			before, updated := models.User{}, models.User{}
+			if err == nil {
+				before, updated, err = users.UpdateProfile(ctx, uid, profile, e)
+			}
 			if err != nil {
-				log.Fatal("[ ! ] Error mapping data to struct: ", err)
+				discardPicture(ctx, blobs, stored, profile.ProfilePic)
+				apierr.Write(res, req, apierr.Missing(err, "user"))
+				return
+			}
+			user = updated
+
+			// the picture that was replaced is no longer anyone's
+			if before.ProfilePic != user.ProfilePic {
+				err = blob.DeleteProfilePicture(ctx, blobs, before)
+				if err != nil {
+					fmt.Println("[ ! ] Error deleting old profile picture of "+uid+": ", err)
+				}
 			}
 		}
 
-		user.Bio = newBio.Bio
-		_, err = client.Collection("users").Doc(user.ID).Set(ctx, user)
-		if err != nil {
-			log.Fatal("[ ! ] Error setting document: ", err)
+		// done even when the username didn't change, so sending it again finishes a rename that
+		// failed part of the way through its posts
+		if update.Username != nil {
+			err = renamePosts(ctx, posts, user)
+			if err != nil {
+				apierr.Write(res, req, apierr.Upstream("username changed but some posts still show the old one, try again", err))
+				return
+			}
 		}
 
 		json.NewEncoder(res).Encode(&user)
 	}
 }
+
+// profileUpdate ... The profile fields a request can change, nil ones are left as they are
+type profileUpdate struct {
+	Bio         *string `json:"bio"`
+	DisplayName *string `json:"display_name"`
+	Username    *string `json:"username"`
+}
+
+// readProfileUpdate ... Reads a profile update from a JSON body, or from a multipart form along
+// with the profile picture if there is one. Fields that can't be changed are rejected.
+func readProfileUpdate(res http.ResponseWriter, req *http.Request) (profileUpdate, []byte, error) {
+	update := profileUpdate{}
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&update)
+		if err != nil {
+			return update, nil, apierr.Validation("request body must be a JSON object with only bio, display_name and username")
+		}
+		return update, nil, nil
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, maxPictureSize+1<<20)
+	err := req.ParseMultipartForm(formMemory)
+	if err != nil {
+		return update, nil, apierr.Validation("request body must be a multipart form of at most " + strconv.Itoa(maxPictureSize>>20+1) + "MB")
+	}
+	defer req.MultipartForm.RemoveAll()
+
+	fields := map[string]**string{"bio": &update.Bio, "display_name": &update.DisplayName, "username": &update.Username}
+	for name, values := range req.MultipartForm.Value {
+		into, ok := fields[name]
+		if !ok || len(values) != 1 {
+			return update, nil, apierr.Validation("the form can only have one each of bio, display_name, username and profile_pic")
+		}
+		value := values[0]
+		*into = &value
+	}
+	for name, files := range req.MultipartForm.File {
+		if name != "profile_pic" || len(files) != 1 {
+			return update, nil, apierr.Validation("the form can only have one each of bio, display_name, username and profile_pic")
+		}
+	}
+
+	files := req.MultipartForm.File["profile_pic"]
+	if len(files) == 0 {
+		return update, nil, nil
+	}
+	picture, err := readPicture(files[0])
+	return update, picture, err
+}
+
+// validateProfile ... Checks the fields being set are ones a profile can have
+func validateProfile(update profileUpdate) error {
+	if update.Username != nil && !usernamePattern.MatchString(*update.Username) {
+		return apierr.Validation("usernames must be 3 to 30 letters, numbers, underscores and dots")
+	}
+	if update.DisplayName != nil && utf8.RuneCountInString(*update.DisplayName) > maxDisplayName {
+		return apierr.Validation("display names can be at most " + strconv.Itoa(maxDisplayName) + " characters")
+	}
+	if update.Bio != nil && utf8.RuneCountInString(*update.Bio) > maxBio {
+		return apierr.Validation("bios can be at most " + strconv.Itoa(maxBio) + " characters")
+	}
+	return nil
+}
+
+// readPicture ... Reads an uploaded profile picture, checking it isn't too big
+func readPicture(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, apierr.Validation("error reading the profile picture")
+	}
+	defer file.Close()
+
+	// read one byte past the limit to tell a file that fits exactly from one that's too big
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxPictureSize+1))
+	if err != nil {
+		return nil, apierr.Validation("error reading the profile picture")
+	}
+	if len(data) > maxPictureSize {
+		return nil, apierr.Validation("profile pictures can be at most " + strconv.Itoa(maxPictureSize>>20) + "MB")
+	}
+	return data, nil
+}
+
+// storePicture ... Makes an upload into a profile picture and stores it under the user, returning
+// where it can be fetched from
+func storePicture(ctx context.Context, blobs blob.Store, uid string, data []byte) (string, error) {
+	avatar, err := media.ProcessAvatar(data)
+	if err == media.ErrUnsupported || err == media.ErrTooLarge {
+		return "", apierr.Validation(err.Error())
+	}
+	if err != nil {
+		return "", err
+	}
+
+	location, err := blobs.Put(ctx, blob.Key(blob.UserOwner(uid), avatar.Data, avatar.ContentType), avatar.ContentType, bytes.NewReader(avatar.Data))
+	if err != nil {
+		return "", apierr.Upstream("error uploading profile picture", err)
+	}
+	return location, nil
+}
+
+// discardPicture ... Deletes a picture stored for a profile update that failed, unless it's the
+// same picture the user already has
+func discardPicture(ctx context.Context, blobs blob.Store, user models.User, profilePic *string) {
+	if profilePic == nil || *profilePic == user.ProfilePic {
+		return
+	}
+	err := blob.DeleteProfilePicture(ctx, blobs, models.User{UID: user.UID, ProfilePic: *profilePic})
+	if err != nil {
+		fmt.Println("[ ! ] Error deleting unused profile picture of "+user.UID+": ", err)
+	}
+}
+
+// renamePosts ... Shows user's current username on each of their posts that has an old one
+func renamePosts(ctx context.Context, posts store.PostStore, user models.User) error {
+	for _, id := range user.Posts {
+		post, err := posts.GetPost(ctx, id)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if post.Username == user.Username {
+			continue
+		}
+
+		post.Username = user.Username
+		e, err := events.New(events.PostUpdated, user.UID, events.Post{ID: post.ID, UID: post.UID})
+		if err != nil {
+			return err
+		}
+		err = posts.UpdatePost(ctx, post, e)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/authn"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// deletionBatch ... How many likes or comments are deleted between saving a deletion's progress
+const deletionBatch = 100
+
+// steps ... What each step of deleting an account does, in order
+var steps = []string{
+	models.DeleteAuth,
+	models.DeleteLikes,
+	models.DeleteComments,
+	models.DeletePosts,
+	models.DeleteFollows,
+	models.DeleteProfile,
+}
+
+// Accounts ... Deletes accounts from a store along with their auth users and images
+type Accounts struct {
+	db    store.Store
+	auth  authn.Client
+	blobs blob.Store
+}
+
+// NewAccounts ... Creates a worker that deletes accounts from db, auth and blobs
+func NewAccounts(db store.Store, auth authn.Client, blobs blob.Store) *Accounts {
+	return &Accounts{db: db, auth: auth, blobs: blobs}
+}
+
+// Handle ... Runs the deletion in a user.deletion_requested event from the step it got to, saving
+// its progress as it goes so an interrupted deletion carries on where it stopped. Returns an error
+// if a step fails, in which case the job should be tried again later.
+func (a *Accounts) Handle(ctx context.Context, e events.Event) error {
+	job := events.User{}
+	err := e.Decode(&job)
+	if err != nil {
+		fmt.Println("[ ! ] Skipping unreadable deletion job "+e.ID+": ", err)
+		return nil
+	}
+
+	deletion, err := a.db.GetDeletion(ctx, job.UID)
+	if err == store.ErrNotFound {
+		fmt.Println("[ - ] Skipping deletion job for " + job.UID + ", nothing was requested")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if deletion.Status == models.DeletionDone {
+		return nil
+	}
+
+	deletion.Status = models.DeletionRunning
+	err = a.run(ctx, &deletion)
+	if err != nil {
+		fmt.Println("[ ! ] Error deleting the account of "+job.UID+" at the "+deletion.Step+" step: ", err)
+		deletion.Error = err.Error()
+		saveErr := a.save(ctx, &deletion)
+		if saveErr != nil {
+			fmt.Println("[ ! ] Error saving the progress of deleting "+job.UID+": ", saveErr)
+		}
+		return err
+	}
+
+	fmt.Println("[ + ] Deleted the account of " + job.UID)
+	return nil
+}
+
+// run ... Runs each step from the one the deletion is at, saving after each
+func (a *Accounts) run(ctx context.Context, deletion *models.Deletion) error {
+	start := 0
+	for i, step := range steps {
+		if step == deletion.Step {
+			start = i
+		}
+	}
+
+	for _, step := range steps[start:] {
+		deletion.Step = step
+		err := a.save(ctx, deletion)
+		if err != nil {
+			return err
+		}
+
+		switch step {
+		case models.DeleteAuth:
+			// first, so nobody can sign in and add more while the rest goes
+			err = a.auth.DeleteUser(ctx, deletion.UID)
+		case models.DeleteLikes:
+			err = a.deleteLikes(ctx, deletion)
+		case models.DeleteComments:
+			err = a.deleteComments(ctx, deletion)
+		case models.DeletePosts:
+			err = a.deletePosts(ctx, deletion)
+		case models.DeleteFollows:
+			err = a.deleteFollows(ctx, deletion)
+		case models.DeleteProfile:
+			err = a.deleteProfile(ctx, deletion)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	deletion.Status = models.DeletionDone
+	deletion.Step = ""
+	deletion.Error = ""
+	return a.save(ctx, deletion)
+}
+
+// deleteLikes ... Takes back every like the user made, a batch at a time
+func (a *Accounts) deleteLikes(ctx context.Context, deletion *models.Deletion) error {
+	for {
+		likes, err := a.db.UserLikes(ctx, deletion.UID, deletionBatch)
+		if err != nil {
+			return err
+		}
+		if len(likes) == 0 {
+			return nil
+		}
+
+		for _, like := range likes {
+			// the post's author isn't needed to refresh it, and looking it up for every like would
+			// double the reads
+			e, err := events.New(events.PostUnliked, deletion.UID, events.Post{ID: like.PostID})
+			if like.CommentID != "" {
+				e, err = events.New(events.CommentUnliked, deletion.UID, events.Comment{PostID: like.PostID, CommentID: like.CommentID})
+			}
+			if err != nil {
+				return err
+			}
+
+			// something deleted since it was listed can't be unliked, and the like would be listed
+			// again in every batch if it stayed
+			target := store.LikeTarget{PostID: like.PostID, CommentID: like.CommentID}
+			_, err = a.db.Unlike(ctx, deletion.UID, target, e)
+			if err == store.ErrNotFound {
+				err = a.db.DeleteLike(ctx, deletion.UID, target)
+			}
+			if err != nil {
+				return err
+			}
+			deletion.Likes++
+		}
+
+		err = a.save(ctx, deletion)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deleteComments ... Deletes every comment the user wrote, a batch at a time. Replies to them go
+// too, the same as when a comment is deleted by hand.
+func (a *Accounts) deleteComments(ctx context.Context, deletion *models.Deletion) error {
+	for {
+		comments, err := a.db.UserComments(ctx, deletion.UID, deletionBatch)
+		if err != nil {
+			return err
+		}
+		if len(comments) == 0 {
+			return nil
+		}
+
+		for _, comment := range comments {
+			e, err := events.New(events.CommentDeleted, deletion.UID, events.Comment{PostID: comment.PostID, CommentID: comment.ID, ParentID: comment.ParentID})
+			if err != nil {
+				return err
+			}
+
+			// a reply deleted along with an earlier comment in the batch is already gone
+			err = a.db.DeleteComment(ctx, comment.PostID, comment.ID, e)
+			if err != nil && err != store.ErrNotFound {
+				return err
+			}
+			deletion.Comments++
+		}
+
+		err = a.save(ctx, deletion)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deletePosts ... Deletes each of the user's posts, with their comments, likes and images
+func (a *Accounts) deletePosts(ctx context.Context, deletion *models.Deletion) error {
+	user, err := a.db.GetUser(ctx, deletion.UID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range user.Posts {
+		post, err := a.db.GetPost(ctx, id)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// the images go first, once the post is gone there's nothing left to find them by
+		err = blob.DeletePostImages(ctx, a.blobs, post)
+		if err != nil {
+			return err
+		}
+
+		e, err := events.New(events.PostDeleted, deletion.UID, events.Post{ID: post.ID, UID: post.UID})
+		if err != nil {
+			return err
+		}
+		err = a.db.DeletePost(ctx, post.ID, e)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+
+		deletion.Posts++
+		err = a.save(ctx, deletion)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFollows ... Undoes every follow to and from the user
+func (a *Accounts) deleteFollows(ctx context.Context, deletion *models.Deletion) error {
+	user, err := a.db.GetUser(ctx, deletion.UID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	edges := []events.Follow{}
+	for _, followee := range user.Following {
+		edges = append(edges, events.Follow{Follower: user.UID, Followee: followee})
+	}
+	for _, follower := range user.Followers {
+		edges = append(edges, events.Follow{Follower: follower, Followee: user.UID})
+	}
+
+	for _, edge := range edges {
+		e, err := events.New(events.UserUnfollowed, deletion.UID, edge)
+		if err != nil {
+			return err
+		}
+
+		// an edge to someone who's gone goes with the user
+		err = a.db.Unfollow(ctx, edge.Follower, edge.Followee, e)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+		deletion.Follows++
+	}
+	return a.save(ctx, deletion)
+}
+
+// deleteProfile ... Deletes the user once nothing else is left. Anything added since its step
+// ran, by a session that was still signed in, is deleted first.
+func (a *Accounts) deleteProfile(ctx context.Context, deletion *models.Deletion) error {
+	user, err := a.db.GetUser(ctx, deletion.UID)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(user.Posts) > 0 {
+		err = a.deletePosts(ctx, deletion)
+		if err != nil {
+			return err
+		}
+	}
+	if len(user.Following) > 0 || len(user.Followers) > 0 {
+		err = a.deleteFollows(ctx, deletion)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the profile picture and export go with the user, their files have to go first
+	err = blob.DeleteProfilePicture(ctx, a.blobs, user)
+	if err != nil {
+		return err
+	}
+	export, err := a.db.GetExport(ctx, deletion.UID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if export.Key != "" {
+		err = a.blobs.Delete(ctx, export.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	e, err := events.New(events.UserDeleted, deletion.UID, events.User{UID: deletion.UID})
+	if err != nil {
+		return err
+	}
+	err = a.db.DeleteUser(ctx, deletion.UID, e)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// save ... Records how far the deletion has got
+func (a *Accounts) save(ctx context.Context, deletion *models.Deletion) error {
+	deletion.UpdatedAt = time.Now().UTC()
+	return a.db.UpdateDeletion(ctx, *deletion)
+}
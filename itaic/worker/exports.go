@@ -0,0 +1,265 @@
+package worker
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+)
+
+// ExportLifetime ... How long the download link to an archive works once it's built
+const ExportLifetime = 48 * time.Hour
+
+// Exports ... Builds archives of users' data from a store and the images in a blob store
+type Exports struct {
+	db    store.Store
+	blobs blob.Store
+}
+
+// NewExports ... Creates a worker that reads users' data from db and keeps the archives in blobs
+func NewExports(db store.Store, blobs blob.Store) *Exports {
+	return &Exports{db: db, blobs: blobs}
+}
+
+// Handle ... Builds the archive asked for in a user.export_requested event and marks it ready to
+// download, or failed if the user is gone. Jobs for archives that aren't being built any more are
+// skipped. Returns an error if the archive couldn't be built or saved, in which case the job
+// should be tried again later.
+func (x *Exports) Handle(ctx context.Context, e events.Event) error {
+	job := events.User{}
+	err := e.Decode(&job)
+	if err != nil {
+		fmt.Println("[ ! ] Skipping unreadable export job "+e.ID+": ", err)
+		return nil
+	}
+
+	export, err := x.db.GetExport(ctx, job.UID)
+	if err == store.ErrNotFound {
+		fmt.Println("[ - ] Skipping export job for " + job.UID + ", nothing was requested")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if export.Status != models.ExportPending && export.Status != models.ExportRunning {
+		return nil
+	}
+
+	export.Status = models.ExportRunning
+	err = x.save(ctx, &export)
+	if err != nil {
+		return err
+	}
+
+	// archives can be far bigger than fits in memory, so they're built on disk and streamed up
+	archive, err := ioutil.TempFile("", "itaic-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	err = x.build(ctx, job.UID, archive)
+	if err == store.ErrNotFound {
+		fmt.Println("[ - ] Not exporting the data of " + job.UID + ", the account is gone")
+		export.Status = models.ExportFailed
+		export.Error = "the account no longer exists"
+		return x.save(ctx, &export)
+	}
+	if err == nil {
+		_, err = archive.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = x.publish(ctx, &export, archive)
+	}
+	if err != nil {
+		fmt.Println("[ ! ] Error exporting the data of "+job.UID+": ", err)
+		export.Error = err.Error()
+		saveErr := x.save(ctx, &export)
+		if saveErr != nil {
+			fmt.Println("[ ! ] Error saving the export of "+job.UID+": ", saveErr)
+		}
+		return err
+	}
+
+	fmt.Println("[ + ] Exported the data of " + job.UID)
+	return nil
+}
+
+// publish ... Stores the archive under a new key and makes it downloadable, then deletes the last
+// one built
+func (x *Exports) publish(ctx context.Context, export *models.Export, archive io.Reader) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	key := blob.ExportKey(export.UID, token)
+
+	_, err = x.blobs.Put(ctx, key, "application/zip", archive)
+	if err != nil {
+		return err
+	}
+
+	last := export.Key
+	export.Status = models.ExportReady
+	export.Key = key
+	export.Token = token
+	export.Error = ""
+	export.Expires = time.Now().UTC().Add(ExportLifetime)
+	err = x.save(ctx, export)
+	if err != nil {
+		return err
+	}
+
+	// the old archive can't be downloaded any more, losing it only leaves a file behind
+	if last != "" && last != key {
+		err = x.blobs.Delete(ctx, last)
+		if err != nil {
+			fmt.Println("[ ! ] Error deleting the last export of "+export.UID+": ", err)
+		}
+	}
+	return nil
+}
+
+// build ... Zips up the user's profile, posts, comments, likes, followers and following as JSON,
+// along with the images they posted as they were uploaded, writing the archive to w. Images are
+// copied in one at a time rather than read whole.
+func (x *Exports) build(ctx context.Context, uid string, w io.Writer) error {
+	user, err := x.db.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	posts := []models.Post{}
+	for _, id := range user.Posts {
+		post, err := x.db.GetPost(ctx, id)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		posts = append(posts, post)
+	}
+
+	comments, err := x.db.UserComments(ctx, uid, 0)
+	if err != nil {
+		return err
+	}
+	likes, err := x.db.UserLikes(ctx, uid, 0)
+	if err != nil {
+		return err
+	}
+	followers, err := x.summaries(ctx, user.Followers)
+	if err != nil {
+		return err
+	}
+	following, err := x.summaries(ctx, user.Following)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", user},
+		{"posts.json", posts},
+		{"comments.json", comments},
+		{"likes.json", likes},
+		{"followers.json", followers},
+		{"following.json", following},
+	} {
+		entry, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(entry)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(file.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, post := range posts {
+		for i, key := range originals(post) {
+			image, err := x.blobs.Open(ctx, key)
+			if err == blob.ErrNotFound {
+				fmt.Println("[ - ] Leaving image " + key + " of post " + post.ID + " out of the export of " + uid + ", it's missing")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			entry, err := archive.Create("images/" + post.ID + "/" + strconv.Itoa(i+1) + path.Ext(key))
+			if err == nil {
+				_, err = io.Copy(entry, image)
+			}
+			image.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// originals ... The keys of a post's images in the order they're shown, as they were uploaded
+// where that was kept, or the largest size made from them where it wasn't
+func originals(post models.Post) []string {
+	keys := []string{}
+	for _, item := range post.Media {
+		key := item.Original
+		if key == "" {
+			key = blob.KeyOf(item.URL)
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(post.Media) == 0 {
+		if key := blob.KeyOf(post.ImageURL); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// summaries ... The summaries of the users with the given uids, leaving out any that are gone
+func (x *Exports) summaries(ctx context.Context, uids []string) ([]models.UserSummary, error) {
+	users, err := x.db.GetUsers(ctx, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []models.UserSummary{}
+	for _, user := range users {
+		summaries = append(summaries, user.Summary())
+	}
+	return summaries, nil
+}
+
+// save ... Records how building the archive went
+func (x *Exports) save(ctx context.Context, export *models.Export) error {
+	export.UpdatedAt = time.Now().UTC()
+	return x.db.UpdateExport(ctx, *export)
+}
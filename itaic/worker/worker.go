@@ -0,0 +1,208 @@
+// Package worker runs the jobs the API queues to be done in the background. Media jobs are queued
+// when a post is created, making the original uploads into the sizes the post is shown at and
+// marking the post ready, or failed with the reason. Deletion jobs delete a user's account along
+// with everything they left behind, and export jobs build an archive of it for them to download.
+package worker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmlattanzi/itaic-backend/events"
+	"github.com/jmlattanzi/itaic-backend/itaic/blob"
+	"github.com/jmlattanzi/itaic-backend/itaic/media"
+	"github.com/jmlattanzi/itaic-backend/itaic/models"
+	"github.com/jmlattanzi/itaic-backend/itaic/mq"
+	"github.com/jmlattanzi/itaic-backend/itaic/store"
+	"github.com/jmlattanzi/itaic-backend/itaic/timeline"
+)
+
+// retryDelays ... How long to wait before trying a job again after an error retrying might fix,
+// the length is how many retries a job gets before the post is marked failed
+var retryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// failed ... A job that can never work, like one for an upload that isn't an image
+type failed struct {
+	reason string
+}
+
+func (f failed) Error() string {
+	return f.reason
+}
+
+// Worker ... Processes media jobs against the posts in a store and the files in a blob store
+type Worker struct {
+	posts store.PostStore
+	blobs blob.Store
+}
+
+// New ... Creates a worker that reads originals from and writes images to blobs
+func New(posts store.PostStore, blobs blob.Store) *Worker {
+	return &Worker{posts: posts, blobs: blobs}
+}
+
+// Handle ... Runs the job in a media.requested event, retrying errors that might go away, and
+// marks the post failed if it can't be done. Jobs for posts that are gone or no longer processing
+// are skipped, so a job delivered twice is only done once. Only returns an error if the post
+// couldn't be marked either way, in which case the job should be tried again later.
+func (w *Worker) Handle(ctx context.Context, e events.Event) error {
+	job := events.Media{}
+	err := e.Decode(&job)
+	if err != nil {
+		fmt.Println("[ ! ] Skipping unreadable media job "+e.ID+": ", err)
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.process(ctx, job)
+		if _, ok := err.(failed); ok || err == nil || attempt == len(retryDelays) {
+			break
+		}
+
+		fmt.Println("[ ! ] Error processing image for post "+job.PostID+", retrying in "+retryDelays[attempt].String()+": ", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelays[attempt]):
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	reason := err.Error()
+	if _, ok := err.(failed); !ok {
+		reason = "the image couldn't be processed, try posting it again"
+	}
+	fmt.Println("[ ! ] Media job for post "+job.PostID+" failed: ", err)
+
+	updated, err := events.New(events.PostUpdated, job.UID, events.Post{ID: job.PostID, UID: job.UID})
+	if err != nil {
+		return err
+	}
+	err = w.posts.FinishMedia(ctx, job.PostID, store.MediaResult{Reason: reason}, updated)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// process ... Makes every one of the post's images and marks it ready
+func (w *Worker) process(ctx context.Context, job events.Media) error {
+	post, err := w.posts.GetPost(ctx, job.PostID)
+	if err == store.ErrNotFound {
+		fmt.Println("[ - ] Skipping media job for deleted post " + job.PostID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if post.Status != models.PostProcessing {
+		fmt.Println("[ - ] Skipping media job for post " + job.PostID + ", it's already " + post.Status)
+		return nil
+	}
+
+	if len(job.Items) == 0 {
+		return failed{"the post has no images"}
+	}
+
+	result := store.MediaResult{}
+	for i, upload := range job.Items {
+		item, err := w.image(ctx, job.PostID, upload)
+		if f, ok := err.(failed); ok && len(job.Items) > 1 {
+			return failed{"image " + strconv.Itoa(i+1) + ": " + f.reason}
+		}
+		if err != nil {
+			return err
+		}
+		result.Items = append(result.Items, item)
+	}
+
+	ready, err := events.New(events.PostReady, job.UID, events.Post{ID: post.ID, UID: post.UID, Score: timeline.Score(post)})
+	if err != nil {
+		return err
+	}
+	err = w.posts.FinishMedia(ctx, post.ID, result, ready)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("[ + ] Post " + post.ID + " is ready")
+	return nil
+}
+
+// image ... Makes one upload into every size and stores them under the post
+func (w *Worker) image(ctx context.Context, postID string, upload events.MediaItem) (models.MediaItem, error) {
+	item := models.MediaItem{ID: upload.ID}
+	data, err := w.blobs.Get(ctx, upload.Key)
+	if err == blob.ErrNotFound {
+		return item, failed{"the uploaded image is missing, try posting it again"}
+	}
+	if err != nil {
+		return item, err
+	}
+
+	processed, err := media.Process(data)
+	if err == media.ErrUnsupported || err == media.ErrTooLarge {
+		return item, failed{err.Error()}
+	}
+	if err != nil {
+		return item, err
+	}
+
+	for _, v := range []struct {
+		variant media.Variant
+		into    *models.ImageVariant
+	}{
+		{processed.Thumbnail, &item.Variants.Thumbnail},
+		{processed.Feed, &item.Variants.Feed},
+		{processed.Full, &item.Variants.Full},
+	} {
+		key := blob.Key(blob.PostOwner(postID), v.variant.Data, v.variant.ContentType)
+		location, err := w.blobs.Put(ctx, key, v.variant.ContentType, bytes.NewReader(v.variant.Data))
+		if err != nil {
+			return item, err
+		}
+		*v.into = models.ImageVariant{URL: location, Width: v.variant.Width, Height: v.variant.Height}
+	}
+
+	item.URL = item.Variants.Full.URL
+	item.Width = item.Variants.Full.Width
+	item.Height = item.Variants.Full.Height
+	item.Placeholder = processed.Placeholder
+	return item, nil
+}
+
+// Job ... Something that runs the jobs in one type of event
+type Job interface {
+	Handle(ctx context.Context, e events.Event) error
+}
+
+// Inline ... Publisher that runs jobs as soon as they're published, then passes every event on to
+// next, for running without RabbitMQ
+type Inline struct {
+	jobs map[string]Job
+	next mq.Publisher
+}
+
+// NewInline ... Creates a publisher that hands each event to the job for its type, if it has one
+func NewInline(next mq.Publisher, jobs map[string]Job) *Inline {
+	return &Inline{jobs: jobs, next: next}
+}
+
+// Publish ... Runs the event's job if it has one, then publishes it to next
+func (p *Inline) Publish(e events.Event) error {
+	if job, ok := p.jobs[e.Type]; ok {
+		err := job.Handle(context.Background(), e)
+		if err != nil {
+			return err
+		}
+	}
+	return p.next.Publish(e)
+}